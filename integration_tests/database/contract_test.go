@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"testing"
+
+	db "db_access/internal/database"
+	"db_access/tests/contract"
+
+	"github.com/pressly/goose/v3"
+)
+
+// backend is one database the integration suite runs against.
+type backend struct {
+	name string
+	// newMigrator returns a migrator for a database that lives until the test
+	// ends.
+	newMigrator func(t *testing.T) (*db.Migrator, error)
+	// open returns a service for a migrated database that lives until the
+	// test ends, along with a direct connection to the same database.
+	open func(t *testing.T) (db.DatabaseService, *sql.DB)
+	// unlockAuditLog are the statements that lift the audit log's append-only
+	// triggers, as someone with direct access to the database could.
+	unlockAuditLog []string
+}
+
+// backends are run by every parameterized test: Postgres in the test
+// container and SQLite in a temporary file.
+var backends = []backend{
+	{
+		name: "postgres",
+		newMigrator: func(t *testing.T) (*db.Migrator, error) {
+			return db.NewMigrator(containerDatabaseConfig().DataSourceName())
+		},
+		open:           openPostgres,
+		unlockAuditLog: []string{"ALTER TABLE user_audit_log DISABLE TRIGGER user_audit_log_append_only"},
+	},
+	{
+		name: "sqlite",
+		newMigrator: func(t *testing.T) (*db.Migrator, error) {
+			return db.NewSQLiteMigrator(filepath.Join(t.TempDir(), "db_access.sqlite"))
+		},
+		open: openSQLite,
+		unlockAuditLog: []string{
+			"DROP TRIGGER user_audit_log_append_only_update",
+			"DROP TRIGGER user_audit_log_append_only_delete",
+		},
+	},
+}
+
+func openPostgres(t *testing.T) (db.DatabaseService, *sql.DB) {
+	dataSourceName := containerDatabaseConfig().DataSourceName()
+
+	sqlDb, err := sql.Open("pgx", dataSourceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := goose.Up(sqlDb, "../../migrations"); err != nil {
+		log.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		t.Log("Cleaning up after test")
+		err := goose.DownTo(sqlDb, "../../migrations", 0)
+		if err != nil {
+			message := fmt.Sprintf("Error whilst cleaning migration: %v", err)
+			t.Log(message)
+		}
+		sqlDb.Close()
+	})
+
+	underTest, err := db.New(context.Background(), dataSourceName, containerDatabaseConfig().Pool, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(underTest.Close)
+	return underTest, sqlDb
+}
+
+func openSQLite(t *testing.T) (db.DatabaseService, *sql.DB) {
+	path := filepath.Join(t.TempDir(), "db_access.sqlite")
+
+	migrator, err := db.NewSQLiteMigrator(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = migrator.Up(context.Background())
+	migrator.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sqlDb, err := sql.Open("sqlite", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDb.Close() })
+
+	underTest, err := db.NewSQLite(context.Background(), path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(underTest.Close)
+	return underTest, sqlDb
+}
+
+func TestContract(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			contract.Run(t, func(t *testing.T) db.DatabaseService {
+				underTest, _ := backend.open(t)
+				return underTest
+			})
+		})
+	}
+}
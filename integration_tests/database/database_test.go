@@ -3,9 +3,11 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,7 +16,10 @@ import (
 	"db_access/internal/environment"
 	"math/rand"
 
-	_ "github.com/lib/pq" // Import the PostgreSQL driver
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/jackc/pgx/v5/stdlib" // Import the pgx database/sql driver for goose
 	"github.com/stretchr/testify/assert"
 
 	"github.com/pressly/goose/v3"
@@ -25,7 +30,7 @@ import (
 )
 
 var (
-	containerPort string
+	containerPort int
 	containerHost string
 	envPath       string = "../../.env"
 )
@@ -41,12 +46,15 @@ func randomString(n int) string {
 
 func mustStartPostgresContainer() (func(context.Context) error, error) {
 
-	_, _, _, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(envPath)
+	config, err := environment.Load(envPath)
+	if err != nil {
+		return nil, err
+	}
 
 	var (
-		dbName = postgresDb
-		dbPwd  = postgresPassword
-		dbUser = postgresUser
+		dbName = config.Database.Name
+		dbPwd  = config.Database.Password
+		dbUser = config.Database.User
 	)
 
 	dbContainer, err := postgres.Run(
@@ -75,12 +83,25 @@ func mustStartPostgresContainer() (func(context.Context) error, error) {
 	}
 
 	containerHost = dbHost
-	containerPort = strings.ReplaceAll(string(dbPort), "tcp", "")
-	containerPort = strings.ReplaceAll(containerPort, "/", "")
+	containerPort = dbPort.Int()
 
 	return dbContainer.Terminate, err
 }
 
+// containerDatabaseConfig returns the database config pointed at the postgres
+// container.
+func containerDatabaseConfig() environment.DatabaseConfig {
+	config, err := environment.Load(envPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config.Database.Host = containerHost
+	config.Database.Port = containerPort
+
+	return config.Database
+}
+
 func TestMain(m *testing.M) {
 	teardown, err := mustStartPostgresContainer()
 	if err != nil {
@@ -95,60 +116,72 @@ func TestMain(m *testing.M) {
 }
 
 func TestNew(t *testing.T) {
-	_, _, _, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(envPath)
+	dataSourceName := containerDatabaseConfig().DataSourceName()
 
-	dataSourceName := func(user, password, dbName, port, host string) string {
-		return fmt.Sprintf("user=%s password=%s dbname=%s port=%s host=%s sslmode=disable", user, password, dbName, port, host)
-	}(postgresUser, postgresPassword, postgresDb, containerPort, containerHost)
-
-	srv := db.New(dataSourceName)
+	srv, err := db.New(context.Background(), dataSourceName, containerDatabaseConfig().Pool, nil)
+	assert.Equal(t, nil, err, "Some error occurred connecting to the database. expected nil")
 	assert.NotEqual(t, nil, srv, "New() returned nil")
+	srv.Close()
 }
 
-func TestInsertNewUserSuccess(t *testing.T) {
-	userForInsertion := domain.User{
-		Username: "test user",
-		Email:    "test@email.com",
-	}
-
-	_, _, _, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(envPath)
+func TestNewUnreachableDatabaseFailure(t *testing.T) {
+	databaseConfig := containerDatabaseConfig()
+	databaseConfig.Name = "does_not_exist"
 
-	dataSourceName := func(user, password, dbName, port, host string) string {
-		return fmt.Sprintf("user=%s password=%s dbname=%s port=%s host=%s sslmode=disable", user, password, dbName, port, host)
-	}(postgresUser, postgresPassword, postgresDb, containerPort, containerHost)
+	srv, err := db.New(context.Background(), databaseConfig.DataSourceName(), databaseConfig.Pool, nil)
+	assert.NotEqual(t, nil, err, "Expected New() to fail when the database does not exist")
+	assert.Equal(t, nil, srv, "Expected New() to return no service when it fails")
+}
 
-	underTest := db.New(dataSourceName)
+func TestNewIndependentInstancesSuccess(t *testing.T) {
+	databaseConfig := containerDatabaseConfig()
+	dataSourceName := databaseConfig.DataSourceName()
 
-	sqlDb, err := sql.Open("postgres", dataSourceName)
+	first, err := db.New(context.Background(), dataSourceName, databaseConfig.Pool, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := goose.Up(sqlDb, "../../migrations"); err != nil {
+	smallerPool := databaseConfig.Pool
+	smallerPool.MaxConns = 1
+	second, err := db.New(context.Background(), dataSourceName, smallerPool, nil)
+	if err != nil {
 		log.Fatal(err)
 	}
+	t.Cleanup(second.Close)
 
-	t.Cleanup(func() {
-		t.Log("Cleaning up after test")
-		err := goose.DownTo(sqlDb, "../../migrations", 0)
-		if err != nil {
-			message := fmt.Sprintf("Error whilst cleaning migration: %v", err)
-			t.Log(message)
-		}
-		sqlDb.Close()
-	})
+	assert.Equal(t, databaseConfig.Pool.MaxConns, first.PoolStats().MaxConnections, "expected the first instance to keep its own pool")
+	assert.Equal(t, int32(1), second.PoolStats().MaxConnections, "expected the second instance to get its own pool")
 
-	userId, err := underTest.InsertNewUser(userForInsertion)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+	first.Close()
 
-	var count int
-	err = sqlDb.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
-	if err != nil {
-		log.Fatal(err)
+	health := second.Health(context.Background())
+	assert.Equal(t, "up", health.Status, fmt.Sprintf("expected closing one instance to leave the other usable. [error]: %v", health.Error))
+}
+
+func TestInsertNewUserSuccess(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user",
+		Email:    "test@email.com",
 	}
 
-	assert.Equal(t, 1, userId, fmt.Sprintf("Expected userId to equal to 1 got %v", userId))
-	assert.Equal(t, 1, count, fmt.Sprintf("Expected count to equal to 1 got %v", count))
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			var count int
+			err = sqlDb.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			assert.Equal(t, 1, userId, fmt.Sprintf("Expected userId to equal to 1 got %v", userId))
+			assert.Equal(t, 1, count, fmt.Sprintf("Expected count to equal to 1 got %v", count))
+		})
+	}
 }
 
 func TestInsertNewUserDuplicateUserEmailFailure(t *testing.T) {
@@ -163,89 +196,504 @@ func TestInsertNewUserDuplicateUserEmailFailure(t *testing.T) {
 		Email:    email,
 	}
 
-	_, _, _, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(envPath)
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, err = underTest.InsertNewUser(context.Background(), userForInsertion1)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			_, err = underTest.InsertNewUser(context.Background(), userForInsertion2)
+			_, isUniqueConstraintError := err.(*domain.UniqueConstraintDatabaseError)
+			assert.True(t, isUniqueConstraintError, "Expected an UniqueConstraintDatabaseError when inserting a user with an already existing email address")
+		})
+	}
+}
 
-	dataSourceName := func(user, password, dbName, port, host string) string {
-		return fmt.Sprintf("user=%s password=%s dbname=%s port=%s host=%s sslmode=disable", user, password, dbName, port, host)
-	}(postgresUser, postgresPassword, postgresDb, containerPort, containerHost)
+func TestGetUsersPageTombstoneSuccess(t *testing.T) {
+	userForInsertion1 := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
 
-	underTest := db.New(dataSourceName)
+	userForInsertion2 := domain.User{
+		Username: "test user 2",
+		Email:    "email2@email.com",
+	}
 
-	sqlDb, err := sql.Open("postgres", dataSourceName)
-	if err != nil {
-		log.Fatal(err)
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			var err error
+			_, err = underTest.InsertNewUser(context.Background(), userForInsertion1)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion2)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			// insert into tombstone with the userId above
+			stmt := "INSERT INTO user_deletes(user_id) VALUES($1)"
+			_, err = sqlDb.Exec(stmt, userId)
+			if err != nil {
+				log.Fatal(err)
+			}
+			users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+
+			assert.Equal(t, 1, len(users), "expected GetUsersPage() to return a list of length equal to 1")
+		})
 	}
+}
 
-	if err := goose.Up(sqlDb, "../../migrations"); err != nil {
-		log.Fatal(err)
+func TestSoftDeleteUserSuccess(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
 	}
 
-	t.Cleanup(func() {
-		t.Log("Cleaning up after test")
-		err := goose.DownTo(sqlDb, "../../migrations", 0)
-		if err != nil {
-			message := fmt.Sprintf("Error whilst cleaning migration: %v", err)
-			t.Log(message)
-		}
-		sqlDb.Close()
-	})
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			err = underTest.SoftDeleteUser(context.Background(), userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
 
-	_, err = underTest.InsertNewUser(userForInsertion1)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
-	_, err = underTest.InsertNewUser(userForInsertion2)
-	_, isUniqueConstraintError := err.(*domain.UniqueConstraintDatabaseError)
-	assert.True(t, isUniqueConstraintError, "Expected an UniqueConstraintDatabaseError when inserting a user with an already existing email address")
+			query := "SELECT COUNT(*) FROM user_deletes ud WHERE ud.user_id = $1"
+			var count int
+			err = sqlDb.QueryRow(query, userId).Scan(&count)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			assert.Equal(t, 1, count, "expected SoftDeleteUser() to persist 1 row to the user_deletes table")
+		})
+	}
 }
 
-func TestGetAllUsersSuccess(t *testing.T) {
-	userForInsertion1 := domain.User{
+func TestSoftDeleteUserNotFoundFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			err := underTest.SoftDeleteUser(context.Background(), 999, nil)
+
+			var notFoundError *domain.UserNotFoundError
+			assert.True(t, errors.As(err, &notFoundError), fmt.Sprintf("Expected a UserNotFoundError when deleting a user that does not exist. [actual]: %v", err))
+
+			assert.NotNil(t, errors.Unwrap(err), "Expected the foreign key violation to be wrapped")
+			if backend.name == "postgres" {
+				var pgErr *pgconn.PgError
+				assert.True(t, errors.As(err, &pgErr), "Expected the foreign key violation to be wrapped")
+				assert.Equal(t, "23503", pgErr.Code, "Expected the foreign key violation to be wrapped")
+			}
+		})
+	}
+}
+
+func TestSoftDeleteUserAlreadyDeletedFailure(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			err = underTest.SoftDeleteUser(context.Background(), userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+			err = underTest.SoftDeleteUser(context.Background(), userId, nil)
+
+			var deletedError *domain.UserDeletedError
+			assert.True(t, errors.As(err, &deletedError), fmt.Sprintf("Expected a UserDeletedError when deleting a user twice. [actual]: %v", err))
+
+			history, err := underTest.GetUserHistory(context.Background(), userId)
+			assert.Equal(t, nil, err, "Some error occurred reading the history. expected nil")
+			assert.Equal(t, 2, len(history), "expected the second delete not to be recorded")
+		})
+	}
+}
+
+func TestGetUserByIDTimeoutFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+			defer cancel()
+			time.Sleep(time.Millisecond)
+
+			_, err = underTest.GetUserByID(ctx, 1)
+
+			assert.True(t, errors.Is(err, context.DeadlineExceeded), fmt.Sprintf("Expected the deadline to be wrapped. [actual]: %v", err))
+		})
+	}
+}
+
+func TestGetUserByIDSuccess(t *testing.T) {
+	userForInsertion := domain.User{
 		Username: "test user 1",
 		Email:    "email1@email.com",
 	}
 
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			user, err := underTest.GetUserByID(context.Background(), userId)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the user. expected nil")
+
+			expected := domain.User{ID: userId, Username: userForInsertion.Username, Email: userForInsertion.Email, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt, Version: 1}
+			assert.Equal(t, expected, user, "expected GetUserByID() to return the inserted user")
+		})
+	}
+}
+
+func TestGetUserByIDUserNotFoundFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, err = underTest.GetUserByID(context.Background(), 999)
+			_, isUserNotFoundError := err.(*domain.UserNotFoundError)
+			assert.True(t, isUserNotFoundError, "Expected a UserNotFoundError when retrieving a user that does not exist")
+		})
+	}
+}
+
+func TestGetUserByIDUserDeletedFailure(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			err = underTest.SoftDeleteUser(context.Background(), userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+			_, err = underTest.GetUserByID(context.Background(), userId)
+			_, isUserDeletedError := err.(*domain.UserDeletedError)
+			assert.True(t, isUserDeletedError, "Expected a UserDeletedError when retrieving a user that has been deleted")
+		})
+	}
+}
+
+func TestUpdateUserSuccess(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			replacement := domain.User{Username: "updated user", Email: "updated@email.com"}
+			user, err := underTest.UpdateUser(context.Background(), userId, replacement, nil)
+			assert.Equal(t, nil, err, "Some error occurred updating the user. expected nil")
+
+			expected := domain.User{ID: userId, Username: replacement.Username, Email: replacement.Email, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt, Version: 2}
+			assert.Equal(t, expected, user, "expected UpdateUser() to return the updated user")
+
+			persisted, err := underTest.GetUserByID(context.Background(), userId)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the user. expected nil")
+			assert.Equal(t, expected, persisted, "expected UpdateUser() to persist the updated user")
+		})
+	}
+}
+
+func TestUpdateUserUserNotFoundFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, err = underTest.UpdateUser(context.Background(), 999, domain.User{Username: "updated user", Email: "updated@email.com"}, nil)
+			_, isUserNotFoundError := err.(*domain.UserNotFoundError)
+			assert.True(t, isUserNotFoundError, "Expected a UserNotFoundError when updating a user that does not exist")
+		})
+	}
+}
+
+func TestPatchUserSuccess(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			username := "patched user"
+			user, err := underTest.PatchUser(context.Background(), userId, domain.UserPatch{Username: &username}, nil)
+			assert.Equal(t, nil, err, "Some error occurred patching the user. expected nil")
+
+			expected := domain.User{ID: userId, Username: username, Email: userForInsertion.Email, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt, Version: 2}
+			assert.Equal(t, expected, user, "expected PatchUser() to only change the username")
+		})
+	}
+}
+
+func TestPatchUserDuplicateUserEmailFailure(t *testing.T) {
+	userForInsertion1 := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
 	userForInsertion2 := domain.User{
 		Username: "test user 2",
 		Email:    "email2@email.com",
 	}
 
-	_, _, _, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(envPath)
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, err = underTest.InsertNewUser(context.Background(), userForInsertion1)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion2)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			_, err = underTest.PatchUser(context.Background(), userId, domain.UserPatch{Email: &userForInsertion1.Email}, nil)
+			_, isUniqueConstraintError := err.(*domain.UniqueConstraintDatabaseError)
+			assert.True(t, isUniqueConstraintError, "Expected an UniqueConstraintDatabaseError when patching a user to an already existing email address")
+		})
+	}
+}
+
+func TestRestoreUserSuccess(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
 
-	dataSourceName := func(user, password, dbName, port, host string) string {
-		return fmt.Sprintf("user=%s password=%s dbname=%s port=%s host=%s sslmode=disable", user, password, dbName, port, host)
-	}(postgresUser, postgresPassword, postgresDb, containerPort, containerHost)
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			err = underTest.SoftDeleteUser(context.Background(), userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
 
-	underTest := db.New(dataSourceName)
+			user, err := underTest.RestoreUser(context.Background(), userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred restoring the user. expected nil")
 
-	sqlDb, err := sql.Open("postgres", dataSourceName)
-	if err != nil {
-		log.Fatal(err)
+			expected := domain.User{ID: userId, Username: userForInsertion.Username, Email: userForInsertion.Email, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt, Version: 3}
+			assert.Equal(t, expected, user, "expected RestoreUser() to return the restored user")
+
+			query := "SELECT COUNT(*) FROM user_deletes ud WHERE ud.user_id = $1"
+			var count int
+			err = sqlDb.QueryRow(query, userId).Scan(&count)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			assert.Equal(t, 0, count, "expected RestoreUser() to remove the user_deletes row")
+		})
 	}
+}
 
-	if err := goose.Up(sqlDb, "../../migrations"); err != nil {
-		log.Fatal(err)
+func TestRestoreUserNotDeletedFailure(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
 	}
 
-	t.Cleanup(func() {
-		t.Log("Cleaning up after test")
-		err := goose.DownTo(sqlDb, "../../migrations", 0)
-		if err != nil {
-			message := fmt.Sprintf("Error whilst cleaning migration: %v", err)
-			t.Log(message)
-		}
-		sqlDb.Close()
-	})
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			_, err = underTest.RestoreUser(context.Background(), userId, nil)
+			_, isUserNotDeletedError := err.(*domain.UserNotDeletedError)
+			assert.True(t, isUserNotDeletedError, "Expected a UserNotDeletedError when restoring a user that has not been deleted")
+		})
+	}
+}
+
+func TestRestoreUserUserNotFoundFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, err = underTest.RestoreUser(context.Background(), 999, nil)
+			_, isUserNotFoundError := err.(*domain.UserNotFoundError)
+			assert.True(t, isUserNotFoundError, "Expected a UserNotFoundError when restoring a user that does not exist")
+		})
+	}
+}
+
+func TestGetUsersPageSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			var userIds []int
+			for i := 1; i <= 5; i++ {
+				userId, err := underTest.InsertNewUser(context.Background(), domain.User{
+					Username: fmt.Sprintf("test user %d", i),
+					Email:    fmt.Sprintf("email%d@email.com", i),
+				})
+				assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+				userIds = append(userIds, userId)
+			}
+			err = underTest.SoftDeleteUser(context.Background(), userIds[1], nil)
+			assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+			firstPage, next, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 2})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.NotNil(t, next, "expected GetUsersPage() to return a cursor for another page")
+			assert.Equal(t, []int{userIds[0], userIds[2]}, []int{firstPage[0].ID, firstPage[1].ID}, "expected the first page to skip the deleted user")
+
+			secondPage, next, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{After: next, Limit: 2})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Nil(t, next, "expected GetUsersPage() to report the last page")
+			assert.Equal(t, []int{userIds[3], userIds[4]}, []int{secondPage[0].ID, secondPage[1].ID}, "expected the second page to continue after the cursor")
+		})
+	}
+}
 
-	_, err = underTest.InsertNewUser(userForInsertion1)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
-	_, err = underTest.InsertNewUser(userForInsertion2)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+func TestGetUsersPageFilterAndSortSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			usersForInsertion := []domain.User{
+				{Username: "alice", Email: "alice@example.com"},
+				{Username: "albert", Email: "albert@example.com"},
+				{Username: "alfred", Email: "alfred@other.com"},
+				{Username: "al_x", Email: "alx@EXAMPLE.com"},
+				{Username: "bob", Email: "bob@example.com"},
+			}
+			for _, user := range usersForInsertion {
+				_, err := underTest.InsertNewUser(context.Background(), user)
+				assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			}
+
+			query := domain.UsersQuery{
+				UsernamePrefix: "al",
+				EmailDomain:    "example.com",
+				Sort:           []domain.SortField{{Field: "username", Descending: true}},
+				Limit:          2,
+			}
+
+			firstPage, next, err := underTest.GetUsersPage(context.Background(), query)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Equal(t, []string{"alice", "albert"}, []string{firstPage[0].Username, firstPage[1].Username}, "expected the first page to be filtered and sorted by username descending")
+
+			query.After = next
+			secondPage, next, err := underTest.GetUsersPage(context.Background(), query)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Nil(t, next, "expected GetUsersPage() to report the last page")
+			assert.Equal(t, 1, len(secondPage), "expected the second page to hold the remaining user")
+			assert.Equal(t, "al_x", secondPage[0].Username, "expected the second page to continue after the cursor")
+
+			query = domain.UsersQuery{UsernamePrefix: "al_", Limit: 10}
+			literalPrefix, _, err := underTest.GetUsersPage(context.Background(), query)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Equal(t, 1, len(literalPrefix), "expected an underscore in the username prefix to be matched literally")
+
+			createdBefore := time.Now().Add(-time.Hour)
+			query = domain.UsersQuery{CreatedBefore: &createdBefore, Limit: 10}
+			noneCreated, _, err := underTest.GetUsersPage(context.Background(), query)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Equal(t, 0, len(noneCreated), "expected no users to have been created before an hour ago")
+		})
+	}
+}
 
-	getAllUsersResponse, _ := underTest.GetAllUsers()
+func TestGetUsersPageByteOrderSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			for _, username := range []string{"alice", "Zoe", "bob", "Carl"} {
+				_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: username, Email: username + "@example.com"})
+				assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			}
+
+			query := domain.UsersQuery{Sort: []domain.SortField{{Field: "username"}}, Limit: 2}
+			firstPage, next, err := underTest.GetUsersPage(context.Background(), query)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Equal(t, []string{"Carl", "Zoe"}, []string{firstPage[0].Username, firstPage[1].Username}, "expected upper case usernames first, in byte order")
+
+			query.After = next
+			secondPage, next, err := underTest.GetUsersPage(context.Background(), query)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Nil(t, next, "expected GetUsersPage() to report the last page")
+			assert.Equal(t, []string{"alice", "bob"}, []string{secondPage[0].Username, secondPage[1].Username}, "expected the cursor to continue in byte order")
+		})
+	}
+}
 
-	assert.Equal(t, 2, len(getAllUsersResponse), "expected GetAllUsers() to return a list of length equal to 2")
+func TestGetUsersPageUnknownSortFieldFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, _, err = underTest.GetUsersPage(context.Background(), domain.UsersQuery{Sort: []domain.SortField{{Field: "password"}}, Limit: 10})
+			invalidQueryError, isInvalidQueryError := err.(*domain.InvalidQueryError)
+			assert.True(t, isInvalidQueryError, "Expected an InvalidQueryError when sorting by a field that is not whitelisted")
+			assert.Equal(t, "sort", invalidQueryError.Parameter, "Expected the InvalidQueryError to name the sort parameter")
+		})
+	}
 }
 
-func TestGetAllUsersTombstoneSuccess(t *testing.T) {
+func TestUserTimestampsSuccess(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the users. expected nil")
+			assert.NotNil(t, users[0].CreatedAt, "expected GetUsersPage() to return created_at")
+			assert.Equal(t, *users[0].CreatedAt, *users[0].UpdatedAt, "expected updated_at to equal created_at before any update")
+
+			username := "patched user"
+			patchedUser, err := underTest.PatchUser(context.Background(), userId, domain.UserPatch{Username: &username}, nil)
+			assert.Equal(t, nil, err, "Some error occurred patching the user. expected nil")
+			assert.True(t, patchedUser.UpdatedAt.After(*patchedUser.CreatedAt), "expected the trigger to move updated_at on update")
+		})
+	}
+}
+
+func TestGetUsersPageIncludeDeletedSuccess(t *testing.T) {
 	userForInsertion1 := domain.User{
 		Username: "test user 1",
 		Email:    "email1@email.com",
@@ -256,14 +704,72 @@ func TestGetAllUsersTombstoneSuccess(t *testing.T) {
 		Email:    "email2@email.com",
 	}
 
-	_, _, _, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(envPath)
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, err = underTest.InsertNewUser(context.Background(), userForInsertion1)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion2)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			err = underTest.SoftDeleteUser(context.Background(), userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+			activeUsers, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Equal(t, 1, len(activeUsers), "expected GetUsersPage() to leave out the deleted user by default")
+
+			allUsers, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{IncludeDeleted: true, Limit: 10})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the page. expected nil")
+			assert.Equal(t, 2, len(allUsers), "expected GetUsersPage() to include the deleted user")
+			assert.Nil(t, allUsers[0].DeletedAt, "expected the active user to have no deleted_at")
+			assert.NotNil(t, allUsers[1].DeletedAt, "expected the deleted user to have a deleted_at")
+		})
+	}
+}
+
+func TestHealthSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			health := underTest.Health(context.Background())
+			assert.Equal(t, "up", health.Status, fmt.Sprintf("Expected the database to be up. [error]: %v", health.Error))
+
+			latestVersion, err := db.LatestMigrationVersion()
+			assert.Equal(t, nil, err, "Some error occurred reading the migrations. expected nil")
+			assert.Equal(t, latestVersion, health.MigrationVersion, "expected Health() to report the latest migration as applied")
+		})
+	}
+}
+
+func TestGetUsersPageCancelledContextFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
 
-	dataSourceName := func(user, password, dbName, port, host string) string {
-		return fmt.Sprintf("user=%s password=%s dbname=%s port=%s host=%s sslmode=disable", user, password, dbName, port, host)
-	}(postgresUser, postgresPassword, postgresDb, containerPort, containerHost)
-	underTest := db.New(dataSourceName)
+			var err error
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
 
-	sqlDb, err := sql.Open("postgres", dataSourceName)
+			_, _, err = underTest.GetUsersPage(ctx, domain.UsersQuery{Limit: 10})
+			assert.NotEqual(t, nil, err, "Expected an error when retrieving users with a cancelled context")
+		})
+	}
+}
+
+func TestPoolStatsSuccess(t *testing.T) {
+	databaseConfig := containerDatabaseConfig()
+	dataSourceName := databaseConfig.DataSourceName()
+
+	underTest, err := db.New(context.Background(), dataSourceName, databaseConfig.Pool, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(underTest.Close)
+
+	sqlDb, err := sql.Open("pgx", dataSourceName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -282,37 +788,542 @@ func TestGetAllUsersTombstoneSuccess(t *testing.T) {
 		sqlDb.Close()
 	})
 
-	_, err = underTest.InsertNewUser(userForInsertion1)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
-	userId, err := underTest.InsertNewUser(userForInsertion2)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+	_, _, err = underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred retrieving the users. expected nil")
 
-	// insert into tombstone with the userId above
-	stmt := "INSERT INTO user_deletes(user_id) VALUES($1)"
-	_, err = sqlDb.Exec(stmt, userId)
-	if err != nil {
-		log.Fatal(err)
+	stats := underTest.PoolStats()
+	assert.Equal(t, databaseConfig.Pool.MaxConns, stats.MaxConnections, "expected PoolStats() to report the configured max conns")
+	assert.GreaterOrEqual(t, stats.TotalConnections, int32(1), "expected the pool to hold at least one connection")
+	assert.GreaterOrEqual(t, stats.AcquireCount, int64(1), "expected the pool to have been acquired from")
+	assert.Equal(t, int32(0), stats.AcquiredConnections, "expected every connection to be released")
+}
+
+func TestInsertUsersSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			users := []domain.User{
+				{Username: "first", Email: "first@email.com"},
+				{Username: "second", Email: "second@email.com"},
+			}
+
+			results, err := underTest.InsertUsers(context.Background(), users, domain.BatchInsertOptions{Atomic: true})
+			assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+
+			expected := []domain.BatchUserResult{
+				{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+				{Index: 1, Status: domain.BatchUserCreated, ID: 2},
+			}
+			assert.Equal(t, expected, results, "expected every user to be created")
+
+			var count int
+			err = sqlDb.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+			if err != nil {
+				log.Fatal(err)
+			}
+			assert.Equal(t, 2, count, fmt.Sprintf("Expected count to equal to 2 got %v", count))
+		})
 	}
-	getAllUsersResponse, _ := underTest.GetAllUsers()
+}
 
-	assert.Equal(t, 1, len(getAllUsersResponse), "expected GetAllUsers() to return a list of length equal to 1")
+func TestInsertUsersDuplicateEmailsFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			var err error
+			_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: "existing", Email: "existing@email.com"})
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			users := []domain.User{
+				{Username: "first", Email: "first@email.com"},
+				{Username: "existing", Email: "existing@email.com"},
+				{Username: "again", Email: "first@email.com"},
+			}
+
+			results, err := underTest.InsertUsers(context.Background(), users, domain.BatchInsertOptions{})
+			assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+			assert.Equal(t, 3, len(results), "expected a result for every user")
+			assert.Equal(t, domain.BatchUserCreated, results[0].Status, "expected the first user to be created")
+			assert.Equal(t, domain.BatchUserFailed, results[1].Status, "expected the existing email to fail")
+			assert.Equal(t, "email is already used", results[1].Error, "expected the existing email to be reported")
+			assert.Equal(t, domain.BatchUserFailed, results[2].Status, "expected the repeated email to fail")
+			assert.Equal(t, "email is already used earlier in this batch", results[2].Error, "expected the repeated email to be reported")
+
+			var count int
+			err = sqlDb.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+			if err != nil {
+				log.Fatal(err)
+			}
+			assert.Equal(t, 2, count, fmt.Sprintf("Expected count to equal to 2 got %v", count))
+		})
+	}
 }
 
-func TestSoftDeleteUserSuccess(t *testing.T) {
+func TestInsertUsersAtomicRollsBackFailure(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			var err error
+			_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: "existing", Email: "existing@email.com"})
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			users := []domain.User{
+				{Username: "first", Email: "first@email.com"},
+				{Username: "existing", Email: "existing@email.com"},
+			}
+
+			results, err := underTest.InsertUsers(context.Background(), users, domain.BatchInsertOptions{Atomic: true})
+			assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+
+			expected := []domain.BatchUserResult{
+				{Index: 0, Status: domain.BatchUserRolledBack},
+				{Index: 1, Status: domain.BatchUserFailed, Error: "email is already used"},
+			}
+			assert.Equal(t, expected, results, "expected the whole batch to be rolled back")
+
+			var count int
+			err = sqlDb.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+			if err != nil {
+				log.Fatal(err)
+			}
+			assert.Equal(t, 1, count, fmt.Sprintf("Expected count to equal to 1 got %v", count))
+		})
+	}
+}
+
+func TestInsertUsersDryRunSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			users := []domain.User{
+				{Username: "first", Email: "first@email.com"},
+				{Username: "again", Email: "first@email.com"},
+			}
+
+			results, err := underTest.InsertUsers(context.Background(), users, domain.BatchInsertOptions{DryRun: true})
+			assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+
+			expected := []domain.BatchUserResult{
+				{Index: 0, Status: domain.BatchUserValid},
+				{Index: 1, Status: domain.BatchUserFailed, Error: "email is already used earlier in this batch"},
+			}
+			assert.Equal(t, expected, results, "expected the dry run to report each user")
+
+			var count int
+			err = sqlDb.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+			if err != nil {
+				log.Fatal(err)
+			}
+			assert.Equal(t, 0, count, fmt.Sprintf("Expected count to equal to 0 got %v", count))
+		})
+	}
+}
+
+func TestExportUsersSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			var err error
+			_, err = underTest.InsertUsers(context.Background(), []domain.User{
+				{Username: "first", Email: "first@email.com"},
+				{Username: "second", Email: "second@email.com"},
+			}, domain.BatchInsertOptions{})
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = underTest.SoftDeleteUser(context.Background(), 2, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			var active []domain.User
+			err = underTest.ExportUsers(context.Background(), false, func(user domain.User) error {
+				active = append(active, user)
+				return nil
+			})
+			assert.Equal(t, nil, err, "Some error occurred exporting the users. expected nil")
+			assert.Equal(t, 1, len(active), "expected the export to leave out the deleted user")
+
+			var all []domain.User
+			err = underTest.ExportUsers(context.Background(), true, func(user domain.User) error {
+				all = append(all, user)
+				return nil
+			})
+			assert.Equal(t, nil, err, "Some error occurred exporting the users. expected nil")
+			assert.Equal(t, 2, len(all), "expected the export to include the deleted user")
+			assert.NotNil(t, all[1].DeletedAt, "expected the deleted user to have a deleted_at")
+
+			stop := errors.New("stop")
+			err = underTest.ExportUsers(context.Background(), true, func(user domain.User) error {
+				return stop
+			})
+			assert.Equal(t, stop, err, "expected the error from yield to stop the export")
+		})
+	}
+}
+
+func TestIdempotencyKeySuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			held, reserved, err := underTest.ReserveIdempotencyKey(context.Background(), "key-1", "hash-1", time.Hour)
+			assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+			assert.Equal(t, true, reserved, "expected an unused key to be reserved")
+
+			record, reserved, err := underTest.ReserveIdempotencyKey(context.Background(), "key-1", "hash-1", time.Hour)
+			assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+			assert.Equal(t, false, reserved, "expected a key in use not to be reserved again")
+			assert.Equal(t, 0, record.StatusCode, "expected a key in progress to have no stored response")
+
+			userId := 7
+			err = underTest.CompleteIdempotencyKey(context.Background(), "key-1", held.LeaseToken, 201, []byte(`{"userId":7}`), &userId, time.Hour)
+			assert.Equal(t, nil, err, "Some error occurred completing the key. expected nil")
+
+			record, reserved, err = underTest.ReserveIdempotencyKey(context.Background(), "key-1", "hash-1", time.Hour)
+			assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+			assert.Equal(t, false, reserved, "expected a completed key not to be reserved again")
+			assert.Equal(t, "hash-1", record.RequestHash, "expected the stored request hash")
+			assert.Equal(t, 201, record.StatusCode, "expected the stored status code")
+			assert.Equal(t, `{"userId":7}`, string(record.Body), "expected the stored response body")
+			assert.Equal(t, &userId, record.UserID, "expected the stored user id")
+
+			err = underTest.ReleaseIdempotencyKey(context.Background(), "key-1", held.LeaseToken)
+			_, isLeaseLost := err.(*domain.IdempotencyLeaseLostError)
+			assert.True(t, isLeaseLost, "expected a completed key not to be released")
+
+			held, _, err = underTest.ReserveIdempotencyKey(context.Background(), "key-2", "hash-1", time.Hour)
+			assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+			err = underTest.ReleaseIdempotencyKey(context.Background(), "key-2", held.LeaseToken)
+			assert.Equal(t, nil, err, "Some error occurred releasing the key. expected nil")
+
+			_, reserved, err = underTest.ReserveIdempotencyKey(context.Background(), "key-2", "hash-2", time.Hour)
+			assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+			assert.Equal(t, true, reserved, "expected a released key to be reserved again")
+		})
+	}
+}
+
+func TestIdempotencyKeyExpiredSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			_, reserved, err := underTest.ReserveIdempotencyKey(context.Background(), "key-1", "hash-1", time.Millisecond)
+			assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+			assert.Equal(t, true, reserved, "expected an unused key to be reserved")
+
+			time.Sleep(10 * time.Millisecond)
+
+			_, reserved, err = underTest.ReserveIdempotencyKey(context.Background(), "key-1", "hash-2", time.Hour)
+			assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+			assert.Equal(t, true, reserved, "expected an expired key to be reserved again")
+		})
+	}
+}
+
+func TestUpdateUserVersionMismatchFailure(t *testing.T) {
 	userForInsertion := domain.User{
 		Username: "test user 1",
 		Email:    "email1@email.com",
 	}
 
-	_, _, _, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(envPath)
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
 
-	dataSourceName := func(user, password, dbName, port, host string) string {
-		return fmt.Sprintf("user=%s password=%s dbname=%s port=%s host=%s sslmode=disable", user, password, dbName, port, host)
-	}(postgresUser, postgresPassword, postgresDb, containerPort, containerHost)
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
 
-	underTest := db.New(dataSourceName)
+			version := 1
+			user, err := underTest.UpdateUser(context.Background(), userId, domain.User{Username: "first edit", Email: userForInsertion.Email}, &version)
+			assert.Equal(t, nil, err, "Some error occurred updating the user. expected nil")
+			assert.Equal(t, 2, user.Version, "expected UpdateUser() to increment the version")
 
-	sqlDb, err := sql.Open("postgres", dataSourceName)
+			_, err = underTest.UpdateUser(context.Background(), userId, domain.User{Username: "stale edit", Email: userForInsertion.Email}, &version)
+			_, isPreconditionFailedError := err.(*domain.PreconditionFailedError)
+			assert.True(t, isPreconditionFailedError, fmt.Sprintf("Expected a PreconditionFailedError when updating a stale version. [actual]: %v", err))
+
+			username := "stale patch"
+			_, err = underTest.PatchUser(context.Background(), userId, domain.UserPatch{Username: &username}, &version)
+			_, isPreconditionFailedError = err.(*domain.PreconditionFailedError)
+			assert.True(t, isPreconditionFailedError, fmt.Sprintf("Expected a PreconditionFailedError when patching a stale version. [actual]: %v", err))
+
+			persisted, err := underTest.GetUserByID(context.Background(), userId)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the user. expected nil")
+			assert.Equal(t, "first edit", persisted.Username, "expected the stale changes not to be persisted")
+			assert.Equal(t, 2, persisted.Version, "expected the stale changes not to increment the version")
+		})
+	}
+}
+
+func TestSoftDeleteUserVersionMismatchFailure(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			userId, err := underTest.InsertNewUser(context.Background(), userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+			_, err = underTest.UpdateUser(context.Background(), userId, domain.User{Username: "edited", Email: userForInsertion.Email}, nil)
+			assert.Equal(t, nil, err, "Some error occurred updating the user. expected nil")
+
+			staleVersion := 1
+			err = underTest.SoftDeleteUser(context.Background(), userId, &staleVersion)
+			_, isPreconditionFailedError := err.(*domain.PreconditionFailedError)
+			assert.True(t, isPreconditionFailedError, fmt.Sprintf("Expected a PreconditionFailedError when deleting a stale version. [actual]: %v", err))
+
+			currentVersion := 2
+			err = underTest.SoftDeleteUser(context.Background(), userId, &currentVersion)
+			assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+			missingUserVersion := 1
+			err = underTest.SoftDeleteUser(context.Background(), 999, &missingUserVersion)
+			_, isUserNotFoundError := err.(*domain.UserNotFoundError)
+			assert.True(t, isUserNotFoundError, fmt.Sprintf("Expected a UserNotFoundError when deleting a user that does not exist. [actual]: %v", err))
+		})
+	}
+}
+
+func TestUserHistorySuccess(t *testing.T) {
+	userForInsertion := domain.User{
+		Username: "test user 1",
+		Email:    "email1@email.com",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			ctx := domain.WithAuditContext(context.Background(), domain.AuditContext{Actor: "admin", RequestID: "request-1", ClientIP: "192.0.2.10"})
+
+			userId, err := underTest.InsertNewUser(ctx, userForInsertion)
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			_, err = underTest.UpdateUser(ctx, userId, domain.User{Username: "updated user", Email: userForInsertion.Email}, nil)
+			assert.Equal(t, nil, err, "Some error occurred updating the user. expected nil")
+			err = underTest.SoftDeleteUser(ctx, userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+			_, err = underTest.RestoreUser(context.Background(), userId, nil)
+			assert.Equal(t, nil, err, "Some error occurred restoring the user. expected nil")
+
+			history, err := underTest.GetUserHistory(context.Background(), userId)
+			assert.Equal(t, nil, err, "Some error occurred retrieving the history. expected nil")
+
+			var actions []string
+			for _, entry := range history {
+				actions = append(actions, entry.Action)
+			}
+			assert.Equal(t, []string{"insert", "update", "delete", "restore"}, actions, "expected every change to be recorded in order")
+
+			deleteEntry := history[2]
+			assert.Equal(t, "admin", deleteEntry.Actor, "expected the actor to be recorded")
+			assert.Equal(t, "request-1", deleteEntry.RequestID, "expected the request id to be recorded")
+			assert.Equal(t, "192.0.2.10", deleteEntry.ClientIP, "expected the client ip to be recorded")
+
+			var before, after domain.User
+			json.Unmarshal(deleteEntry.Before, &before)
+			json.Unmarshal(deleteEntry.After, &after)
+			assert.Equal(t, "updated user", before.Username, "expected the user before the delete to be recorded")
+			assert.Nil(t, before.DeletedAt, "expected the user before the delete not to be deleted")
+			assert.NotNil(t, after.DeletedAt, "expected the user after the delete to be deleted")
+			assert.Equal(t, "null", string(history[0].Before), "expected an insert to have no before state")
+			assert.Equal(t, "unknown", history[3].Actor, "expected a change without an audit context to have an unknown actor")
+
+			_, err = underTest.GetUserHistory(context.Background(), 999)
+			_, isUserNotFoundError := err.(*domain.UserNotFoundError)
+			assert.True(t, isUserNotFoundError, fmt.Sprintf("Expected a UserNotFoundError for the history of a user that does not exist. [actual]: %v", err))
+		})
+	}
+}
+
+func TestAuditLogSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, sqlDb := backend.open(t)
+
+			var err error
+			adminCtx := domain.WithAuditContext(context.Background(), domain.AuditContext{Actor: "admin"})
+			importCtx := domain.WithAuditContext(context.Background(), domain.AuditContext{Actor: "importer"})
+
+			_, err = underTest.InsertNewUser(adminCtx, domain.User{Username: "first", Email: "first@email.com"})
+			assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+			_, err = underTest.InsertUsers(importCtx, []domain.User{
+				{Username: "second", Email: "second@email.com"},
+				{Username: "third", Email: "third@email.com"},
+			}, domain.BatchInsertOptions{})
+			assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+			_, err = underTest.InsertUsers(importCtx, []domain.User{{Username: "dry", Email: "dry@email.com"}}, domain.BatchInsertOptions{DryRun: true})
+			assert.Equal(t, nil, err, "Some error occurred validating the users. expected nil")
+
+			firstPage, next, err := underTest.GetAuditLog(context.Background(), domain.AuditQuery{Actor: "importer", Limit: 1})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the audit log. expected nil")
+			assert.NotNil(t, next, "expected GetAuditLog() to return a cursor for another page")
+			assert.Equal(t, 1, len(firstPage), "expected the first page to hold one entry")
+
+			secondPage, next, err := underTest.GetAuditLog(context.Background(), domain.AuditQuery{Actor: "importer", AfterID: *next, Limit: 1})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the audit log. expected nil")
+			assert.Nil(t, next, "expected GetAuditLog() to report the last page, with nothing recorded for the dry run")
+			assert.True(t, firstPage[0].ID < secondPage[0].ID, "expected the audit log to be ordered oldest first")
+
+			all, _, err := underTest.GetAuditLog(context.Background(), domain.AuditQuery{Action: domain.AuditActionInsert, Limit: 50})
+			assert.Equal(t, nil, err, "Some error occurred retrieving the audit log. expected nil")
+			assert.Equal(t, 3, len(all), "expected every insert to be recorded")
+
+			_, err = sqlDb.Exec("UPDATE user_audit_log SET actor = 'someone else'")
+			assert.NotNil(t, err, "expected the audit log to reject updates")
+			_, err = sqlDb.Exec("DELETE FROM user_audit_log")
+			assert.NotNil(t, err, "expected the audit log to reject deletes")
+		})
+	}
+}
+
+// recordAuditChanges makes five audited changes: two inserts, an update, a
+// delete and a restore.
+func recordAuditChanges(t *testing.T, underTest db.DatabaseService) {
+	ctx := domain.WithAuditContext(context.Background(), domain.AuditContext{Actor: "admin", RequestID: "request-1", ClientIP: "192.0.2.10"})
+
+	_, err := underTest.InsertUsers(ctx, []domain.User{
+		{Username: "first <user>", Email: "first@email.com"},
+		{Username: "second", Email: "second@email.com"},
+	}, domain.BatchInsertOptions{})
+	assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+	_, err = underTest.UpdateUser(ctx, 1, domain.User{Username: "updated", Email: "first@email.com"}, nil)
+	assert.Equal(t, nil, err, "Some error occurred updating the user. expected nil")
+	err = underTest.SoftDeleteUser(ctx, 2, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+	_, err = underTest.RestoreUser(ctx, 2, nil)
+	assert.Equal(t, nil, err, "Some error occurred restoring the user. expected nil")
+}
+
+// tamper runs statement against the audit log with its append-only triggers
+// lifted, as someone with direct access to the database could.
+func tamper(t *testing.T, backend backend, sqlDb *sql.DB, statement string) {
+	for _, step := range append(backend.unlockAuditLog, statement) {
+		_, err := sqlDb.Exec(step)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func TestVerifyAuditLogSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			underTest, _ := backend.open(t)
+
+			recordAuditChanges(t, underTest)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "concurrent", Email: fmt.Sprintf("concurrent%d@email.com", i)})
+					assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+				}(i)
+			}
+			wg.Wait()
+
+			verification, err := underTest.VerifyAuditLog(context.Background())
+			assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+			assert.True(t, verification.Valid, fmt.Sprintf("expected an untouched audit log to verify. [actual]: %+v", verification))
+			assert.Equal(t, int64(15), verification.Checked, "expected every entry to be checked")
+			assert.Equal(t, 64, len(verification.LastHash), "expected the hash of the last entry to be reported")
+		})
+	}
+}
+
+func TestVerifyAuditLogTamperedFailure(t *testing.T) {
+	tests := []struct {
+		name             string
+		statement        string
+		expectedBrokenAt int64
+		expectedReason   string
+	}{
+		{
+			name:             "edited actor",
+			statement:        "UPDATE user_audit_log SET actor = 'someone else' WHERE id = 3",
+			expectedBrokenAt: 3,
+			expectedReason:   "hash does not match the content of the entry",
+		},
+		{
+			name:             "edited after",
+			statement:        "UPDATE user_audit_log SET after = before WHERE id = 3",
+			expectedBrokenAt: 3,
+			expectedReason:   "hash does not match the content of the entry",
+		},
+		{
+			name:             "deleted entry",
+			statement:        "DELETE FROM user_audit_log WHERE id = 2",
+			expectedBrokenAt: 3,
+			expectedReason:   "previous_hash does not match the hash of entry 1",
+		},
+		{
+			name:             "rehashed entry",
+			statement:        "UPDATE user_audit_log SET actor = 'someone else', hash = previous_hash WHERE id = 4",
+			expectedBrokenAt: 4,
+			expectedReason:   "hash does not match the content of the entry",
+		},
+		{
+			name:             "removed hash",
+			statement:        "UPDATE user_audit_log SET hash = NULL WHERE id = 5",
+			expectedBrokenAt: 5,
+			expectedReason:   "entry has no hash",
+		},
+		{
+			name:             "removed every hash",
+			statement:        "UPDATE user_audit_log SET previous_hash = NULL, hash = NULL",
+			expectedBrokenAt: 1,
+			expectedReason:   "entry has no hash",
+		},
+	}
+
+	for _, backend := range backends {
+		for _, test := range tests {
+			t.Run(backend.name+"/"+test.name, func(t *testing.T) {
+				underTest, sqlDb := backend.open(t)
+
+				recordAuditChanges(t, underTest)
+
+				tamper(t, backend, sqlDb, test.statement)
+
+				verification, err := underTest.VerifyAuditLog(context.Background())
+				assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+				assert.False(t, verification.Valid, "expected a tampered audit log not to verify")
+				if verification.BrokenAt == nil {
+					t.Fatal("expected the broken entry to be reported")
+				}
+				assert.Equal(t, test.expectedBrokenAt, *verification.BrokenAt, "expected the first broken entry to be reported")
+				assert.Equal(t, test.expectedReason, verification.Reason, "expected the reason the entry does not verify")
+			})
+		}
+	}
+}
+
+func TestWithTxSerializationRetrySuccess(t *testing.T) {
+	dataSourceName := containerDatabaseConfig().DataSourceName()
+
+	pool, err := pgxpool.New(context.Background(), dataSourceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	sqlDb, err := sql.Open("pgx", dataSourceName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -331,17 +1342,52 @@ func TestSoftDeleteUserSuccess(t *testing.T) {
 		sqlDb.Close()
 	})
 
-	userId, err := underTest.InsertNewUser(userForInsertion)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
-	err = underTest.SoftDeleteUser(userId)
-	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+	// Both transactions read the users before either inserts one, so the
+	// serializable isolation level can only commit one of them. The other must
+	// be retried to succeed.
+	var read sync.WaitGroup
+	read.Add(2)
+	var mu sync.Mutex
+	attempts := 0
+
+	options := db.TxOptions{TxOptions: pgx.TxOptions{IsoLevel: pgx.Serializable}, Backoff: time.Millisecond}
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first := true
+			errs[i] = db.WithTx(context.Background(), pool, options, func(tx pgx.Tx) error {
+				mu.Lock()
+				attempts++
+				mu.Unlock()
+
+				var count int
+				err := tx.QueryRow(context.Background(), "SELECT count(*) FROM users").Scan(&count)
+				if err != nil {
+					return err
+				}
+				if first {
+					first = false
+					read.Done()
+					read.Wait()
+				}
+				_, err = tx.Exec(context.Background(), "INSERT INTO users (username, email) VALUES ($1, $2)", fmt.Sprintf("user%d", count), fmt.Sprintf("user%d-%d@test.com", i, count))
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, nil, errs[0], "Some error occurred running the first transaction. expected nil")
+	assert.Equal(t, nil, errs[1], "Some error occurred running the second transaction. expected nil")
+	assert.Equal(t, 3, attempts, "expected the transaction that failed to serialize to be run again")
 
-	query := "SELECT COUNT(*) FROM user_deletes ud WHERE ud.user_id = $1"
-	var count int
-	err = sqlDb.QueryRow(query, userId).Scan(&count)
+	var users int
+	err = sqlDb.QueryRow("SELECT count(*) FROM users").Scan(&users)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	assert.Equal(t, 1, count, "expected SoftDeleteUser() to persist 1 row to the user_deletes table")
+	assert.Equal(t, 2, users, "expected both transactions to have inserted a user")
 }
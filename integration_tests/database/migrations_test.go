@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	db "db_access/internal/database"
+
+	"github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigratorUpAndDownSuccess(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			testMigratorUpAndDown(t, backend)
+		})
+	}
+}
+
+func testMigratorUpAndDown(t *testing.T, backend backend) {
+	underTest, err := backend.newMigrator(t)
+	assert.Equal(t, nil, err, "Some error occurred creating the migrator. expected nil")
+
+	t.Cleanup(func() {
+		t.Log("Cleaning up after test")
+		for {
+			_, err := underTest.Down(context.Background())
+			if err != nil {
+				break
+			}
+		}
+		underTest.Close()
+	})
+
+	latestVersion, err := db.LatestMigrationVersion()
+	assert.Equal(t, nil, err, "Some error occurred reading the migrations. expected nil")
+
+	results, err := underTest.Up(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred applying the migrations. expected nil")
+	assert.Equal(t, int(latestVersion), len(results), "expected Up() to apply every migration")
+
+	version, err := underTest.Version(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred reading the version. expected nil")
+	assert.Equal(t, latestVersion, version, "expected the database to be at the latest migration")
+
+	statuses, err := underTest.Status(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred reading the status. expected nil")
+	for _, status := range statuses {
+		assert.Equal(t, goose.StateApplied, status.State, fmt.Sprintf("expected %v to be applied", status.Source.Path))
+	}
+
+	results, err = underTest.Redo(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred redoing the latest migration. expected nil")
+	assert.Equal(t, 2, len(results), "expected Redo() to roll back and reapply one migration")
+
+	_, err = underTest.Down(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred rolling back the latest migration. expected nil")
+
+	version, err = underTest.Version(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred reading the version. expected nil")
+	assert.Equal(t, latestVersion-1, version, "expected Down() to roll back one migration")
+}
+
+func TestMigratorConcurrentUpSuccess(t *testing.T) {
+	dataSourceName := containerDatabaseConfig().DataSourceName()
+
+	latestVersion, err := db.LatestMigrationVersion()
+	assert.Equal(t, nil, err, "Some error occurred reading the migrations. expected nil")
+
+	replicas := 3
+	applied := make([]int, replicas)
+	errs := make([]error, replicas)
+
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			migrator, err := db.NewMigrator(dataSourceName)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer migrator.Close()
+
+			results, err := migrator.Up(context.Background())
+			applied[i] = len(results)
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	t.Cleanup(func() {
+		t.Log("Cleaning up after test")
+		migrator, err := db.NewMigrator(dataSourceName)
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		for {
+			_, err := migrator.Down(context.Background())
+			if err != nil {
+				break
+			}
+		}
+		migrator.Close()
+	})
+
+	total := 0
+	for i := 0; i < replicas; i++ {
+		assert.Equal(t, nil, errs[i], "Some error occurred applying the migrations concurrently. expected nil")
+		total += applied[i]
+	}
+	assert.Equal(t, int(latestVersion), total, "expected every migration to be applied exactly once")
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"db_access/internal/database"
+	"db_access/internal/domain"
+)
+
+// ExitTampered is returned by verify-audit when the audit log's hash chain is
+// broken.
+const ExitTampered = 8
+
+// VerifyAuditUsage describes the verify-audit command.
+const VerifyAuditUsage = `usage: main verify-audit [--output table|json|csv]
+
+Walks the audit log's hash chain and reports the first entry that does not
+verify. Exits with 8 when the chain is broken.`
+
+var verificationHeader = []string{"valid", "checked", "unhashed", "broken_at", "reason", "last_hash"}
+
+// RunVerifyAudit verifies the audit log against db and returns the process
+// exit code. The result is written to out and errors to errOut.
+func RunVerifyAudit(ctx context.Context, db database.DatabaseService, args []string, out, errOut io.Writer) int {
+	flags, format := newFlagSet("verify-audit", errOut)
+	positional, err := parse(flags, format, args)
+	if err != nil {
+		return report(errOut, err)
+	}
+	if len(positional) != 0 {
+		return report(errOut, &usageError{message: "verify-audit takes no arguments"})
+	}
+
+	verification, err := db.VerifyAuditLog(ctx)
+	if err != nil {
+		return report(errOut, err)
+	}
+
+	err = writeVerification(out, *format, verification)
+	if err != nil {
+		return report(errOut, err)
+	}
+
+	if !verification.Valid {
+		return ExitTampered
+	}
+	return ExitOK
+}
+
+func writeVerification(out io.Writer, format string, verification domain.AuditVerification) error {
+	brokenAt := ""
+	if verification.BrokenAt != nil {
+		brokenAt = strconv.FormatInt(*verification.BrokenAt, 10)
+	}
+
+	row := []string{
+		strconv.FormatBool(verification.Valid),
+		strconv.FormatInt(verification.Checked, 10),
+		strconv.FormatInt(verification.Unhashed, 10),
+		brokenAt,
+		verification.Reason,
+		verification.LastHash,
+	}
+
+	if format == formatTable {
+		for i, name := range verificationHeader {
+			if row[i] != "" {
+				fmt.Fprintf(out, "%-10s %s\n", name+":", row[i])
+			}
+		}
+		return nil
+	}
+
+	return writeRecords(out, format, verificationHeader, [][]string{row}, verification)
+}
@@ -0,0 +1,201 @@
+// Package cli implements the admin subcommands, which run directly against a
+// DatabaseService rather than through the HTTP API.
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db_access/internal/domain"
+)
+
+// Exit codes returned by the subcommands, so scripts can tell failures apart.
+const (
+	ExitOK       = 0
+	ExitFailure  = 1
+	ExitUsage    = 2
+	ExitNotFound = 3
+	ExitConflict = 4
+	ExitDeleted  = 5
+	ExitInvalid  = 6
+	ExitDatabase = 7
+)
+
+// ExitCode maps an error returned by the DatabaseService to an exit code.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var notFound *domain.UserNotFoundError
+	var uniqueConstraint *domain.UniqueConstraintDatabaseError
+	var notDeleted *domain.UserNotDeletedError
+	var deleted *domain.UserDeletedError
+	var invalidQuery *domain.InvalidQueryError
+	var invalidUser *domain.InvalidUserError
+	var unmapped *domain.UnmappedDatabaseError
+	var transaction *domain.DatabaseTransactionError
+
+	switch {
+	case errors.As(err, &notFound):
+		return ExitNotFound
+	case errors.As(err, &uniqueConstraint), errors.As(err, &notDeleted):
+		return ExitConflict
+	case errors.As(err, &deleted):
+		return ExitDeleted
+	case errors.As(err, &invalidQuery), errors.As(err, &invalidUser):
+		return ExitInvalid
+	case errors.As(err, &unmapped), errors.As(err, &transaction):
+		return ExitDatabase
+	default:
+		return ExitFailure
+	}
+}
+
+// usageError is a malformed command line, reported with ExitUsage.
+type usageError struct {
+	message string
+}
+
+func (ue *usageError) Error() string {
+	return ue.message
+}
+
+// validationError is input rejected before reaching the database, reported
+// with ExitInvalid.
+type validationError struct {
+	message string
+}
+
+func (ve *validationError) Error() string {
+	return ve.message
+}
+
+// report writes err to errOut and returns its exit code.
+func report(errOut io.Writer, err error) int {
+	fmt.Fprintln(errOut, "error:", err)
+
+	switch err.(type) {
+	case *usageError:
+		return ExitUsage
+	case *validationError:
+		return ExitInvalid
+	default:
+		return ExitCode(err)
+	}
+}
+
+// Output formats accepted by --output.
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+// newFlagSet returns a flag set for a subcommand with the shared --output flag.
+func newFlagSet(name string, errOut io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	format := flags.String("output", formatTable, "output format: table, json or csv")
+	return flags, format
+}
+
+// parse parses args and checks the output format. Flags may come before or
+// after the positional arguments.
+func parse(flags *flag.FlagSet, format *string, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, &usageError{message: err.Error()}
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	switch *format {
+	case formatTable, formatJSON, formatCSV:
+	default:
+		return nil, &usageError{message: fmt.Sprintf("output must be table, json or csv, got %q", *format)}
+	}
+
+	return positional, nil
+}
+
+// parseUserID reads the single positional user id.
+func parseUserID(positional []string) (int, error) {
+	if len(positional) != 1 {
+		return 0, &usageError{message: "expected exactly one user id"}
+	}
+
+	userId, err := strconv.Atoi(positional[0])
+	if err != nil || userId < 1 {
+		return 0, &usageError{message: fmt.Sprintf("user id must be a positive integer, got %q", positional[0])}
+	}
+
+	return userId, nil
+}
+
+// writeRecords writes a header and rows in the requested format. JSON output is
+// an array of the values instead.
+func writeRecords(out io.Writer, format string, header []string, rows [][]string, values any) error {
+	switch format {
+	case formatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(values)
+	case formatCSV:
+		writer := csv.NewWriter(out)
+		writer.Write(header)
+		writer.WriteAll(rows)
+		return writer.Error()
+	default:
+		table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(table, strings.Join(row, "\t"))
+		}
+		return table.Flush()
+	}
+}
+
+var userHeader = []string{"id", "username", "email", "created_at", "updated_at", "deleted_at"}
+
+func formatTime(value *time.Time) string {
+	if value == nil {
+		return ""
+	}
+	return value.Format(time.RFC3339)
+}
+
+// writeUsers writes users in the requested format.
+func writeUsers(out io.Writer, format string, users []domain.User) error {
+	rows := make([][]string, 0, len(users))
+	for _, user := range users {
+		rows = append(rows, []string{
+			strconv.Itoa(user.ID),
+			user.Username,
+			user.Email,
+			formatTime(user.CreatedAt),
+			formatTime(user.UpdatedAt),
+			formatTime(user.DeletedAt),
+		})
+	}
+
+	if users == nil {
+		users = []domain.User{}
+	}
+
+	return writeRecords(out, format, userHeader, rows, users)
+}
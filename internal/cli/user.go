@@ -0,0 +1,283 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin/binding"
+
+	"db_access/internal/database"
+	"db_access/internal/domain"
+)
+
+// UserUsage describes the user subcommands.
+const UserUsage = `usage: main user <command> [--output table|json|csv] [arguments]
+
+commands:
+  create --username <username> --email <email>
+  list [--username <prefix>] [--email-domain <domain>] [--include-deleted]
+  delete <user id>
+  restore <user id>
+  import <file.csv | ->   CSV with a username and an email column`
+
+// listPageSize is the page size used to walk every user for user list.
+const listPageSize = 500
+
+// RunUser runs a user subcommand against db and returns the process exit code.
+// Results are written to out and errors to errOut.
+func RunUser(ctx context.Context, db database.DatabaseService, args []string, in io.Reader, out, errOut io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(errOut, UserUsage)
+		return ExitUsage
+	}
+
+	ctx = domain.WithAuditContext(ctx, domain.AuditContext{Actor: cliActor()})
+
+	var err error
+	switch args[0] {
+	case "create":
+		err = createUser(ctx, db, args[1:], out, errOut)
+	case "list":
+		err = listUsers(ctx, db, args[1:], out, errOut)
+	case "delete":
+		err = deleteUser(ctx, db, args[1:], out, errOut)
+	case "restore":
+		err = restoreUser(ctx, db, args[1:], out, errOut)
+	case "import":
+		err = importUsers(ctx, db, args[1:], in, out, errOut)
+	default:
+		fmt.Fprintf(errOut, "unknown user command %q\n%s\n", args[0], UserUsage)
+		return ExitUsage
+	}
+
+	if err != nil {
+		return report(errOut, err)
+	}
+	return ExitOK
+}
+
+// cliActor names the operating system user running the command in the audit
+// log, since the CLI has no other identity to go on.
+func cliActor() string {
+	if name := os.Getenv("USER"); name != "" {
+		return "cli:" + name
+	}
+	return "cli"
+}
+
+func createUser(ctx context.Context, db database.DatabaseService, args []string, out, errOut io.Writer) error {
+	flags, format := newFlagSet("user create", errOut)
+	username := flags.String("username", "", "the new user's username")
+	email := flags.String("email", "", "the new user's email")
+	positional, err := parse(flags, format, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return &usageError{message: "user create takes no arguments"}
+	}
+
+	user := domain.User{Username: *username, Email: *email}
+	err = validateUser(user)
+	if err != nil {
+		return err
+	}
+
+	userId, err := db.InsertNewUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	created, err := db.GetUserByID(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return writeUsers(out, *format, []domain.User{created})
+}
+
+func listUsers(ctx context.Context, db database.DatabaseService, args []string, out, errOut io.Writer) error {
+	flags, format := newFlagSet("user list", errOut)
+	username := flags.String("username", "", "only list users whose username starts with this prefix")
+	emailDomain := flags.String("email-domain", "", "only list users with an email at this domain")
+	includeDeleted := flags.Bool("include-deleted", false, "also list deleted users")
+	positional, err := parse(flags, format, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return &usageError{message: "user list takes no arguments"}
+	}
+
+	query := domain.UsersQuery{
+		UsernamePrefix: *username,
+		EmailDomain:    *emailDomain,
+		IncludeDeleted: *includeDeleted,
+		Limit:          listPageSize,
+	}
+
+	var users []domain.User
+	for {
+		page, next, err := db.GetUsersPage(ctx, query)
+		if err != nil {
+			return err
+		}
+		users = append(users, page...)
+		if next == nil {
+			break
+		}
+		query.After = next
+	}
+
+	return writeUsers(out, *format, users)
+}
+
+func deleteUser(ctx context.Context, db database.DatabaseService, args []string, out, errOut io.Writer) error {
+	flags, format := newFlagSet("user delete", errOut)
+	positional, err := parse(flags, format, args)
+	if err != nil {
+		return err
+	}
+	userId, err := parseUserID(positional)
+	if err != nil {
+		return err
+	}
+
+	err = db.SoftDeleteUser(ctx, userId, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Deleted user %d\n", userId)
+	return nil
+}
+
+func restoreUser(ctx context.Context, db database.DatabaseService, args []string, out, errOut io.Writer) error {
+	flags, format := newFlagSet("user restore", errOut)
+	positional, err := parse(flags, format, args)
+	if err != nil {
+		return err
+	}
+	userId, err := parseUserID(positional)
+	if err != nil {
+		return err
+	}
+
+	user, err := db.RestoreUser(ctx, userId, nil)
+	if err != nil {
+		return err
+	}
+
+	return writeUsers(out, *format, []domain.User{user})
+}
+
+// importResult is the outcome of importing one CSV row.
+type importResult struct {
+	Line  int    `json:"line"`
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// importBatchSize is how many users are inserted per InsertUsers call, so a
+// large file is not imported in a single transaction.
+const importBatchSize = 1000
+
+// importUsers inserts every row of a CSV file, carrying on past failed rows,
+// and reports the outcome of each. It fails with the first row's error when
+// any row could not be imported.
+func importUsers(ctx context.Context, db database.DatabaseService, args []string, in io.Reader, out, errOut io.Writer) error {
+	flags, format := newFlagSet("user import", errOut)
+	positional, err := parse(flags, format, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return &usageError{message: "expected exactly one CSV file, or - for standard input"}
+	}
+
+	source := in
+	if positional[0] != "-" {
+		file, err := os.Open(positional[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		source = file
+	}
+
+	userRows, err := domain.ReadUsersCSV(source, 0)
+	if err != nil {
+		return &validationError{message: err.Error()}
+	}
+
+	results := make([]importResult, len(userRows))
+	errs := make([]error, len(userRows))
+	var valid []domain.User
+	var positions []int
+	for i, row := range userRows {
+		results[i].Line = row.Line
+		if row.Err != nil {
+			errs[i] = &validationError{message: row.Err.Error()}
+		} else {
+			errs[i] = validateUser(row.User)
+		}
+		if errs[i] == nil {
+			valid = append(valid, row.User)
+			positions = append(positions, i)
+		}
+	}
+
+	for start := 0; start < len(valid); start += importBatchSize {
+		end := min(start+importBatchSize, len(valid))
+		batch, err := db.InsertUsers(ctx, valid[start:end], domain.BatchInsertOptions{})
+		if err != nil {
+			return err
+		}
+		for _, result := range batch {
+			i := positions[start+result.Index]
+			if result.Status == domain.BatchUserCreated {
+				results[i].ID = result.ID
+				continue
+			}
+			// A user in a batch only fails when its email is taken.
+			errs[i] = &domain.UniqueConstraintDatabaseError{Message: result.Error}
+		}
+	}
+
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			results[i].Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	rows := make([][]string, 0, len(results))
+	for _, result := range results {
+		id := ""
+		if result.ID != 0 {
+			id = strconv.Itoa(result.ID)
+		}
+		rows = append(rows, []string{strconv.Itoa(result.Line), id, result.Error})
+	}
+	err = writeRecords(out, *format, []string{"line", "id", "error"}, rows, results)
+	if err != nil {
+		return err
+	}
+
+	return firstErr
+}
+
+// validateUser applies the same rules as the HTTP API to a new user.
+func validateUser(user domain.User) error {
+	err := binding.Validator.ValidateStruct(user)
+	if err != nil {
+		return &validationError{message: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"db_access/internal/domain"
+)
+
+// unknownActor is recorded against changes made without an AuditContext.
+const unknownActor = "unknown"
+
+// auditChange is a change to a user to be written to the audit log. Before is
+// nil for an insert.
+type auditChange struct {
+	userId int
+	action string
+	before *domain.User
+	after  *domain.User
+}
+
+// recordAudit appends changes to the audit log within tx, attributed to the
+// AuditContext of ctx, so they are only kept if tx commits. Each entry is
+// hashed and chained to the one before it, which serialises every transaction
+// that records a change from this point until it ends. The hashes are keyed
+// with key when it is set.
+func recordAudit(ctx context.Context, tx pgx.Tx, key []byte, changes ...auditChange) error {
+	previousHash, err := lastAuditHash(ctx, tx)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Failed to read the audit log hash chain. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+
+	entries, err := newAuditEntries(ctx, key, previousHash, changes)
+	if err != nil {
+		return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+
+	userIds := make([]int, len(changes))
+	actions := make([]string, len(changes))
+	befores := make([]*string, len(changes))
+	afters := make([]*string, len(changes))
+	previousHashes := make([]*string, len(changes))
+	hashes := make([]string, len(changes))
+	for i, change := range changes {
+		userIds[i] = change.userId
+		actions[i] = change.action
+		befores[i] = auditState(change.before)
+		afters[i] = auditState(change.after)
+		if entries[i].PreviousHash != "" {
+			previousHashes[i] = &entries[i].PreviousHash
+		}
+		hashes[i] = entries[i].Hash
+	}
+	audit := entries[0]
+
+	statement :=
+		`
+	INSERT INTO user_audit_log (user_id, action, actor, before, after, request_id, client_ip, created_at, previous_hash, hash)
+	SELECT change.user_id, change.action, $7, change.before::jsonb, change.after::jsonb, NULLIF($8, ''), NULLIF($9, ''), $10, change.previous_hash, change.hash
+	FROM unnest($1::integer[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[]) WITH ORDINALITY AS change(user_id, action, before, after, previous_hash, hash, position)
+	ORDER BY change.position
+	`
+
+	_, err = tx.Exec(ctx, statement, userIds, actions, befores, afters, previousHashes, hashes, audit.Actor, audit.RequestID, audit.ClientIP, audit.CreatedAt)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Failed to record the audit log. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+
+	return nil
+}
+
+// newAuditEntries returns the audit entries for changes, attributed to the
+// AuditContext of ctx, hashed with key and chained to previousHash. Their ids
+// are left for the database to assign.
+func newAuditEntries(ctx context.Context, key []byte, previousHash string, changes []auditChange) ([]domain.AuditEntry, error) {
+	audit := domain.AuditContextFrom(ctx)
+	if audit.Actor == "" {
+		audit.Actor = unknownActor
+	}
+
+	// The hash is computed over the time as it will be read back.
+	createdAt := microsecondNow()
+
+	entries := make([]domain.AuditEntry, len(changes))
+	for i, change := range changes {
+		entry := domain.AuditEntry{
+			UserID:       change.userId,
+			Action:       change.action,
+			Actor:        audit.Actor,
+			Before:       auditJSON(stateBytes(auditState(change.before))),
+			After:        auditJSON(stateBytes(auditState(change.after))),
+			RequestID:    audit.RequestID,
+			ClientIP:     audit.ClientIP,
+			CreatedAt:    createdAt,
+			PreviousHash: previousHash,
+		}
+		hash, err := auditEntryHash(key, previousHash, entry)
+		if err != nil {
+			return nil, err
+		}
+		entry.Hash = hash
+		entries[i] = entry
+		previousHash = hash
+	}
+
+	return entries, nil
+}
+
+// microsecondNow returns the current time in UTC to the microsecond, which is
+// as precisely as every database keeps it.
+func microsecondNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func auditState(user *domain.User) *string {
+	if user == nil {
+		return nil
+	}
+	data, _ := json.Marshal(user)
+	state := string(data)
+	return &state
+}
+
+func stateBytes(state *string) []byte {
+	if state == nil {
+		return nil
+	}
+	return []byte(*state)
+}
+
+const auditColumns = "id, user_id, action, actor, before, after, COALESCE(request_id, ''), COALESCE(client_ip, ''), created_at, COALESCE(previous_hash, ''), COALESCE(hash, '')"
+
+func scanAuditEntry(rows pgx.Rows) (domain.AuditEntry, error) {
+	var entry domain.AuditEntry
+	var before, after []byte
+	err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &entry.Actor, &before, &after, &entry.RequestID, &entry.ClientIP, &entry.CreatedAt, &entry.PreviousHash, &entry.Hash)
+	if err != nil {
+		return domain.AuditEntry{}, &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+	entry.Before = auditJSON(before)
+	entry.After = auditJSON(after)
+	return entry, nil
+}
+
+func scanAuditEntries(rows pgx.Rows) ([]domain.AuditEntry, error) {
+	entries := []domain.AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return nil, &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+
+	return entries, nil
+}
+
+// auditJSON maps a null state to a JSON null, so the entry always has both
+// members.
+func auditJSON(state []byte) json.RawMessage {
+	if state == nil {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(state)
+}
+
+// GetUserHistory returns every change to a user, oldest first, including those
+// made before it was deleted.
+func (s *service) GetUserHistory(ctx context.Context, userId int) ([]domain.AuditEntry, error) {
+	statement := "SELECT " + auditColumns + " FROM user_audit_log WHERE user_id = $1 ORDER BY id"
+
+	var entries []domain.AuditEntry
+	options := TxOptions{TxOptions: pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}}
+	err := WithTx(ctx, s.pool, options, func(tx pgx.Tx) error {
+		existsStatement := "SELECT id FROM users WHERE id = $1"
+
+		var id int
+		err := tx.QueryRow(ctx, existsStatement, userId).Scan(&id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				message := fmt.Sprintf("User with id %d does not exist", userId)
+				log.Println(message)
+				return &domain.UserNotFoundError{Message: message, Err: err}
+			}
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		rows, err := tx.Query(ctx, statement, userId)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		defer rows.Close()
+
+		entries, err = scanAuditEntries(rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return entries, nil
+}
+
+// GetAuditLog returns up to query.Limit audit entries matching the query's
+// filters, oldest first, and the id to continue after or nil on the last page.
+func (s *service) GetAuditLog(ctx context.Context, query domain.AuditQuery) ([]domain.AuditEntry, *int64, error) {
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if query.UserID != 0 {
+		conditions = append(conditions, "user_id = "+arg(query.UserID))
+	}
+	if query.Actor != "" {
+		conditions = append(conditions, "actor = "+arg(query.Actor))
+	}
+	if query.Action != "" {
+		conditions = append(conditions, "action = "+arg(query.Action))
+	}
+	if query.RequestID != "" {
+		conditions = append(conditions, "request_id = "+arg(query.RequestID))
+	}
+	if query.CreatedAfter != nil {
+		conditions = append(conditions, "created_at > "+arg(*query.CreatedAfter))
+	}
+	if query.CreatedBefore != nil {
+		conditions = append(conditions, "created_at < "+arg(*query.CreatedBefore))
+	}
+	if query.AfterID != 0 {
+		conditions = append(conditions, "id > "+arg(query.AfterID))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	statement := fmt.Sprintf("SELECT %s FROM user_audit_log %s ORDER BY id LIMIT %s", auditColumns, where, arg(query.Limit+1))
+
+	var entries []domain.AuditEntry
+	options := TxOptions{TxOptions: pgx.TxOptions{AccessMode: pgx.ReadOnly}}
+	err := WithTx(ctx, s.pool, options, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, statement, args...)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		defer rows.Close()
+
+		entries, err = scanAuditEntries(rows)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	if len(entries) <= query.Limit {
+		return entries, nil, nil
+	}
+
+	entries = entries[:query.Limit]
+	return entries, &entries[query.Limit-1].ID, nil
+}
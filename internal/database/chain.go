@@ -0,0 +1,231 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"db_access/internal/domain"
+)
+
+// auditHashContent is what an audit entry's hash is computed over. The id is
+// left out since it is only known once the entry is inserted, the order of
+// the entries is fixed by each one including the previous entry's hash.
+type auditHashContent struct {
+	PreviousHash string          `json:"previous_hash"`
+	UserID       int             `json:"user_id"`
+	Action       string          `json:"action"`
+	Actor        string          `json:"actor"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+	RequestID    string          `json:"request_id"`
+	ClientIP     string          `json:"client_ip"`
+	CreatedAt    string          `json:"created_at"`
+}
+
+// auditEntryHash returns the hex encoded SHA-256 hash of an entry chained to
+// previousHash, or its HMAC-SHA256 when key is set. Without a key anyone able
+// to write to the audit log can recompute the hashes of the entries they
+// change, with one they cannot.
+func auditEntryHash(key []byte, previousHash string, entry domain.AuditEntry) (string, error) {
+	before, err := canonicalJSON(entry.Before)
+	if err != nil {
+		return "", err
+	}
+	after, err := canonicalJSON(entry.After)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal(auditHashContent{
+		PreviousHash: previousHash,
+		UserID:       entry.UserID,
+		Action:       entry.Action,
+		Actor:        entry.Actor,
+		Before:       before,
+		After:        after,
+		RequestID:    entry.RequestID,
+		ClientIP:     entry.ClientIP,
+		CreatedAt:    entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(key) == 0 {
+		hash := sha256.Sum256(content)
+		return hex.EncodeToString(hash[:]), nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// canonicalJSON rewrites a JSON document with its object keys sorted and no
+// insignificant whitespace. Postgres stores before and after as jsonb, which
+// does not keep the document as it was written, so both the hash recorded and
+// the hash verified are computed over this form.
+func canonicalJSON(document json.RawMessage) (json.RawMessage, error) {
+	if len(document) == 0 {
+		return json.RawMessage("null"), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
+
+// lastAuditHash locks the chain until tx ends, so entries are appended one
+// transaction at a time, and returns the hash of the last entry, or an empty
+// string when the chain has not started.
+func lastAuditHash(ctx context.Context, tx pgx.Tx) (string, error) {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('user_audit_log'))")
+	if err != nil {
+		return "", err
+	}
+
+	statement := "SELECT hash FROM user_audit_log WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1"
+
+	var hash string
+	err = tx.QueryRow(ctx, statement).Scan(&hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return hash, err
+}
+
+// unhashedBeforeStatement reads the id of the first entry that must be hashed,
+// recorded when the chain was introduced. Without it no entry may be unhashed.
+const unhashedBeforeStatement = "SELECT COALESCE(MIN(unhashed_before), 0) FROM user_audit_log_chain"
+
+// VerifyAuditLog walks the audit log in order, recomputing each entry's hash
+// and checking it is chained to the entry before it. It stops at the first
+// entry that does not verify. Entries recorded before the chain was introduced
+// are counted as unhashed, but only ahead of the first hashed entry.
+func (s *service) VerifyAuditLog(ctx context.Context) (domain.AuditVerification, error) {
+	statement := "SELECT " + auditColumns + " FROM user_audit_log ORDER BY id"
+
+	var verification domain.AuditVerification
+	options := TxOptions{TxOptions: pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}}
+	err := WithTx(ctx, s.pool, options, func(tx pgx.Tx) error {
+		var unhashedBefore int64
+		err := tx.QueryRow(ctx, unhashedBeforeStatement).Scan(&unhashedBefore)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to read the start of the audit log hash chain. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		rows, err := tx.Query(ctx, statement)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		defer rows.Close()
+
+		verification, err = verifyAuditEntries(rows, newAuditChain(s.auditHashKey, unhashedBefore))
+		return err
+	})
+	if err != nil {
+		return domain.AuditVerification{}, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return verification, nil
+}
+
+// verifyAuditEntries adds the audit entries in rows, which must be in id
+// order, to chain.
+func verifyAuditEntries(rows pgx.Rows, chain *auditChain) (domain.AuditVerification, error) {
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return domain.AuditVerification{}, err
+		}
+		if !chain.add(entry) {
+			return chain.verification, nil
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return domain.AuditVerification{}, &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+
+	return chain.verification, nil
+}
+
+// auditChain verifies audit entries added to it in id order.
+type auditChain struct {
+	verification domain.AuditVerification
+	previousId   int64
+	key          []byte
+	// unhashedBefore is the id of the first entry recorded after the chain
+	// was introduced. Only entries before it may be unhashed, otherwise
+	// stripping every hash would leave a log that verifies.
+	unhashedBefore int64
+}
+
+// newAuditChain returns a chain verifying hashes computed with key, in which
+// only entries with an id below unhashedBefore may be unhashed.
+func newAuditChain(key []byte, unhashedBefore int64) *auditChain {
+	return &auditChain{verification: domain.AuditVerification{Valid: true}, key: key, unhashedBefore: unhashedBefore}
+}
+
+// add checks entry is chained to the entries before it and reports whether it
+// verifies. Once an entry does not, the verification says why and no more
+// entries should be added.
+func (c *auditChain) add(entry domain.AuditEntry) bool {
+	if entry.Hash == "" {
+		if c.verification.Checked > 0 || entry.ID >= c.unhashedBefore {
+			return c.broken(entry.ID, "entry has no hash")
+		}
+		c.verification.Unhashed++
+		return true
+	}
+
+	if entry.PreviousHash != c.verification.LastHash {
+		if c.verification.Checked == 0 {
+			return c.broken(entry.ID, "first entry in the chain has a previous_hash")
+		}
+		return c.broken(entry.ID, fmt.Sprintf("previous_hash does not match the hash of entry %d", c.previousId))
+	}
+
+	hash, err := auditEntryHash(c.key, entry.PreviousHash, entry)
+	if err != nil {
+		return c.broken(entry.ID, "before or after is not valid JSON")
+	}
+	if hash != entry.Hash {
+		return c.broken(entry.ID, "hash does not match the content of the entry")
+	}
+
+	c.verification.Checked++
+	c.verification.LastHash = entry.Hash
+	c.previousId = entry.ID
+	return true
+}
+
+func (c *auditChain) broken(id int64, reason string) bool {
+	c.verification.Valid = false
+	c.verification.BrokenAt = &id
+	c.verification.Reason = reason
+	return false
+}
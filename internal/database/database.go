@@ -1,91 +1,227 @@
 package database
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
-	"github.com/lib/pq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"db_access/internal/domain"
+	"db_access/internal/environment"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/joho/godotenv/autoload"
 )
 
 type DatabaseService interface {
-	InsertNewUser(user domain.User) (int, error)
+	InsertNewUser(ctx context.Context, user domain.User) (int, error)
 
-	GetAllUsers() ([]domain.User, error)
+	InsertUsers(ctx context.Context, users []domain.User, options domain.BatchInsertOptions) ([]domain.BatchUserResult, error)
 
-	SoftDeleteUser(userId int) error
+	ExportUsers(ctx context.Context, includeDeleted bool, yield func(domain.User) error) error
+
+	ReserveIdempotencyKey(ctx context.Context, key string, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error)
+
+	CompleteIdempotencyKey(ctx context.Context, key string, leaseToken string, statusCode int, body []byte, userId *int, ttl time.Duration) error
+
+	ReleaseIdempotencyKey(ctx context.Context, key string, leaseToken string) error
+
+	GetUserHistory(ctx context.Context, userId int) ([]domain.AuditEntry, error)
+
+	GetAuditLog(ctx context.Context, query domain.AuditQuery) ([]domain.AuditEntry, *int64, error)
+
+	VerifyAuditLog(ctx context.Context) (domain.AuditVerification, error)
+
+	GetUsersPage(ctx context.Context, query domain.UsersQuery) ([]domain.User, *domain.UsersCursor, error)
+
+	GetUserByID(ctx context.Context, userId int) (domain.User, error)
+
+	UpdateUser(ctx context.Context, userId int, user domain.User, expectedVersion *int) (domain.User, error)
+
+	PatchUser(ctx context.Context, userId int, patch domain.UserPatch, expectedVersion *int) (domain.User, error)
+
+	SoftDeleteUser(ctx context.Context, userId int, expectedVersion *int) error
+
+	RestoreUser(ctx context.Context, userId int, expectedVersion *int) (domain.User, error)
+
+	Health(ctx context.Context) domain.DatabaseHealth
+
+	PoolStats() domain.PoolStats
+
+	Close()
 }
 
+// service runs every statement through a pgx connection pool. pgx prepares
+// and caches statements on each connection by itself, so none are prepared
+// explicitly.
 type service struct {
-	db *sql.DB
+	pool *pgxpool.Pool
+	// auditHashKey keys the audit log's hashes, they are plain SHA-256
+	// hashes when it is empty.
+	auditHashKey []byte
 }
 
-var (
-	dbInstance *service
-)
+// New connects a pool to the database and pings it, so an unreachable database
+// is reported straight away. Every call returns an independent pool which the
+// caller must Close. The audit log is hashed with auditHashKey, see
+// environment.DatabaseConfig.AuditHashKey.
+func New(ctx context.Context, connectionString string, poolConfig environment.PoolConfig, auditHashKey []byte) (DatabaseService, error) {
+	config, err := pgxpool.ParseConfig(connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the database connection string: %w", err)
+	}
+	config.MaxConns = poolConfig.MaxConns
+	config.MinConns = poolConfig.MinConns
+	config.MaxConnLifetime = poolConfig.MaxConnLifetime
+	config.MaxConnIdleTime = poolConfig.MaxConnIdleTime
+	config.HealthCheckPeriod = poolConfig.HealthCheckPeriod
 
-func New(connectionString string) DatabaseService {
-	if dbInstance != nil {
-		return dbInstance
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the database pool: %w", err)
 	}
 
-	db, err := sql.Open("postgres", connectionString)
+	err = pool.Ping(ctx)
 	if err != nil {
-		log.Println(err)
+		pool.Close()
+		return nil, fmt.Errorf("unable to reach the database: %w", err)
 	}
-	dbInstance = &service{
-		db: db,
+
+	return &service{
+		pool:         pool,
+		auditHashKey: auditHashKey,
+	}, nil
+}
+
+// Close waits for acquired connections to be released and closes the pool.
+func (s *service) Close() {
+	s.pool.Close()
+}
+
+// PoolStats reports how saturated the connection pool is.
+func (s *service) PoolStats() domain.PoolStats {
+	stats := s.pool.Stat()
+	return domain.PoolStats{
+		MaxConnections:          stats.MaxConns(),
+		TotalConnections:        stats.TotalConns(),
+		AcquiredConnections:     stats.AcquiredConns(),
+		IdleConnections:         stats.IdleConns(),
+		ConstructingConnections: stats.ConstructingConns(),
+		AcquireCount:            stats.AcquireCount(),
+		EmptyAcquireCount:       stats.EmptyAcquireCount(),
+		CanceledAcquireCount:    stats.CanceledAcquireCount(),
+		AcquireDuration:         stats.AcquireDuration().String(),
 	}
-	return dbInstance
 }
 
-func (s *service) SoftDeleteUser(userId int) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return &domain.DatabaseTransactionError{Message: err.Error()}
+// Health pings the database and reports the connection pool statistics and the
+// latest migration recorded by goose, which is 0 when none have been applied.
+func (s *service) Health(ctx context.Context) domain.DatabaseHealth {
+	health := domain.DatabaseHealth{
+		Status: "up",
+		Pool:   s.PoolStats(),
 	}
-	statement := "INSERT INTO user_deletes(user_id) VALUES($1)"
 
-	query, err := tx.Prepare(statement)
+	err := s.pool.Ping(ctx)
 	if err != nil {
-		tx.Rollback()
-		errorMessage := fmt.Sprintf("Failed to prepare the SQL statement. [Reason]: %v", err)
-		log.Println(errorMessage)
-		return err
+		log.Println("Database health check failed:", err)
+		health.Status = "down"
+		health.Error = err.Error()
+		return health
 	}
 
-	_, err = query.Exec(userId)
+	statement := "SELECT COALESCE(MAX(version_id), 0) FROM goose_db_version"
+	err = s.pool.QueryRow(ctx, statement).Scan(&health.MigrationVersion)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42P01" {
+			return health
+		}
+		log.Println("Database health check failed:", err)
+		health.Status = "down"
+		health.Error = err.Error()
+	}
+
+	return health
+}
 
-		if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "23505":
-				log.Println("Unique constraint violation:", pqErr.Message)
-				return &domain.UniqueConstraintDatabaseError{Message: pqErr.Message}
-			case "23503":
-				log.Println("User does not exist cannot delete", pqErr.Message)
-				return &domain.UniqueConstraintDatabaseError{Message: pqErr.Message}
-			default:
-				log.Println("Database error:", pqErr.Code.Name())
-				return &domain.UnmappedDatabaseError{Message: pqErr.Message}
+// SoftDeleteUser marks a user as deleted, which moves it on to a new version.
+// When expectedVersion is set the user is only deleted if it is still at that
+// version.
+func (s *service) SoftDeleteUser(ctx context.Context, userId int, expectedVersion *int) error {
+	statement := "INSERT INTO user_deletes(user_id) VALUES($1) RETURNING deletion_date"
+
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		if expectedVersion != nil {
+			lockStatement := "SELECT version FROM users WHERE id = $1 FOR UPDATE"
+
+			var version int
+			err := tx.QueryRow(ctx, lockStatement, userId).Scan(&version)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					message := fmt.Sprintf("User with id %d does not exist", userId)
+					log.Println(message)
+					return &domain.UserNotFoundError{Message: message, Err: err}
+				}
+				errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+				log.Println(errorMessage)
+				return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+			}
+			if version != *expectedVersion {
+				return stalePreconditionError(userId, version, *expectedVersion)
 			}
 		}
-		return &domain.UnmappedDatabaseError{Message: err.Error()}
 
-	}
-	defer query.Close()
+		var deletionDate time.Time
+		err := tx.QueryRow(ctx, statement, userId).Scan(&deletionDate)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				switch pgErr.Code {
+				// user_deletes is keyed by user_id, so a second delete violates
+				// its primary key.
+				case "23505":
+					message := fmt.Sprintf("User with id %d has already been deleted", userId)
+					log.Println(message)
+					return &domain.UserDeletedError{Message: message, Err: err}
+				case "23503":
+					message := fmt.Sprintf("User with id %d does not exist", userId)
+					log.Println(message)
+					return &domain.UserNotFoundError{Message: message, Err: err}
+				default:
+					log.Println("Database error:", pgErr.Code)
+					return &domain.UnmappedDatabaseError{Message: pgErr.Message, Err: err}
+				}
+			}
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		userStatement := "SELECT id, username, email, created_at, updated_at, version FROM users WHERE id = $1"
+
+		var before domain.User
+		err = tx.QueryRow(ctx, userStatement, userId).Scan(&before.ID, &before.Username, &before.Email, &before.CreatedAt, &before.UpdatedAt, &before.Version)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		after, err := touchUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		after.DeletedAt = &deletionDate
 
-	err = tx.Commit()
+		return recordAudit(ctx, tx, s.auditHashKey, auditChange{userId: userId, action: domain.AuditActionDelete, before: &before, after: &after})
+	})
 	if err != nil {
-		tx.Rollback()
-		errorMessage := fmt.Sprintf("Failed to commit the prepared SQL statement. [Reason]: %v", err)
-		log.Println(errorMessage)
-		return &domain.DatabaseTransactionError{Message: err.Error()}
+		return err
 	}
 
 	log.Println("SQL query:", statement)
@@ -93,102 +229,479 @@ func (s *service) SoftDeleteUser(userId int) error {
 	return nil
 }
 
-func (s *service) GetAllUsers() ([]domain.User, error) {
-	tx, err := s.db.Begin()
+// touchUser moves a user on to a new version for a change made outside the
+// users table, such as a delete, and returns the user. The triggers on users
+// set the update time and increment the version.
+func touchUser(ctx context.Context, tx pgx.Tx, userId int) (domain.User, error) {
+	statement := "UPDATE users SET version = version + 1 WHERE id = $1 RETURNING id, username, email, created_at, updated_at, version"
+
+	var user domain.User
+	err := tx.QueryRow(ctx, statement, userId).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return domain.User{}, &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+	return user, nil
+}
+
+// RestoreUser undoes the soft delete of a user, which moves it on to a new
+// version. When expectedVersion is set the user is only restored if it is
+// still at that version.
+func (s *service) RestoreUser(ctx context.Context, userId int, expectedVersion *int) (domain.User, error) {
+	statement := "DELETE FROM user_deletes WHERE user_id = $1"
+
+	var user domain.User
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		lockStatement :=
+			`
+		SELECT u.id, u.username, u.email, u.created_at, u.updated_at, u.version, ud.deletion_date
+		FROM users u
+		LEFT JOIN user_deletes ud on u.id = ud.user_id
+		WHERE u.id = $1
+		FOR UPDATE OF u
+		`
+
+		user = domain.User{}
+		var deletedAt *time.Time
+		err := tx.QueryRow(ctx, lockStatement, userId).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version, &deletedAt)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				message := fmt.Sprintf("User with id %d does not exist", userId)
+				log.Println(message)
+				return &domain.UserNotFoundError{Message: message, Err: err}
+			}
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		if expectedVersion != nil && *expectedVersion != user.Version {
+			return stalePreconditionError(userId, user.Version, *expectedVersion)
+		}
+		if deletedAt == nil {
+			message := fmt.Sprintf("User with id %d has not been deleted", userId)
+			return &domain.UserNotDeletedError{Message: message}
+		}
+
+		_, err = tx.Exec(ctx, statement, userId)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		before := user
+		before.DeletedAt = deletedAt
+		user, err = touchUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, s.auditHashKey, auditChange{userId: userId, action: domain.AuditActionRestore, before: &before, after: &user})
+	})
 	if err != nil {
-		return nil, &domain.DatabaseTransactionError{Message: err.Error()}
+		return domain.User{}, err
 	}
 
+	log.Println("SQL query:", statement)
+
+	return user, nil
+}
+
+func (s *service) GetUserByID(ctx context.Context, userId int) (domain.User, error) {
 	statement :=
 		`
-	SELECT u.id, u.username, u.email
-	FROM users u 
+	SELECT u.id, u.username, u.email, u.created_at, u.updated_at, u.version, ud.user_id IS NOT NULL
+	FROM users u
 	LEFT JOIN user_deletes ud on u.id = ud.user_id
-	WHERE ud.user_id is NULL
+	WHERE u.id = $1
 	`
 
-	query, err := tx.Prepare(statement)
+	var user domain.User
+	var deleted bool
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, statement, userId).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version, &deleted)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				message := fmt.Sprintf("User with id %d does not exist", userId)
+				log.Println(message)
+				return &domain.UserNotFoundError{Message: message, Err: err}
+			}
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		return nil
+	})
 	if err != nil {
-		tx.Rollback()
-		errorMessage := fmt.Sprintf("Failed to prepare the SQL statement. [Reason]: %v", err)
-		log.Println(errorMessage)
-		return nil, &domain.DatabaseTransactionError{Message: err.Error()}
+		return domain.User{}, err
 	}
 
-	rows, err := query.Query()
+	log.Println("SQL query:", statement)
+
+	if deleted {
+		message := fmt.Sprintf("User with id %d has been deleted", userId)
+		return domain.User{}, &domain.UserDeletedError{Message: message}
+	}
+
+	return user, nil
+}
+
+// GetUsersPage returns up to query.Limit active users matching the query's
+// filters, and the cursor of the next page or nil on the last page.
+func (s *service) GetUsersPage(ctx context.Context, query domain.UsersQuery) ([]domain.User, *domain.UsersCursor, error) {
+	statement, args, err := buildUsersPageQuery(postgresDialect{}, query)
 	if err != nil {
-		return nil, &domain.UnmappedDatabaseError{Message: err.Error()}
+		return nil, nil, err
 	}
-	defer rows.Close()
 
 	var users []domain.User
-	for rows.Next() {
-		var user domain.User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email)
+	var cursors []domain.UsersCursor
+	err = WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, statement, args...)
 		if err != nil {
-			tx.Rollback()
-			return nil, err
+			return usersPageError(err)
+		}
+		defer rows.Close()
+
+		// Every column after the user's own is an ordering key.
+		keyCount := len(rows.FieldDescriptions()) - userColumnCount
+
+		users = []domain.User{}
+		cursors = nil
+		for rows.Next() {
+			var user domain.User
+			cursor := domain.UsersCursor{Keys: make([]string, keyCount)}
+			destinations := []any{&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt, &user.Version}
+			for i := range cursor.Keys {
+				destinations = append(destinations, &cursor.Keys[i])
+			}
+			err := rows.Scan(destinations...)
+			if err != nil {
+				return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+			}
+			users = append(users, user)
+			cursors = append(cursors, cursor)
 		}
-		users = append(users, user)
-	}
 
-	err = tx.Commit()
+		if err := rows.Err(); err != nil {
+			return usersPageError(err)
+		}
+
+		return nil
+	})
 	if err != nil {
-		tx.Rollback()
-		errorMessage := fmt.Sprintf("Failed to commit the prepared SQL statement. [Reason]: %v", err)
-		log.Println(errorMessage)
-		return nil, &domain.DatabaseTransactionError{Message: err.Error()}
+		return nil, nil, err
 	}
 
 	log.Println("SQL query:", statement)
-	return users, nil
+
+	if len(users) <= query.Limit {
+		return users, nil, nil
+	}
+
+	return users[:query.Limit], &cursors[query.Limit-1], nil
 }
 
-func (s *service) InsertNewUser(user domain.User) (int, error) {
-	tx, err := s.db.Begin()
+// ExportUsers calls yield with every user, active only unless includeDeleted
+// is set, in id order. Rows are streamed from the database as they are read
+// and all come from one snapshot. An error from yield stops the export and is
+// returned as is.
+func (s *service) ExportUsers(ctx context.Context, includeDeleted bool, yield func(domain.User) error) error {
+	statement :=
+		`
+	SELECT u.id, u.username, u.email, u.created_at, u.updated_at, ud.deletion_date
+	FROM users u
+	LEFT JOIN user_deletes ud on u.id = ud.user_id
+	WHERE $1 OR ud.user_id IS NULL
+	ORDER BY u.id
+	`
+
+	// Rows already yielded cannot be taken back, so the export is never
+	// retried.
+	options := TxOptions{TxOptions: pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, MaxAttempts: 1}
+	err := WithTx(ctx, s.pool, options, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, statement, includeDeleted)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var user domain.User
+			err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt)
+			if err != nil {
+				return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+			}
+			err = yield(user)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		return nil
+	})
 	if err != nil {
-		return 0, &domain.DatabaseTransactionError{Message: err.Error()}
+		return err
 	}
 
-	statement := "INSERT INTO users (username, email) VALUES ($1, $2) RETURNING id"
+	log.Println("SQL query:", statement)
 
-	query, err := tx.Prepare(statement)
-	if err != nil {
-		tx.Rollback()
-		errorMessage := fmt.Sprintf("Failed to prepare the SQL statement. [Reason]: %v", err)
-		log.Println(errorMessage)
-		return 0, &domain.DatabaseTransactionError{Message: err.Error()}
+	return nil
+}
+
+func stalePreconditionError(userId int, version int, expectedVersion int) error {
+	message := fmt.Sprintf("User with id %d is at version %d, not %d", userId, version, expectedVersion)
+	log.Println(message)
+	return &domain.PreconditionFailedError{Message: message}
+}
+
+// usersPageError maps a failed page query to a domain error. pgx may report
+// cursor keys that cannot be cast back to their column type either from Query
+// or once the rows are read.
+func usersPageError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "22") {
+		return &domain.InvalidQueryError{Parameter: "cursor", Message: "invalid cursor", Err: err}
 	}
-	defer query.Close()
+	return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+}
 
-	err = query.QueryRow(user.Username, user.Email).Scan(&user.ID)
-	if err != nil {
-		tx.Rollback()
-		errorMessage := fmt.Sprintf("Failed to execute the prepared SQL statement. [Reason]: %v", err)
-		log.Println(errorMessage)
+func (s *service) InsertNewUser(ctx context.Context, user domain.User) (int, error) {
+	statement := "INSERT INTO users (username, email) VALUES ($1, $2) RETURNING id, created_at, updated_at, version"
 
-		if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "23505":
-				log.Println("Unique constraint violation:", pqErr.Message)
-				return 0, &domain.UniqueConstraintDatabaseError{Message: pqErr.Message}
-			default:
-				log.Println("Database error:", pqErr.Code.Name())
-				return 0, &domain.UnmappedDatabaseError{Message: pqErr.Message}
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, statement, user.Username, user.Email).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt, &user.Version)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				switch pgErr.Code {
+				case "23505":
+					log.Println("Unique constraint violation:", pgErr.Message)
+					return &domain.UniqueConstraintDatabaseError{Message: pgErr.Message, Err: err}
+				// A value longer than its VARCHAR column.
+				case "22001":
+					return &domain.InvalidUserError{Message: pgErr.Message, Err: err}
+				default:
+					log.Println("Database error:", pgErr.Code)
+					return &domain.UnmappedDatabaseError{Message: pgErr.Message, Err: err}
+				}
 			}
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
 		}
+
+		return recordAudit(ctx, tx, s.auditHashKey, auditChange{userId: user.ID, action: domain.AuditActionInsert, after: &user})
+	})
+	if err != nil {
 		return 0, err
 	}
 
-	err = tx.Commit()
+	log.Println("SQL query:", statement)
+
+	return user.ID, nil
+}
+
+// InsertUsers inserts users with a single statement in one transaction and
+// reports the outcome of each, in order. A user whose email is already taken,
+// or used by an earlier user in the batch, fails without affecting the others
+// unless options.Atomic is set, in which case nothing is inserted. A dry run
+// always rolls back. The error is only set when the batch as a whole could not
+// be run.
+func (s *service) InsertUsers(ctx context.Context, users []domain.User, options domain.BatchInsertOptions) ([]domain.BatchUserResult, error) {
+	statement :=
+		`
+	INSERT INTO users (username, email)
+	SELECT * FROM unnest($1::text[], $2::text[])
+	ON CONFLICT (email) DO NOTHING
+	RETURNING id, username, email, created_at, updated_at, version
+	`
+
+	var results []domain.BatchUserResult
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		results = make([]domain.BatchUserResult, len(users))
+		seen := map[string]bool{}
+		var usernames, emails []string
+		var pending []int
+		for i, user := range users {
+			results[i].Index = i
+			if seen[user.Email] {
+				results[i].Status = domain.BatchUserFailed
+				results[i].Error = "email is already used earlier in this batch"
+				continue
+			}
+			seen[user.Email] = true
+			usernames = append(usernames, user.Username)
+			emails = append(emails, user.Email)
+			pending = append(pending, i)
+		}
+
+		rows, err := tx.Query(ctx, statement, usernames, emails)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		defer rows.Close()
+
+		created := map[string]domain.User{}
+		for rows.Next() {
+			var user domain.User
+			err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version)
+			if err != nil {
+				return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+			}
+			created[user.Email] = user
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				if pgErr.Code == "22001" {
+					return &domain.InvalidUserError{Message: pgErr.Message, Err: err}
+				}
+				return &domain.UnmappedDatabaseError{Message: pgErr.Message, Err: err}
+			}
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		failed := len(pending) < len(users)
+		var changes []auditChange
+		for _, i := range pending {
+			user, ok := created[users[i].Email]
+			if !ok {
+				results[i].Status = domain.BatchUserFailed
+				results[i].Error = "email is already used"
+				failed = true
+				continue
+			}
+			results[i].Status = domain.BatchUserCreated
+			results[i].ID = user.ID
+			changes = append(changes, auditChange{userId: user.ID, action: domain.AuditActionInsert, after: &user})
+		}
+
+		if options.DryRun || (options.Atomic && failed) {
+			status := domain.BatchUserRolledBack
+			if options.DryRun {
+				status = domain.BatchUserValid
+			}
+			for i := range results {
+				if results[i].Status == domain.BatchUserCreated {
+					results[i].Status = status
+					results[i].ID = 0
+				}
+			}
+			return ErrRollback
+		}
+
+		if len(changes) > 0 {
+			return recordAudit(ctx, tx, s.auditHashKey, changes...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return results, nil
+}
+
+func (s *service) UpdateUser(ctx context.Context, userId int, user domain.User, expectedVersion *int) (domain.User, error) {
+	return s.updateUser(ctx, userId, &user.Username, &user.Email, expectedVersion)
+}
+
+func (s *service) PatchUser(ctx context.Context, userId int, patch domain.UserPatch, expectedVersion *int) (domain.User, error) {
+	return s.updateUser(ctx, userId, patch.Username, patch.Email, expectedVersion)
+}
+
+// updateUser sets the non-nil fields on an active user and returns the result.
+// When expectedVersion is set the user is only changed if it is still at that
+// version.
+func (s *service) updateUser(ctx context.Context, userId int, username, email *string, expectedVersion *int) (domain.User, error) {
+	statement :=
+		`
+	UPDATE users
+	SET username = COALESCE($2, username), email = COALESCE($3, email)
+	WHERE id = $1
+	RETURNING id, username, email, created_at, updated_at, version
+	`
+
+	var user domain.User
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		lockStatement :=
+			`
+		SELECT u.id, u.username, u.email, u.created_at, u.updated_at, u.version, ud.user_id IS NOT NULL
+		FROM users u
+		LEFT JOIN user_deletes ud on u.id = ud.user_id
+		WHERE u.id = $1
+		FOR UPDATE OF u
+		`
+
+		var before domain.User
+		var deleted bool
+		err := tx.QueryRow(ctx, lockStatement, userId).Scan(&before.ID, &before.Username, &before.Email, &before.CreatedAt, &before.UpdatedAt, &before.Version, &deleted)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				message := fmt.Sprintf("User with id %d does not exist", userId)
+				log.Println(message)
+				return &domain.UserNotFoundError{Message: message, Err: err}
+			}
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		if deleted {
+			message := fmt.Sprintf("User with id %d has been deleted", userId)
+			return &domain.UserDeletedError{Message: message}
+		}
+		if expectedVersion != nil && *expectedVersion != before.Version {
+			return stalePreconditionError(userId, before.Version, *expectedVersion)
+		}
+
+		user = domain.User{}
+		err = tx.QueryRow(ctx, statement, userId, username, email).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				switch pgErr.Code {
+				case "23505":
+					log.Println("Unique constraint violation:", pgErr.Message)
+					return &domain.UniqueConstraintDatabaseError{Message: pgErr.Message, Err: err}
+				// A value longer than its VARCHAR column.
+				case "22001":
+					return &domain.InvalidUserError{Message: pgErr.Message, Err: err}
+				default:
+					log.Println("Database error:", pgErr.Code)
+					return &domain.UnmappedDatabaseError{Message: pgErr.Message, Err: err}
+				}
+			}
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		return recordAudit(ctx, tx, s.auditHashKey, auditChange{userId: userId, action: domain.AuditActionUpdate, before: &before, after: &user})
+	})
 	if err != nil {
-		tx.Rollback()
-		errorMessage := fmt.Sprintf("Failed to commit the prepared SQL statement. [Reason]: %v", err)
-		log.Println(errorMessage)
-		return 0, &domain.DatabaseTransactionError{Message: err.Error()}
+		return domain.User{}, err
 	}
 
 	log.Println("SQL query:", statement)
 
-	return user.ID, nil
+	return user, nil
 }
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"db_access/internal/domain"
+)
+
+// newLeaseToken returns a random token identifying one reservation of an
+// Idempotency-Key.
+func newLeaseToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// ReserveIdempotencyKey claims key for a request whose payload hashes to
+// requestHash, for lease. It reports true when the caller now owns the key and
+// must complete or release it with the record's LeaseToken. Otherwise it returns the key's live record,
+// which may belong to a request that is still in progress. Expired keys are
+// purged and can be claimed again, so a key whose request never completed, as
+// when the process crashed, is freed once its lease runs out.
+func (s *service) ReserveIdempotencyKey(ctx context.Context, key string, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error) {
+	statement :=
+		`
+	INSERT INTO idempotency_keys (idempotency_key, request_hash, lease_token, expires_at)
+	VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4::interval)
+	ON CONFLICT (idempotency_key) DO NOTHING
+	`
+
+	leaseToken := newLeaseToken()
+	var record domain.IdempotencyRecord
+	var reserved bool
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		purgeStatement := "DELETE FROM idempotency_keys WHERE expires_at <= CURRENT_TIMESTAMP"
+
+		_, err := tx.Exec(ctx, purgeStatement)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		tag, err := tx.Exec(ctx, statement, key, requestHash, leaseToken, lease)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		reserved = tag.RowsAffected() == 1
+		record = domain.IdempotencyRecord{Key: key, RequestHash: requestHash}
+		if reserved {
+			record.LeaseToken = leaseToken
+			return nil
+		}
+
+		selectStatement :=
+			`
+		SELECT request_hash, COALESCE(status_code, 0), response_body, user_id, expires_at
+		FROM idempotency_keys
+		WHERE idempotency_key = $1
+		`
+
+		err = tx.QueryRow(ctx, selectStatement, key).Scan(&record.RequestHash, &record.StatusCode, &record.Body, &record.UserID, &record.ExpiresAt)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return domain.IdempotencyRecord{}, false, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return record, reserved, nil
+}
+
+// CompleteIdempotencyKey stores the response to the request that reserved key
+// with leaseToken, so retries with the same key replay it for ttl. It fails
+// with an IdempotencyLeaseLostError when the request no longer holds the key.
+func (s *service) CompleteIdempotencyKey(ctx context.Context, key string, leaseToken string, statusCode int, body []byte, userId *int, ttl time.Duration) error {
+	statement :=
+		`
+	UPDATE idempotency_keys
+	SET status_code = $3, response_body = $4, user_id = $5, expires_at = CURRENT_TIMESTAMP + $6::interval
+	WHERE idempotency_key = $1 AND lease_token = $2 AND status_code IS NULL
+	`
+
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, statement, key, leaseToken, statusCode, body, userId, ttl)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		if tag.RowsAffected() == 0 {
+			return idempotencyLeaseLost(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets key, reserved with leaseToken, so a retry runs
+// the request again, for responses that must not be replayed such as server
+// errors. It fails with an IdempotencyLeaseLostError when the request no
+// longer holds the key.
+func (s *service) ReleaseIdempotencyKey(ctx context.Context, key string, leaseToken string) error {
+	statement := "DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND lease_token = $2 AND status_code IS NULL"
+
+	err := WithTx(ctx, s.pool, TxOptions{}, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, statement, key, leaseToken)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		if tag.RowsAffected() == 0 {
+			return idempotencyLeaseLost(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return nil
+}
+
+// idempotencyLeaseLost reports a request that no longer holds key.
+func idempotencyLeaseLost(key string) error {
+	message := fmt.Sprintf("Idempotency-Key %s is no longer held by this request", key)
+	log.Println(message)
+	return &domain.IdempotencyLeaseLostError{Message: message}
+}
@@ -0,0 +1,743 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"db_access/internal/domain"
+)
+
+// memoryService keeps every table in memory behind a single lock, so each
+// method sees and changes the data as one transaction would. It enforces the
+// same constraints and returns the same errors as the Postgres service, and is
+// meant for local development and tests. Nothing survives Close.
+type memoryService struct {
+	mu sync.Mutex
+	// users is keyed by id. A deleted user keeps its row, with DeletedAt set,
+	// as it does in Postgres.
+	users  map[int]*domain.User
+	nextId int
+	// emails maps every email, deleted users' included, to the user holding
+	// it, standing in for the unique index on users.email.
+	emails      map[string]int
+	audit       []domain.AuditEntry
+	idempotency map[string]domain.IdempotencyRecord
+}
+
+// NewMemory returns an empty in-memory DatabaseService.
+func NewMemory() DatabaseService {
+	return &memoryService{
+		users:       map[int]*domain.User{},
+		nextId:      1,
+		emails:      map[string]int{},
+		idempotency: map[string]domain.IdempotencyRecord{},
+	}
+}
+
+// contextError fails a call made with a context that is already done, as the
+// Postgres service does when its query is cancelled.
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+	return nil
+}
+
+func (s *memoryService) Close() {}
+
+func (s *memoryService) PoolStats() domain.PoolStats {
+	return domain.PoolStats{AcquireDuration: time.Duration(0).String()}
+}
+
+// Health is always up. The schema is implied by the code, so it reports the
+// latest embedded migration as applied.
+func (s *memoryService) Health(ctx context.Context) domain.DatabaseHealth {
+	health := domain.DatabaseHealth{Status: "up", Pool: s.PoolStats()}
+
+	version, err := LatestMigrationVersion()
+	if err != nil {
+		health.Status = "down"
+		health.Error = err.Error()
+		return health
+	}
+	health.MigrationVersion = version
+
+	return health
+}
+
+// user returns the user with userId, or a UserNotFoundError.
+func (s *memoryService) user(userId int) (*domain.User, error) {
+	user, ok := s.users[userId]
+	if !ok {
+		message := fmt.Sprintf("User with id %d does not exist", userId)
+		log.Println(message)
+		return nil, &domain.UserNotFoundError{Message: message}
+	}
+	return user, nil
+}
+
+// activeUser returns the user with userId, or a UserNotFoundError or
+// UserDeletedError.
+func (s *memoryService) activeUser(userId int) (*domain.User, error) {
+	user, err := s.user(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.DeletedAt != nil {
+		message := fmt.Sprintf("User with id %d has been deleted", userId)
+		return nil, &domain.UserDeletedError{Message: message}
+	}
+	return user, nil
+}
+
+func uniqueEmailError() error {
+	message := `duplicate key value violates unique constraint "users_email_key"`
+	log.Println("Unique constraint violation:", message)
+	return &domain.UniqueConstraintDatabaseError{Message: message}
+}
+
+// Lengths of the users columns, which Postgres enforces as VARCHARs.
+const (
+	maxUsernameLength = 50
+	maxEmailLength    = 100
+)
+
+// userLengthError reports a username or email longer than its column, with
+// the error Postgres reports.
+func userLengthError(username, email *string) error {
+	columns := []struct {
+		value  *string
+		length int
+	}{
+		{username, maxUsernameLength},
+		{email, maxEmailLength},
+	}
+	for _, column := range columns {
+		if column.value != nil && utf8.RuneCountInString(*column.value) > column.length {
+			message := fmt.Sprintf("value too long for type character varying(%d)", column.length)
+			log.Println("Database error:", message)
+			return &domain.InvalidUserError{Message: message}
+		}
+	}
+	return nil
+}
+
+func (s *memoryService) InsertNewUser(ctx context.Context, user domain.User) (int, error) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+	if err := userLengthError(&user.Username, &user.Email); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.emails[user.Email]; taken {
+		return 0, uniqueEmailError()
+	}
+
+	created := s.newUser(user)
+	s.insert(created)
+	s.recordAudit(ctx, auditChange{userId: created.ID, action: domain.AuditActionInsert, after: &created})
+
+	return created.ID, nil
+}
+
+// newUser takes the next id for user and sets its timestamps and version as
+// the column defaults would. Like a sequence, an id taken is never handed out
+// again even if the user is not inserted.
+func (s *memoryService) newUser(user domain.User) domain.User {
+	now := microsecondNow()
+	createdAt, updatedAt := now, now
+
+	created := domain.User{
+		ID:        s.nextId,
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: &createdAt,
+		UpdatedAt: &updatedAt,
+		Version:   1,
+	}
+	s.nextId++
+	return created
+}
+
+func (s *memoryService) insert(user domain.User) {
+	s.users[user.ID] = &user
+	s.emails[user.Email] = user.ID
+}
+
+// InsertUsers follows the Postgres service: a user whose email is taken fails
+// on its own unless options.Atomic is set, a value too long for its column
+// fails the whole batch, and a dry run changes nothing.
+func (s *memoryService) InsertUsers(ctx context.Context, users []domain.User, options domain.BatchInsertOptions) ([]domain.BatchUserResult, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if err := userLengthError(&user.Username, &user.Email); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]domain.BatchUserResult, len(users))
+	seen := map[string]bool{}
+	var created []domain.User
+	failed := false
+	for i, user := range users {
+		results[i].Index = i
+		if seen[user.Email] {
+			results[i].Status = domain.BatchUserFailed
+			results[i].Error = "email is already used earlier in this batch"
+			failed = true
+			continue
+		}
+		seen[user.Email] = true
+		if _, taken := s.emails[user.Email]; taken {
+			results[i].Status = domain.BatchUserFailed
+			results[i].Error = "email is already used"
+			failed = true
+			continue
+		}
+
+		newUser := s.newUser(user)
+		results[i].Status = domain.BatchUserCreated
+		results[i].ID = newUser.ID
+		created = append(created, newUser)
+	}
+
+	if options.DryRun || (options.Atomic && failed) {
+		status := domain.BatchUserRolledBack
+		if options.DryRun {
+			status = domain.BatchUserValid
+		}
+		for i := range results {
+			if results[i].Status == domain.BatchUserCreated {
+				results[i].Status = status
+				results[i].ID = 0
+			}
+		}
+		return results, nil
+	}
+
+	changes := make([]auditChange, len(created))
+	for i := range created {
+		s.insert(created[i])
+		changes[i] = auditChange{userId: created[i].ID, action: domain.AuditActionInsert, after: &created[i]}
+	}
+	if len(changes) > 0 {
+		s.recordAudit(ctx, changes...)
+	}
+
+	return results, nil
+}
+
+// ExportUsers copies the users out before calling yield, so the export is of
+// one snapshot and yield may call back into the service.
+func (s *memoryService) ExportUsers(ctx context.Context, includeDeleted bool, yield func(domain.User) error) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	var users []domain.User
+	for _, user := range s.sortedUsers() {
+		if !includeDeleted && user.DeletedAt != nil {
+			continue
+		}
+		user.Version = 0
+		users = append(users, user)
+	}
+	s.mu.Unlock()
+
+	for _, user := range users {
+		err := yield(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortedUsers returns a copy of every user in id order.
+func (s *memoryService) sortedUsers() []domain.User {
+	users := make([]domain.User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, *user)
+	}
+	slices.SortFunc(users, func(a, b domain.User) int {
+		return a.ID - b.ID
+	})
+	return users
+}
+
+func (s *memoryService) GetUserByID(ctx context.Context, userId int) (domain.User, error) {
+	if err := contextError(ctx); err != nil {
+		return domain.User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.activeUser(userId)
+	if err != nil {
+		return domain.User{}, err
+	}
+
+	return *user, nil
+}
+
+// GetUsersPage applies the query the way buildUsersPageQuery does. Its cursor
+// keys are the user's own values as text, so cursors are not interchangeable
+// with those of the Postgres service.
+func (s *memoryService) GetUsersPage(ctx context.Context, query domain.UsersQuery) ([]domain.User, *domain.UsersCursor, error) {
+	columns, descending, err := memoryOrderingColumns(query.Sort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var after []any
+	if query.After != nil {
+		if len(query.After.Keys) != len(columns) {
+			return nil, nil, &domain.InvalidQueryError{Parameter: "cursor", Message: "cursor does not match the requested sort"}
+		}
+		after = make([]any, len(columns))
+		for i, column := range columns {
+			after[i], err = column.parse(query.After.Keys[i])
+			if err != nil {
+				return nil, nil, &domain.InvalidQueryError{Parameter: "cursor", Message: "invalid cursor", Err: err}
+			}
+		}
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	compare := func(user domain.User, values []any) int {
+		for i, column := range columns {
+			order := column.compare(column.value(user), values[i])
+			if descending[i] {
+				order = -order
+			}
+			if order != 0 {
+				return order
+			}
+		}
+		return 0
+	}
+
+	users := []domain.User{}
+	for _, user := range s.sortedUsers() {
+		if !query.IncludeDeleted && user.DeletedAt != nil {
+			continue
+		}
+		if !strings.HasPrefix(user.Username, query.UsernamePrefix) {
+			continue
+		}
+		if query.EmailDomain != "" && !strings.EqualFold(emailDomain(user.Email), query.EmailDomain) {
+			continue
+		}
+		if query.CreatedAfter != nil && !user.CreatedAt.After(*query.CreatedAfter) {
+			continue
+		}
+		if query.CreatedBefore != nil && !user.CreatedAt.Before(*query.CreatedBefore) {
+			continue
+		}
+		if after != nil && compare(user, after) <= 0 {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	slices.SortFunc(users, func(a, b domain.User) int {
+		values := make([]any, len(columns))
+		for i, column := range columns {
+			values[i] = column.value(b)
+		}
+		return compare(a, values)
+	})
+
+	if len(users) <= query.Limit {
+		return users, nil, nil
+	}
+
+	users = users[:query.Limit]
+	last := users[query.Limit-1]
+	cursor := &domain.UsersCursor{Keys: make([]string, len(columns))}
+	for i, column := range columns {
+		cursor.Keys[i] = column.format(column.value(last))
+	}
+
+	return users, cursor, nil
+}
+
+// emailDomain returns what follows the first @ of email up to any second one,
+// as split_part does.
+func emailDomain(email string) string {
+	parts := strings.Split(email, "@")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// memoryColumn is a field a user listing can be sorted by, with how to read,
+// compare and write it as a cursor key.
+type memoryColumn struct {
+	value   func(domain.User) any
+	compare func(a, b any) int
+	format  func(any) string
+	parse   func(string) (any, error)
+}
+
+var (
+	memoryIntColumn = memoryColumn{
+		compare: func(a, b any) int { return a.(int) - b.(int) },
+		format:  func(v any) string { return strconv.Itoa(v.(int)) },
+		parse:   func(key string) (any, error) { return strconv.Atoi(key) },
+	}
+	// Text is compared in byte order, as the SQL backends sort it.
+	memoryTextColumn = memoryColumn{
+		compare: func(a, b any) int { return strings.Compare(a.(string), b.(string)) },
+		format:  func(v any) string { return v.(string) },
+		parse:   func(key string) (any, error) { return key, nil },
+	}
+	memoryTimeColumn = memoryColumn{
+		compare: func(a, b any) int { return a.(time.Time).Compare(b.(time.Time)) },
+		format:  func(v any) string { return v.(time.Time).Format(time.RFC3339Nano) },
+		parse:   func(key string) (any, error) { return time.Parse(time.RFC3339Nano, key) },
+	}
+)
+
+func (c memoryColumn) reading(value func(domain.User) any) memoryColumn {
+	c.value = value
+	return c
+}
+
+// memoryUserSortColumns mirrors userSortColumns.
+var memoryUserSortColumns = map[string]memoryColumn{
+	"id":         memoryIntColumn.reading(func(u domain.User) any { return u.ID }),
+	"username":   memoryTextColumn.reading(func(u domain.User) any { return u.Username }),
+	"email":      memoryTextColumn.reading(func(u domain.User) any { return u.Email }),
+	"created_at": memoryTimeColumn.reading(func(u domain.User) any { return *u.CreatedAt }),
+	"updated_at": memoryTimeColumn.reading(func(u domain.User) any { return *u.UpdatedAt }),
+}
+
+// memoryOrderingColumns resolves the requested sort as orderingColumns does,
+// reporting the same errors and ending with the id.
+func memoryOrderingColumns(sort []domain.SortField) ([]memoryColumn, []bool, error) {
+	_, descending, err := orderingColumns(sort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var columns []memoryColumn
+	for _, field := range sort {
+		columns = append(columns, memoryUserSortColumns[field.Field])
+	}
+	if len(columns) < len(descending) {
+		columns = append(columns, memoryUserSortColumns["id"])
+	}
+
+	return columns, descending, nil
+}
+
+func (s *memoryService) UpdateUser(ctx context.Context, userId int, user domain.User, expectedVersion *int) (domain.User, error) {
+	return s.updateUser(ctx, userId, &user.Username, &user.Email, expectedVersion)
+}
+
+func (s *memoryService) PatchUser(ctx context.Context, userId int, patch domain.UserPatch, expectedVersion *int) (domain.User, error) {
+	return s.updateUser(ctx, userId, patch.Username, patch.Email, expectedVersion)
+}
+
+func (s *memoryService) updateUser(ctx context.Context, userId int, username, email *string, expectedVersion *int) (domain.User, error) {
+	if err := contextError(ctx); err != nil {
+		return domain.User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.activeUser(userId)
+	if err != nil {
+		return domain.User{}, err
+	}
+	if expectedVersion != nil && *expectedVersion != user.Version {
+		return domain.User{}, stalePreconditionError(userId, user.Version, *expectedVersion)
+	}
+	if err := userLengthError(username, email); err != nil {
+		return domain.User{}, err
+	}
+	if email != nil && *email != user.Email {
+		if _, taken := s.emails[*email]; taken {
+			return domain.User{}, uniqueEmailError()
+		}
+	}
+
+	before := *user
+	after := *user
+	if username != nil {
+		after.Username = *username
+	}
+	if email != nil {
+		after.Email = *email
+	}
+	updatedAt := microsecondNow()
+	after.UpdatedAt = &updatedAt
+	after.Version++
+
+	delete(s.emails, before.Email)
+	s.insert(after)
+	s.recordAudit(ctx, auditChange{userId: userId, action: domain.AuditActionUpdate, before: &before, after: &after})
+
+	return after, nil
+}
+
+func (s *memoryService) SoftDeleteUser(ctx context.Context, userId int, expectedVersion *int) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.user(userId)
+	if err != nil {
+		return err
+	}
+	if expectedVersion != nil && *expectedVersion != user.Version {
+		return stalePreconditionError(userId, user.Version, *expectedVersion)
+	}
+	if user.DeletedAt != nil {
+		message := fmt.Sprintf("User with id %d has already been deleted", userId)
+		log.Println(message)
+		return &domain.UserDeletedError{Message: message}
+	}
+
+	before := *user
+	deletedAt := microsecondNow()
+	user.DeletedAt = &deletedAt
+	user.UpdatedAt = &deletedAt
+	user.Version++
+	after := *user
+	s.recordAudit(ctx, auditChange{userId: userId, action: domain.AuditActionDelete, before: &before, after: &after})
+
+	return nil
+}
+
+func (s *memoryService) RestoreUser(ctx context.Context, userId int, expectedVersion *int) (domain.User, error) {
+	if err := contextError(ctx); err != nil {
+		return domain.User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.user(userId)
+	if err != nil {
+		return domain.User{}, err
+	}
+	if expectedVersion != nil && *expectedVersion != user.Version {
+		return domain.User{}, stalePreconditionError(userId, user.Version, *expectedVersion)
+	}
+	if user.DeletedAt == nil {
+		message := fmt.Sprintf("User with id %d has not been deleted", userId)
+		return domain.User{}, &domain.UserNotDeletedError{Message: message}
+	}
+
+	before := *user
+	updatedAt := microsecondNow()
+	user.DeletedAt = nil
+	user.UpdatedAt = &updatedAt
+	user.Version++
+	after := *user
+	s.recordAudit(ctx, auditChange{userId: userId, action: domain.AuditActionRestore, before: &before, after: &after})
+
+	return after, nil
+}
+
+// recordAudit appends changes to the audit log, hashed and chained exactly as
+// the Postgres service chains them, so the log verifies the same way.
+func (s *memoryService) recordAudit(ctx context.Context, changes ...auditChange) {
+	previousHash := ""
+	if len(s.audit) > 0 {
+		previousHash = s.audit[len(s.audit)-1].Hash
+	}
+
+	// The state is marshalled from a domain.User, which is always valid JSON,
+	// so hashing it cannot fail.
+	entries, _ := newAuditEntries(ctx, nil, previousHash, changes)
+	for _, entry := range entries {
+		entry.ID = int64(len(s.audit)) + 1
+		s.audit = append(s.audit, entry)
+	}
+}
+
+func (s *memoryService) GetUserHistory(ctx context.Context, userId int) ([]domain.AuditEntry, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.user(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []domain.AuditEntry{}
+	for _, entry := range s.audit {
+		if entry.UserID == userId {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *memoryService) GetAuditLog(ctx context.Context, query domain.AuditQuery) ([]domain.AuditEntry, *int64, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []domain.AuditEntry{}
+	for _, entry := range s.audit {
+		switch {
+		case query.UserID != 0 && entry.UserID != query.UserID,
+			query.Actor != "" && entry.Actor != query.Actor,
+			query.Action != "" && entry.Action != query.Action,
+			query.RequestID != "" && entry.RequestID != query.RequestID,
+			query.CreatedAfter != nil && !entry.CreatedAt.After(*query.CreatedAfter),
+			query.CreatedBefore != nil && !entry.CreatedAt.Before(*query.CreatedBefore),
+			entry.ID <= query.AfterID:
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > query.Limit {
+			break
+		}
+	}
+
+	if len(entries) <= query.Limit {
+		return entries, nil, nil
+	}
+
+	entries = entries[:query.Limit]
+	return entries, &entries[query.Limit-1].ID, nil
+}
+
+func (s *memoryService) VerifyAuditLog(ctx context.Context) (domain.AuditVerification, error) {
+	if err := contextError(ctx); err != nil {
+		return domain.AuditVerification{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Nothing outside the process can change the log, so it is never keyed
+	// and every entry is hashed.
+	chain := newAuditChain(nil, 0)
+	for _, entry := range s.audit {
+		if !chain.add(entry) {
+			break
+		}
+	}
+
+	return chain.verification, nil
+}
+
+func (s *memoryService) ReserveIdempotencyKey(ctx context.Context, key string, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error) {
+	if err := contextError(ctx); err != nil {
+		return domain.IdempotencyRecord{}, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := microsecondNow()
+	for existing, record := range s.idempotency {
+		if !record.ExpiresAt.After(now) {
+			delete(s.idempotency, existing)
+		}
+	}
+
+	if record, ok := s.idempotency[key]; ok {
+		record.LeaseToken = ""
+		return record, false, nil
+	}
+
+	leaseToken := newLeaseToken()
+	s.idempotency[key] = domain.IdempotencyRecord{Key: key, RequestHash: requestHash, LeaseToken: leaseToken, ExpiresAt: now.Add(lease)}
+	return domain.IdempotencyRecord{Key: key, RequestHash: requestHash, LeaseToken: leaseToken}, true, nil
+}
+
+// heldIdempotencyKey returns the record of key while it is still reserved with
+// leaseToken, or an IdempotencyLeaseLostError.
+func (s *memoryService) heldIdempotencyKey(key string, leaseToken string) (domain.IdempotencyRecord, error) {
+	record, ok := s.idempotency[key]
+	if !ok || record.LeaseToken != leaseToken || record.StatusCode != 0 {
+		return domain.IdempotencyRecord{}, idempotencyLeaseLost(key)
+	}
+	return record, nil
+}
+
+func (s *memoryService) CompleteIdempotencyKey(ctx context.Context, key string, leaseToken string, statusCode int, body []byte, userId *int, ttl time.Duration) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.heldIdempotencyKey(key, leaseToken)
+	if err != nil {
+		return err
+	}
+	record.StatusCode = statusCode
+	record.Body = slices.Clone(body)
+	record.ExpiresAt = microsecondNow().Add(ttl)
+	record.UserID = nil
+	if userId != nil {
+		id := *userId
+		record.UserID = &id
+	}
+	s.idempotency[key] = record
+
+	return nil
+}
+
+func (s *memoryService) ReleaseIdempotencyKey(ctx context.Context, key string, leaseToken string) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.heldIdempotencyKey(key, leaseToken); err != nil {
+		return err
+	}
+	delete(s.idempotency, key)
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+
+	"db_access/migrations"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// LatestMigrationVersion returns the version of the newest embedded migration.
+func LatestMigrationVersion() (int64, error) {
+	files, err := fs.Glob(migrations.FS, "*.sql")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+	for _, file := range files {
+		version, err := goose.NumericComponent(file)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse the migration file %q: %w", file, err)
+		}
+		latest = max(latest, version)
+	}
+
+	if latest == 0 {
+		return 0, goose.ErrNoMigrationFiles
+	}
+
+	return latest, nil
+}
+
+// Migrator applies the embedded migrations. On Postgres every change is made
+// while holding an advisory lock so replicas starting at once apply them only
+// once.
+type Migrator struct {
+	provider *goose.Provider
+}
+
+func NewMigrator(connectionString string) (*Migrator, error) {
+	db, err := sql.Open("pgx", connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the database: %w", err)
+	}
+
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	provider, err := goose.NewProvider(goose.DialectPostgres, db, migrations.FS, goose.WithSessionLocker(locker))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to load the migrations: %w", err)
+	}
+
+	return &Migrator{provider: provider}, nil
+}
+
+// NewSQLiteMigrator returns a Migrator for the SQLite database at path, which
+// is created if it does not exist. SQLite is only ever used by a single node,
+// so no lock is taken beyond SQLite's own.
+func NewSQLiteMigrator(path string) (*Migrator, error) {
+	db, err := sql.Open("sqlite", sqliteDataSourceName(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the database: %w", err)
+	}
+
+	sqliteMigrations, err := fs.Sub(migrations.SQLiteFS, "sqlite")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	provider, err := goose.NewProvider(goose.DialectSQLite3, db, sqliteMigrations)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to load the migrations: %w", err)
+	}
+
+	return &Migrator{provider: provider}, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) ([]*goose.MigrationResult, error) {
+	return m.provider.Up(ctx)
+}
+
+// Down rolls back the latest applied migration.
+func (m *Migrator) Down(ctx context.Context) (*goose.MigrationResult, error) {
+	return m.provider.Down(ctx)
+}
+
+// Redo rolls back the latest applied migration and applies it again.
+func (m *Migrator) Redo(ctx context.Context) ([]*goose.MigrationResult, error) {
+	down, err := m.provider.Down(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	up, err := m.provider.UpByOne(ctx)
+	if err != nil {
+		return []*goose.MigrationResult{down}, err
+	}
+
+	return []*goose.MigrationResult{down, up}, nil
+}
+
+// Status lists every migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]*goose.MigrationStatus, error) {
+	return m.provider.Status(ctx)
+}
+
+// Version returns the latest applied migration, 0 when none have been.
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	return m.provider.GetDBVersion(ctx)
+}
+
+// Close closes the migrator's database connection.
+func (m *Migrator) Close() error {
+	return m.provider.Close()
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"db_access/internal/domain"
+)
+
+type userColumn struct {
+	expression string
+	sqlType    string
+}
+
+// userSortColumns is the whitelist of fields a user listing can be sorted by.
+// Only these expressions are ever written into the SQL, values are always
+// passed as parameters.
+var userSortColumns = map[string]userColumn{
+	"id":         {expression: "u.id", sqlType: "integer"},
+	"username":   {expression: "u.username", sqlType: "text"},
+	"email":      {expression: "u.email", sqlType: "text"},
+	"created_at": {expression: "u.created_at", sqlType: "timestamptz"},
+	"updated_at": {expression: "u.updated_at", sqlType: "timestamptz"},
+}
+
+// userColumnCount is the number of user columns selected by buildUsersPageQuery
+// ahead of the ordering columns.
+const userColumnCount = 7
+
+// sqlDialect writes the parts of a user listing that differ between the SQL
+// databases the service runs on.
+type sqlDialect interface {
+	// placeholder is the parameter marker of the nth argument, from 1.
+	placeholder(n int) string
+	// cursorKey returns the argument to compare column with for a key of a
+	// cursor, and any cast the argument needs. A key that can never be of the
+	// column's type is an error, when the dialect can tell up front.
+	cursorKey(column userColumn, key string) (any, string, error)
+	// text casts expression to text, to be returned as a cursor key.
+	text(expression string) string
+	// ordered is the expression column is sorted and compared by. Text sorts
+	// in byte order, as in every other backend, rather than by collation.
+	ordered(column userColumn) string
+	// usernamePrefix is the condition for users whose username starts with
+	// prefix, case sensitively.
+	usernamePrefix(q *usersPageQuery, prefix string) string
+	// emailDomain is the condition for users whose email is at domain, case
+	// insensitively.
+	emailDomain(q *usersPageQuery, domain string) string
+	// timestamp is the argument for a time compared with a timestamp column.
+	timestamp(t time.Time) any
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// cursorKey leaves Postgres to cast the key, a key it cannot cast fails the
+// query and is reported by usersPageError.
+func (postgresDialect) cursorKey(column userColumn, key string) (any, string, error) {
+	return key, "::" + column.sqlType, nil
+}
+
+func (postgresDialect) text(expression string) string {
+	return expression + "::text"
+}
+
+func (postgresDialect) ordered(column userColumn) string {
+	if column.sqlType == "text" {
+		return column.expression + ` COLLATE "C"`
+	}
+	return column.expression
+}
+
+func (postgresDialect) usernamePrefix(q *usersPageQuery, prefix string) string {
+	return fmt.Sprintf(`u.username LIKE %s ESCAPE '\'`, q.arg(escapeLike(prefix)+"%"))
+}
+
+func (postgresDialect) emailDomain(q *usersPageQuery, domain string) string {
+	return fmt.Sprintf("lower(split_part(u.email, '@', 2)) = lower(%s)", q.arg(domain))
+}
+
+func (postgresDialect) timestamp(t time.Time) any {
+	return t
+}
+
+// usersPageQuery builds a SQL statement and its arguments from a UsersQuery.
+type usersPageQuery struct {
+	dialect    sqlDialect
+	conditions []string
+	args       []any
+}
+
+func (q *usersPageQuery) arg(value any) string {
+	q.args = append(q.args, value)
+	return q.dialect.placeholder(len(q.args))
+}
+
+// key adds the argument for a cursor key compared with column.
+func (q *usersPageQuery) key(column userColumn, key string) (string, error) {
+	value, cast, err := q.dialect.cursorKey(column, key)
+	if err != nil {
+		return "", &domain.InvalidQueryError{Parameter: "cursor", Message: "invalid cursor", Err: err}
+	}
+	return q.arg(value) + cast, nil
+}
+
+func (q *usersPageQuery) where() string {
+	if len(q.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(q.conditions, " AND ")
+}
+
+// orderingColumns resolves the requested sort against the whitelist and always
+// ends with the id so the ordering is total, which keyset pagination relies on.
+func orderingColumns(sort []domain.SortField) ([]userColumn, []bool, error) {
+	var columns []userColumn
+	var descending []bool
+	seen := map[string]bool{}
+
+	for _, field := range sort {
+		column, ok := userSortColumns[field.Field]
+		if !ok {
+			return nil, nil, &domain.InvalidQueryError{Parameter: "sort", Message: fmt.Sprintf("cannot sort by %q", field.Field)}
+		}
+		if seen[field.Field] {
+			return nil, nil, &domain.InvalidQueryError{Parameter: "sort", Message: fmt.Sprintf("%q is sorted by more than once", field.Field)}
+		}
+		seen[field.Field] = true
+		columns = append(columns, column)
+		descending = append(descending, field.Descending)
+	}
+
+	if !seen["id"] {
+		columns = append(columns, userSortColumns["id"])
+		descending = append(descending, false)
+	}
+
+	return columns, descending, nil
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// buildUsersPageQuery returns the statement for one page of users in dialect,
+// active only unless IncludeDeleted is set. The statement selects id, username,
+// email, created_at, updated_at, deleted_at and version followed by every
+// ordering column as text, and fetches one row more than the limit.
+func buildUsersPageQuery(dialect sqlDialect, query domain.UsersQuery) (string, []any, error) {
+	columns, descending, err := orderingColumns(query.Sort)
+	if err != nil {
+		return "", nil, err
+	}
+
+	q := &usersPageQuery{dialect: dialect}
+	if !query.IncludeDeleted {
+		q.conditions = append(q.conditions, "ud.user_id IS NULL")
+	}
+
+	if query.UsernamePrefix != "" {
+		q.conditions = append(q.conditions, dialect.usernamePrefix(q, query.UsernamePrefix))
+	}
+	if query.EmailDomain != "" {
+		q.conditions = append(q.conditions, dialect.emailDomain(q, query.EmailDomain))
+	}
+	if query.CreatedAfter != nil {
+		q.conditions = append(q.conditions, fmt.Sprintf("u.created_at > %s", q.arg(dialect.timestamp(*query.CreatedAfter))))
+	}
+	if query.CreatedBefore != nil {
+		q.conditions = append(q.conditions, fmt.Sprintf("u.created_at < %s", q.arg(dialect.timestamp(*query.CreatedBefore))))
+	}
+
+	if query.After != nil {
+		if len(query.After.Keys) != len(columns) {
+			return "", nil, &domain.InvalidQueryError{Parameter: "cursor", Message: "cursor does not match the requested sort"}
+		}
+
+		// (k1 > v1) OR (k1 = v1 AND k2 < v2) OR ... with the comparison
+		// flipped for descending columns.
+		var alternatives []string
+		for i, column := range columns {
+			var terms []string
+			for j := 0; j < i; j++ {
+				key, err := q.key(columns[j], query.After.Keys[j])
+				if err != nil {
+					return "", nil, err
+				}
+				terms = append(terms, fmt.Sprintf("%s = %s", dialect.ordered(columns[j]), key))
+			}
+			operator := ">"
+			if descending[i] {
+				operator = "<"
+			}
+			key, err := q.key(column, query.After.Keys[i])
+			if err != nil {
+				return "", nil, err
+			}
+			terms = append(terms, fmt.Sprintf("%s %s %s", dialect.ordered(column), operator, key))
+			alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+		}
+		q.conditions = append(q.conditions, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	var keys, orderBy []string
+	for i, column := range columns {
+		keys = append(keys, dialect.text(column.expression))
+		direction := "ASC"
+		if descending[i] {
+			direction = "DESC"
+		}
+		orderBy = append(orderBy, dialect.ordered(column)+" "+direction)
+	}
+
+	statement := fmt.Sprintf(
+		`
+	SELECT u.id, u.username, u.email, u.created_at, u.updated_at, ud.deletion_date, u.version, %s
+	FROM users u
+	LEFT JOIN user_deletes ud on u.id = ud.user_id
+	%s
+	ORDER BY %s
+	LIMIT %s
+	`,
+		strings.Join(keys, ", "),
+		q.where(),
+		strings.Join(orderBy, ", "),
+		q.arg(query.Limit+1),
+	)
+
+	return statement, q.args, nil
+}
@@ -0,0 +1,1018 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"db_access/internal/domain"
+)
+
+// sqliteTimeLayout is how timestamps are stored in SQLite, as fixed width text
+// in UTC so they sort as they compare.
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000Z"
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func parseSQLiteTime(value string) (*time.Time, error) {
+	t, err := time.Parse(sqliteTimeLayout, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// sqliteDataSourceName returns the connection string for the SQLite database
+// at path. Foreign keys are enforced, a locked database is waited on rather
+// than failing straight away, and every transaction that can write takes the
+// write lock as it begins, so transactions recording to the audit log's hash
+// chain run one at a time.
+func sqliteDataSourceName(path string) string {
+	return "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+}
+
+// sqliteErrorCode returns the extended result code of a SQLite error, or 0 for
+// any other error.
+func sqliteErrorCode(err error) int {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()
+	}
+	return 0
+}
+
+// sqliteService runs every statement against a SQLite database file through
+// database/sql. It returns the same errors as the Postgres service, and is
+// meant for single node deployments that cannot run Postgres.
+type sqliteService struct {
+	db           *sql.DB
+	auditHashKey []byte
+}
+
+// NewSQLite opens the SQLite database at path, creating it if it does not
+// exist, and pings it. The schema is created by NewSQLiteMigrator. The audit
+// log is hashed with auditHashKey as New hashes it.
+func NewSQLite(ctx context.Context, path string, auditHashKey []byte) (DatabaseService, error) {
+	db, err := sql.Open("sqlite", sqliteDataSourceName(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the database: %w", err)
+	}
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to reach the database: %w", err)
+	}
+
+	return &sqliteService{db: db, auditHashKey: auditHashKey}, nil
+}
+
+func (s *sqliteService) Close() {
+	s.db.Close()
+}
+
+// PoolStats reports the database/sql connection pool. Connections that had to
+// wait are counted as empty acquires.
+func (s *sqliteService) PoolStats() domain.PoolStats {
+	stats := s.db.Stats()
+	return domain.PoolStats{
+		MaxConnections:      int32(stats.MaxOpenConnections),
+		TotalConnections:    int32(stats.OpenConnections),
+		AcquiredConnections: int32(stats.InUse),
+		IdleConnections:     int32(stats.Idle),
+		EmptyAcquireCount:   stats.WaitCount,
+		AcquireDuration:     stats.WaitDuration.String(),
+	}
+}
+
+func (s *sqliteService) Health(ctx context.Context) domain.DatabaseHealth {
+	health := domain.DatabaseHealth{
+		Status: "up",
+		Pool:   s.PoolStats(),
+	}
+
+	err := s.db.PingContext(ctx)
+	if err != nil {
+		log.Println("Database health check failed:", err)
+		health.Status = "down"
+		health.Error = err.Error()
+		return health
+	}
+
+	statement := "SELECT COALESCE(MAX(version_id), 0) FROM goose_db_version"
+	err = s.db.QueryRowContext(ctx, statement).Scan(&health.MigrationVersion)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return health
+		}
+		log.Println("Database health check failed:", err)
+		health.Status = "down"
+		health.Error = err.Error()
+	}
+
+	return health
+}
+
+// withSQLiteTx runs fn in a transaction and commits it when fn returns nil, as
+// WithTx does. A read only transaction does not take the write lock. SQLite
+// waits for the lock rather than failing with a serialization error, so the
+// transaction is never retried.
+func withSQLiteTx(ctx context.Context, db *sql.DB, readOnly bool, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return &domain.DatabaseTransactionError{Message: err.Error(), Err: err}
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, ErrRollback) {
+			return nil
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+		errorMessage := fmt.Sprintf("Failed to commit the SQL statement. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return &domain.DatabaseTransactionError{Message: err.Error(), Err: err}
+	}
+
+	return nil
+}
+
+func sqliteStatementError(err error) error {
+	errorMessage := fmt.Sprintf("Failed to execute the SQL statement. [Reason]: %v", err)
+	log.Println(errorMessage)
+	return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+}
+
+// sqliteUserError maps a failed insert or update of a user, reporting an email
+// that is already taken as a unique constraint violation and a value longer
+// than its column's check constraint allows as an invalid user.
+func sqliteUserError(err error) error {
+	switch sqliteErrorCode(err) {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		log.Println("Unique constraint violation:", err)
+		return &domain.UniqueConstraintDatabaseError{Message: err.Error(), Err: err}
+	case sqlite3.SQLITE_CONSTRAINT_CHECK:
+		log.Println("Database error:", err)
+		return &domain.InvalidUserError{Message: err.Error(), Err: err}
+	default:
+		return sqliteStatementError(err)
+	}
+}
+
+// scanSQLiteUser scans the user columns id, username, email, created_at,
+// updated_at and version followed by dest.
+func scanSQLiteUser(scan func(dest ...any) error, user *domain.User, dest ...any) error {
+	var createdAt, updatedAt string
+	err := scan(append([]any{&user.ID, &user.Username, &user.Email, &createdAt, &updatedAt, &user.Version}, dest...)...)
+	if err != nil {
+		return err
+	}
+
+	user.CreatedAt, err = parseSQLiteTime(createdAt)
+	if err != nil {
+		return err
+	}
+	user.UpdatedAt, err = parseSQLiteTime(updatedAt)
+	return err
+}
+
+// parseSQLiteDeletedAt sets the user's deletion time from a nullable column.
+func parseSQLiteDeletedAt(user *domain.User, deletedAt sql.NullString) error {
+	if !deletedAt.Valid {
+		user.DeletedAt = nil
+		return nil
+	}
+	var err error
+	user.DeletedAt, err = parseSQLiteTime(deletedAt.String)
+	return err
+}
+
+const sqliteUserColumns = "u.id, u.username, u.email, u.created_at, u.updated_at, u.version"
+
+func (s *sqliteService) InsertNewUser(ctx context.Context, user domain.User) (int, error) {
+	statement := "INSERT INTO users (username, email, created_at, updated_at) VALUES (?1, ?2, ?3, ?3) RETURNING id, username, email, created_at, updated_at, version"
+
+	var created domain.User
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, statement, user.Username, user.Email, sqliteTime(microsecondNow()))
+		err := scanSQLiteUser(row.Scan, &created)
+		if err != nil {
+			return sqliteUserError(err)
+		}
+
+		return recordSQLiteAudit(ctx, tx, s.auditHashKey, auditChange{userId: created.ID, action: domain.AuditActionInsert, after: &created})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return created.ID, nil
+}
+
+// InsertUsers inserts each user in turn in one transaction and reports the
+// outcome of each, as the Postgres service does.
+func (s *sqliteService) InsertUsers(ctx context.Context, users []domain.User, options domain.BatchInsertOptions) ([]domain.BatchUserResult, error) {
+	statement :=
+		`
+	INSERT INTO users (username, email, created_at, updated_at) VALUES (?1, ?2, ?3, ?3)
+	ON CONFLICT (email) DO NOTHING
+	RETURNING id, username, email, created_at, updated_at, version
+	`
+
+	var results []domain.BatchUserResult
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		results = make([]domain.BatchUserResult, len(users))
+		seen := map[string]bool{}
+		createdAt := sqliteTime(microsecondNow())
+		failed := false
+		var changes []auditChange
+		for i, user := range users {
+			results[i].Index = i
+			if seen[user.Email] {
+				results[i].Status = domain.BatchUserFailed
+				results[i].Error = "email is already used earlier in this batch"
+				failed = true
+				continue
+			}
+			seen[user.Email] = true
+
+			var created domain.User
+			row := tx.QueryRowContext(ctx, statement, user.Username, user.Email, createdAt)
+			err := scanSQLiteUser(row.Scan, &created)
+			if errors.Is(err, sql.ErrNoRows) {
+				results[i].Status = domain.BatchUserFailed
+				results[i].Error = "email is already used"
+				failed = true
+				continue
+			}
+			if err != nil {
+				return sqliteUserError(err)
+			}
+			results[i].Status = domain.BatchUserCreated
+			results[i].ID = created.ID
+			changes = append(changes, auditChange{userId: created.ID, action: domain.AuditActionInsert, after: &created})
+		}
+
+		if options.DryRun || (options.Atomic && failed) {
+			status := domain.BatchUserRolledBack
+			if options.DryRun {
+				status = domain.BatchUserValid
+			}
+			for i := range results {
+				if results[i].Status == domain.BatchUserCreated {
+					results[i].Status = status
+					results[i].ID = 0
+				}
+			}
+			return ErrRollback
+		}
+
+		if len(changes) > 0 {
+			return recordSQLiteAudit(ctx, tx, s.auditHashKey, changes...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return results, nil
+}
+
+func (s *sqliteService) ExportUsers(ctx context.Context, includeDeleted bool, yield func(domain.User) error) error {
+	statement :=
+		`
+	SELECT ` + sqliteUserColumns + `, ud.deletion_date
+	FROM users u
+	LEFT JOIN user_deletes ud on u.id = ud.user_id
+	WHERE ?1 OR ud.user_id IS NULL
+	ORDER BY u.id
+	`
+
+	err := withSQLiteTx(ctx, s.db, true, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, statement, includeDeleted)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var user domain.User
+			var deletedAt sql.NullString
+			err := scanSQLiteUser(rows.Scan, &user, &deletedAt)
+			if err == nil {
+				err = parseSQLiteDeletedAt(&user, deletedAt)
+			}
+			if err != nil {
+				return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+			}
+			user.Version = 0
+			err = yield(user)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			return sqliteStatementError(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return nil
+}
+
+// sqliteLockedUser reads the user with userId within tx, and whether it has
+// been deleted. Every transaction that can write already holds the write lock,
+// so the user cannot change until tx ends.
+func sqliteLockedUser(ctx context.Context, tx *sql.Tx, userId int) (domain.User, *time.Time, error) {
+	statement :=
+		`
+	SELECT ` + sqliteUserColumns + `, ud.deletion_date
+	FROM users u
+	LEFT JOIN user_deletes ud on u.id = ud.user_id
+	WHERE u.id = ?1
+	`
+
+	var user domain.User
+	var deletedAt sql.NullString
+	err := scanSQLiteUser(tx.QueryRowContext(ctx, statement, userId).Scan, &user, &deletedAt)
+	if err == nil {
+		err = parseSQLiteDeletedAt(&user, deletedAt)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			message := fmt.Sprintf("User with id %d does not exist", userId)
+			log.Println(message)
+			return domain.User{}, nil, &domain.UserNotFoundError{Message: message, Err: err}
+		}
+		return domain.User{}, nil, sqliteStatementError(err)
+	}
+
+	deletionDate := user.DeletedAt
+	user.DeletedAt = nil
+	return user, deletionDate, nil
+}
+
+func (s *sqliteService) GetUserByID(ctx context.Context, userId int) (domain.User, error) {
+	var user domain.User
+	var deletedAt *time.Time
+	err := withSQLiteTx(ctx, s.db, true, func(tx *sql.Tx) error {
+		var err error
+		user, deletedAt, err = sqliteLockedUser(ctx, tx, userId)
+		return err
+	})
+	if err != nil {
+		return domain.User{}, err
+	}
+
+	if deletedAt != nil {
+		message := fmt.Sprintf("User with id %d has been deleted", userId)
+		return domain.User{}, &domain.UserDeletedError{Message: message}
+	}
+
+	return user, nil
+}
+
+// sqliteDialect writes user listings for SQLite, which stores timestamps as
+// text and does not fail on a cast it cannot make, so cursor keys are checked
+// before the query is run.
+type sqliteDialect struct{}
+
+func (sqliteDialect) placeholder(n int) string {
+	return fmt.Sprintf("?%d", n)
+}
+
+func (sqliteDialect) cursorKey(column userColumn, key string) (any, string, error) {
+	switch column.sqlType {
+	case "integer":
+		value, err := strconv.Atoi(key)
+		return value, "", err
+	case "timestamptz":
+		value, err := parseSQLiteTime(key)
+		if err != nil {
+			return nil, "", err
+		}
+		return sqliteTime(*value), "", nil
+	default:
+		return key, "", nil
+	}
+}
+
+func (sqliteDialect) text(expression string) string {
+	return "CAST(" + expression + " AS TEXT)"
+}
+
+// ordered leaves text to SQLite's default BINARY collation, which is byte
+// order.
+func (sqliteDialect) ordered(column userColumn) string {
+	return column.expression
+}
+
+// usernamePrefix compares the start of the username, since LIKE is case
+// insensitive in SQLite.
+func (sqliteDialect) usernamePrefix(q *usersPageQuery, prefix string) string {
+	arg := q.arg(prefix)
+	return fmt.Sprintf("substr(u.username, 1, length(%s)) = %s", arg, arg)
+}
+
+func (sqliteDialect) emailDomain(q *usersPageQuery, domain string) string {
+	return fmt.Sprintf("instr(u.email, '@') > 0 AND lower(substr(u.email, instr(u.email, '@') + 1)) = lower(%s)", q.arg(domain))
+}
+
+func (sqliteDialect) timestamp(t time.Time) any {
+	return sqliteTime(t)
+}
+
+func (s *sqliteService) GetUsersPage(ctx context.Context, query domain.UsersQuery) ([]domain.User, *domain.UsersCursor, error) {
+	statement, args, err := buildUsersPageQuery(sqliteDialect{}, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var users []domain.User
+	var cursors []domain.UsersCursor
+	err = withSQLiteTx(ctx, s.db, true, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, statement, args...)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		defer rows.Close()
+
+		columns, err := rows.Columns()
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		// Every column after the user's own is an ordering key.
+		keyCount := len(columns) - userColumnCount
+
+		users = []domain.User{}
+		cursors = nil
+		for rows.Next() {
+			var user domain.User
+			var createdAt, updatedAt string
+			var deletedAt sql.NullString
+			cursor := domain.UsersCursor{Keys: make([]string, keyCount)}
+			destinations := []any{&user.ID, &user.Username, &user.Email, &createdAt, &updatedAt, &deletedAt, &user.Version}
+			for i := range cursor.Keys {
+				destinations = append(destinations, &cursor.Keys[i])
+			}
+			err := rows.Scan(destinations...)
+			if err == nil {
+				user.CreatedAt, err = parseSQLiteTime(createdAt)
+			}
+			if err == nil {
+				user.UpdatedAt, err = parseSQLiteTime(updatedAt)
+			}
+			if err == nil {
+				err = parseSQLiteDeletedAt(&user, deletedAt)
+			}
+			if err != nil {
+				return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+			}
+			users = append(users, user)
+			cursors = append(cursors, cursor)
+		}
+
+		if err := rows.Err(); err != nil {
+			return sqliteStatementError(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	if len(users) <= query.Limit {
+		return users, nil, nil
+	}
+
+	return users[:query.Limit], &cursors[query.Limit-1], nil
+}
+
+func (s *sqliteService) UpdateUser(ctx context.Context, userId int, user domain.User, expectedVersion *int) (domain.User, error) {
+	return s.updateUser(ctx, userId, &user.Username, &user.Email, expectedVersion)
+}
+
+func (s *sqliteService) PatchUser(ctx context.Context, userId int, patch domain.UserPatch, expectedVersion *int) (domain.User, error) {
+	return s.updateUser(ctx, userId, patch.Username, patch.Email, expectedVersion)
+}
+
+// updateUser sets the non-nil fields on an active user, along with the update
+// time and version the Postgres triggers would set, and returns the result.
+func (s *sqliteService) updateUser(ctx context.Context, userId int, username, email *string, expectedVersion *int) (domain.User, error) {
+	statement :=
+		`
+	UPDATE users
+	SET username = COALESCE(?2, username), email = COALESCE(?3, email), updated_at = ?4, version = version + 1
+	WHERE id = ?1
+	RETURNING id, username, email, created_at, updated_at, version
+	`
+
+	var user domain.User
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		before, deletedAt, err := sqliteLockedUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		if deletedAt != nil {
+			message := fmt.Sprintf("User with id %d has been deleted", userId)
+			return &domain.UserDeletedError{Message: message}
+		}
+		if expectedVersion != nil && *expectedVersion != before.Version {
+			return stalePreconditionError(userId, before.Version, *expectedVersion)
+		}
+
+		user = domain.User{}
+		row := tx.QueryRowContext(ctx, statement, userId, username, email, sqliteTime(microsecondNow()))
+		err = scanSQLiteUser(row.Scan, &user)
+		if err != nil {
+			return sqliteUserError(err)
+		}
+
+		return recordSQLiteAudit(ctx, tx, s.auditHashKey, auditChange{userId: userId, action: domain.AuditActionUpdate, before: &before, after: &user})
+	})
+	if err != nil {
+		return domain.User{}, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return user, nil
+}
+
+// touchSQLiteUser moves a user on to a new version for a change made outside
+// the users table, such as a delete, setting the update time and version the
+// Postgres triggers would set, and returns the user.
+func touchSQLiteUser(ctx context.Context, tx *sql.Tx, userId int) (domain.User, error) {
+	statement := "UPDATE users SET updated_at = ?2, version = version + 1 WHERE id = ?1 RETURNING id, username, email, created_at, updated_at, version"
+
+	var user domain.User
+	err := scanSQLiteUser(tx.QueryRowContext(ctx, statement, userId, sqliteTime(microsecondNow())).Scan, &user)
+	if err != nil {
+		return domain.User{}, sqliteStatementError(err)
+	}
+	return user, nil
+}
+
+func (s *sqliteService) SoftDeleteUser(ctx context.Context, userId int, expectedVersion *int) error {
+	statement := "INSERT INTO user_deletes(user_id, deletion_date) VALUES(?1, ?2) RETURNING deletion_date"
+
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		if expectedVersion != nil {
+			var version int
+			err := tx.QueryRowContext(ctx, "SELECT version FROM users WHERE id = ?1", userId).Scan(&version)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					message := fmt.Sprintf("User with id %d does not exist", userId)
+					log.Println(message)
+					return &domain.UserNotFoundError{Message: message, Err: err}
+				}
+				return sqliteStatementError(err)
+			}
+			if version != *expectedVersion {
+				return stalePreconditionError(userId, version, *expectedVersion)
+			}
+		}
+
+		var deletionDate string
+		err := tx.QueryRowContext(ctx, statement, userId, sqliteTime(microsecondNow())).Scan(&deletionDate)
+		if err != nil {
+			switch sqliteErrorCode(err) {
+			// user_deletes.user_id is unique, so a second delete violates it.
+			case sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+				message := fmt.Sprintf("User with id %d has already been deleted", userId)
+				log.Println(message)
+				return &domain.UserDeletedError{Message: message, Err: err}
+			case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+				message := fmt.Sprintf("User with id %d does not exist", userId)
+				log.Println(message)
+				return &domain.UserNotFoundError{Message: message, Err: err}
+			default:
+				return sqliteStatementError(err)
+			}
+		}
+
+		before, _, err := sqliteLockedUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		after, err := touchSQLiteUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		after.DeletedAt, err = parseSQLiteTime(deletionDate)
+		if err != nil {
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+
+		return recordSQLiteAudit(ctx, tx, s.auditHashKey, auditChange{userId: userId, action: domain.AuditActionDelete, before: &before, after: &after})
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return nil
+}
+
+func (s *sqliteService) RestoreUser(ctx context.Context, userId int, expectedVersion *int) (domain.User, error) {
+	statement := "DELETE FROM user_deletes WHERE user_id = ?1"
+
+	var user domain.User
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		var deletedAt *time.Time
+		var err error
+		user, deletedAt, err = sqliteLockedUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != nil && *expectedVersion != user.Version {
+			return stalePreconditionError(userId, user.Version, *expectedVersion)
+		}
+		if deletedAt == nil {
+			message := fmt.Sprintf("User with id %d has not been deleted", userId)
+			return &domain.UserNotDeletedError{Message: message}
+		}
+
+		_, err = tx.ExecContext(ctx, statement, userId)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+
+		before := user
+		before.DeletedAt = deletedAt
+		user, err = touchSQLiteUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		return recordSQLiteAudit(ctx, tx, s.auditHashKey, auditChange{userId: userId, action: domain.AuditActionRestore, before: &before, after: &user})
+	})
+	if err != nil {
+		return domain.User{}, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return user, nil
+}
+
+// recordSQLiteAudit appends changes to the audit log within tx, hashed and
+// chained as recordAudit does. The transaction already holds the write lock,
+// so the chain cannot move on before it ends.
+func recordSQLiteAudit(ctx context.Context, tx *sql.Tx, key []byte, changes ...auditChange) error {
+	var previousHash string
+	err := tx.QueryRowContext(ctx, "SELECT hash FROM user_audit_log WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1").Scan(&previousHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		errorMessage := fmt.Sprintf("Failed to read the audit log hash chain. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+
+	entries, err := newAuditEntries(ctx, key, previousHash, changes)
+	if err != nil {
+		return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+	}
+
+	statement :=
+		`
+	INSERT INTO user_audit_log (user_id, action, actor, before, after, request_id, client_ip, created_at, previous_hash, hash)
+	VALUES (?1, ?2, ?3, ?4, ?5, NULLIF(?6, ''), NULLIF(?7, ''), ?8, NULLIF(?9, ''), ?10)
+	`
+
+	for i, entry := range entries {
+		_, err = tx.ExecContext(ctx, statement, entry.UserID, entry.Action, entry.Actor, auditState(changes[i].before), auditState(changes[i].after),
+			entry.RequestID, entry.ClientIP, sqliteTime(entry.CreatedAt), entry.PreviousHash, entry.Hash)
+		if err != nil {
+			errorMessage := fmt.Sprintf("Failed to record the audit log. [Reason]: %v", err)
+			log.Println(errorMessage)
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+	}
+
+	return nil
+}
+
+const sqliteAuditColumns = "id, user_id, action, actor, before, after, COALESCE(request_id, ''), COALESCE(client_ip, ''), created_at, COALESCE(previous_hash, ''), COALESCE(hash, '')"
+
+func scanSQLiteAuditEntries(rows *sql.Rows) ([]domain.AuditEntry, error) {
+	entries := []domain.AuditEntry{}
+	for rows.Next() {
+		var entry domain.AuditEntry
+		var before, after sql.NullString
+		var createdAt string
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &entry.Actor, &before, &after, &entry.RequestID, &entry.ClientIP, &createdAt, &entry.PreviousHash, &entry.Hash)
+		if err != nil {
+			return nil, &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		t, err := parseSQLiteTime(createdAt)
+		if err != nil {
+			return nil, &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		entry.CreatedAt = *t
+		if before.Valid {
+			entry.Before = auditJSON([]byte(before.String))
+		} else {
+			entry.Before = auditJSON(nil)
+		}
+		if after.Valid {
+			entry.After = auditJSON([]byte(after.String))
+		} else {
+			entry.After = auditJSON(nil)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteStatementError(err)
+	}
+
+	return entries, nil
+}
+
+func (s *sqliteService) GetUserHistory(ctx context.Context, userId int) ([]domain.AuditEntry, error) {
+	statement := "SELECT " + sqliteAuditColumns + " FROM user_audit_log WHERE user_id = ?1 ORDER BY id"
+
+	var entries []domain.AuditEntry
+	err := withSQLiteTx(ctx, s.db, true, func(tx *sql.Tx) error {
+		_, _, err := sqliteLockedUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, statement, userId)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		defer rows.Close()
+
+		entries, err = scanSQLiteAuditEntries(rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return entries, nil
+}
+
+func (s *sqliteService) GetAuditLog(ctx context.Context, query domain.AuditQuery) ([]domain.AuditEntry, *int64, error) {
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("?%d", len(args))
+	}
+
+	if query.UserID != 0 {
+		conditions = append(conditions, "user_id = "+arg(query.UserID))
+	}
+	if query.Actor != "" {
+		conditions = append(conditions, "actor = "+arg(query.Actor))
+	}
+	if query.Action != "" {
+		conditions = append(conditions, "action = "+arg(query.Action))
+	}
+	if query.RequestID != "" {
+		conditions = append(conditions, "request_id = "+arg(query.RequestID))
+	}
+	if query.CreatedAfter != nil {
+		conditions = append(conditions, "created_at > "+arg(sqliteTime(*query.CreatedAfter)))
+	}
+	if query.CreatedBefore != nil {
+		conditions = append(conditions, "created_at < "+arg(sqliteTime(*query.CreatedBefore)))
+	}
+	if query.AfterID != 0 {
+		conditions = append(conditions, "id > "+arg(query.AfterID))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	statement := fmt.Sprintf("SELECT %s FROM user_audit_log %s ORDER BY id LIMIT %s", sqliteAuditColumns, where, arg(query.Limit+1))
+
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, nil, sqliteStatementError(err)
+	}
+	defer rows.Close()
+
+	entries, err := scanSQLiteAuditEntries(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	if len(entries) <= query.Limit {
+		return entries, nil, nil
+	}
+
+	entries = entries[:query.Limit]
+	return entries, &entries[query.Limit-1].ID, nil
+}
+
+func (s *sqliteService) VerifyAuditLog(ctx context.Context) (domain.AuditVerification, error) {
+	statement := "SELECT " + sqliteAuditColumns + " FROM user_audit_log ORDER BY id"
+
+	var verification domain.AuditVerification
+	err := withSQLiteTx(ctx, s.db, true, func(tx *sql.Tx) error {
+		var unhashedBefore int64
+		err := tx.QueryRowContext(ctx, unhashedBeforeStatement).Scan(&unhashedBefore)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+
+		rows, err := tx.QueryContext(ctx, statement)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		defer rows.Close()
+
+		entries, err := scanSQLiteAuditEntries(rows)
+		if err != nil {
+			return err
+		}
+
+		chain := newAuditChain(s.auditHashKey, unhashedBefore)
+		for _, entry := range entries {
+			if !chain.add(entry) {
+				break
+			}
+		}
+		verification = chain.verification
+		return nil
+	})
+	if err != nil {
+		return domain.AuditVerification{}, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return verification, nil
+}
+
+func (s *sqliteService) ReserveIdempotencyKey(ctx context.Context, key string, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error) {
+	statement :=
+		`
+	INSERT INTO idempotency_keys (idempotency_key, request_hash, lease_token, created_at, expires_at)
+	VALUES (?1, ?2, ?3, ?4, ?5)
+	ON CONFLICT (idempotency_key) DO NOTHING
+	`
+
+	leaseToken := newLeaseToken()
+	var record domain.IdempotencyRecord
+	var reserved bool
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		now := microsecondNow()
+
+		_, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= ?1", sqliteTime(now))
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+
+		result, err := tx.ExecContext(ctx, statement, key, requestHash, leaseToken, sqliteTime(now), sqliteTime(now.Add(lease)))
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+
+		reserved = affected == 1
+		record = domain.IdempotencyRecord{Key: key, RequestHash: requestHash}
+		if reserved {
+			record.LeaseToken = leaseToken
+			return nil
+		}
+
+		selectStatement :=
+			`
+		SELECT request_hash, COALESCE(status_code, 0), response_body, user_id, expires_at
+		FROM idempotency_keys
+		WHERE idempotency_key = ?1
+		`
+
+		var userId sql.NullInt64
+		var expiresAt string
+		err = tx.QueryRowContext(ctx, selectStatement, key).Scan(&record.RequestHash, &record.StatusCode, &record.Body, &userId, &expiresAt)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		if userId.Valid {
+			id := int(userId.Int64)
+			record.UserID = &id
+		}
+		t, err := parseSQLiteTime(expiresAt)
+		if err != nil {
+			return &domain.UnmappedDatabaseError{Message: err.Error(), Err: err}
+		}
+		record.ExpiresAt = *t
+		return nil
+	})
+	if err != nil {
+		return domain.IdempotencyRecord{}, false, err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return record, reserved, nil
+}
+
+func (s *sqliteService) CompleteIdempotencyKey(ctx context.Context, key string, leaseToken string, statusCode int, body []byte, userId *int, ttl time.Duration) error {
+	statement :=
+		`
+	UPDATE idempotency_keys
+	SET status_code = ?3, response_body = ?4, user_id = ?5, expires_at = ?6
+	WHERE idempotency_key = ?1 AND lease_token = ?2 AND status_code IS NULL
+	`
+
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, statement, key, leaseToken, statusCode, body, userId, sqliteTime(microsecondNow().Add(ttl)))
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		return sqliteIdempotencyKeyHeld(result, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return nil
+}
+
+func (s *sqliteService) ReleaseIdempotencyKey(ctx context.Context, key string, leaseToken string) error {
+	statement := "DELETE FROM idempotency_keys WHERE idempotency_key = ?1 AND lease_token = ?2 AND status_code IS NULL"
+
+	err := withSQLiteTx(ctx, s.db, false, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, statement, key, leaseToken)
+		if err != nil {
+			return sqliteStatementError(err)
+		}
+		return sqliteIdempotencyKeyHeld(result, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("SQL query:", statement)
+
+	return nil
+}
+
+// sqliteIdempotencyKeyHeld fails with an IdempotencyLeaseLostError when a
+// statement on a reserved key found no row to change.
+func sqliteIdempotencyKeyHeld(result sql.Result, key string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return sqliteStatementError(err)
+	}
+	if affected == 0 {
+		return idempotencyLeaseLost(key)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"db_access/internal/domain"
+)
+
+const (
+	// DefaultTxMaxAttempts is how many times WithTx runs a transaction that
+	// keeps failing with a serialization failure or deadlock.
+	DefaultTxMaxAttempts = 3
+	// DefaultTxBackoff is how long WithTx waits before its first retry.
+	DefaultTxBackoff = 20 * time.Millisecond
+)
+
+// ErrRollback can be returned by the function passed to WithTx to roll the
+// transaction back without failing, as a dry run does.
+var ErrRollback = errors.New("roll back the transaction")
+
+// TxBeginner starts transactions, as a *pgxpool.Pool does.
+type TxBeginner interface {
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+// TxOptions configures a transaction run by WithTx. The embedded pgx options
+// set its isolation level and access mode.
+type TxOptions struct {
+	pgx.TxOptions
+	// MaxAttempts bounds how many times the transaction is run, zero meaning
+	// DefaultTxMaxAttempts. A transaction whose function has side effects
+	// outside the database, such as streaming rows to a client, should set
+	// it to 1.
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry, zero meaning
+	// DefaultTxBackoff. It doubles, with jitter, before each retry after.
+	Backoff time.Duration
+}
+
+// WithTx runs fn in a transaction begun on db and commits it when fn returns
+// nil. The transaction is rolled back when fn returns an error, which WithTx
+// returns as is, or panics, in which case the panic carries on once the
+// transaction has been rolled back.
+//
+// A transaction that fails with a serialization failure (40001) or deadlock
+// (40P01), whether in fn or on commit, is run again from the start after a
+// backoff, so fn must not keep state between attempts. Once the attempts run
+// out the error is returned wrapped in a DatabaseTransactionError.
+func WithTx(ctx context.Context, db TxBeginner, options TxOptions, fn func(tx pgx.Tx) error) error {
+	maxAttempts := options.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultTxMaxAttempts
+	}
+	backoff := options.Backoff
+	if backoff <= 0 {
+		backoff = DefaultTxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, db, options.TxOptions, fn)
+		if err == nil || !retryableTxError(err) {
+			return err
+		}
+		if attempt == maxAttempts {
+			return &domain.DatabaseTransactionError{Message: err.Error(), Err: err}
+		}
+
+		log.Printf("Retrying the transaction after attempt %d failed. [Reason]: %v", attempt, err)
+		// Full jitter keeps transactions that conflicted with each other from
+		// retrying in lockstep.
+		delay := rand.N(backoff<<(attempt-1)) + 1
+		select {
+		case <-ctx.Done():
+			return &domain.DatabaseTransactionError{Message: ctx.Err().Error(), Err: ctx.Err()}
+		case <-time.After(delay):
+		}
+	}
+}
+
+func runTx(ctx context.Context, db TxBeginner, txOptions pgx.TxOptions, fn func(tx pgx.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return &domain.DatabaseTransactionError{Message: err.Error(), Err: err}
+	}
+
+	// The rollback must still reach the database when ctx has been cancelled.
+	rollbackCtx := context.WithoutCancel(ctx)
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(rollbackCtx)
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback(rollbackCtx)
+		if errors.Is(err, ErrRollback) {
+			return nil
+		}
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(rollbackCtx)
+		errorMessage := fmt.Sprintf("Failed to commit the SQL statement. [Reason]: %v", err)
+		log.Println(errorMessage)
+		return &domain.DatabaseTransactionError{Message: err.Error(), Err: err}
+	}
+
+	return nil
+}
+
+// retryableTxError reports whether err is a serialization failure or deadlock,
+// after which the transaction can be run again.
+func retryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
@@ -0,0 +1,89 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditActionInsert  = "insert"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+)
+
+// AuditEntry is one change to a user. Before is null for an insert, otherwise
+// Before and After hold the user as it was either side of the change. Hash
+// covers the entry's content and PreviousHash, chaining every entry to the one
+// before it.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	UserID    int             `json:"user_id"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	RequestID string          `json:"request_id,omitempty"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	// PreviousHash is empty for the first entry in the chain, and both hashes
+	// are empty for entries recorded before the chain was introduced.
+	PreviousHash string `json:"previous_hash,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// AuditPage is one page of the audit log. NextCursor is nil on the last page.
+type AuditPage struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextCursor *string      `json:"next_cursor"`
+}
+
+// AuditQuery filters and paginates the audit log, oldest entry first. Zero
+// valued filters are not applied.
+type AuditQuery struct {
+	UserID        int
+	Actor         string
+	Action        string
+	RequestID     string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// AfterID is the id of the last entry on the previous page.
+	AfterID int64
+	Limit   int
+}
+
+// AuditVerification is the outcome of walking the audit log's hash chain.
+// BrokenAt is the id of the first entry that does not verify, with Reason
+// saying why. LastHash is the hash of the last entry checked, which can be
+// kept elsewhere to detect entries later removed from the end of the log.
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Checked  int64  `json:"checked"`
+	Unhashed int64  `json:"unhashed"`
+	BrokenAt *int64 `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	LastHash string `json:"last_hash,omitempty"`
+}
+
+// AuditContext identifies who made a change and the request it was made in.
+type AuditContext struct {
+	Actor     string
+	RequestID string
+	ClientIP  string
+}
+
+type auditContextKey struct{}
+
+// WithAuditContext returns a copy of ctx carrying audit, which the database
+// records against every change made with it.
+func WithAuditContext(ctx context.Context, audit AuditContext) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, audit)
+}
+
+// AuditContextFrom returns the AuditContext carried by ctx, or the zero value.
+func AuditContextFrom(ctx context.Context) AuditContext {
+	audit, _ := ctx.Value(auditContextKey{}).(AuditContext)
+	return audit
+}
@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// UserRow is one user read from an import file, with the line it starts on.
+// Err is set when the row could not be read.
+type UserRow struct {
+	Line int
+	User User
+	Err  error
+}
+
+// ErrTooManyRows is returned when an import file holds more rows than allowed.
+var ErrTooManyRows = errors.New("too many rows")
+
+// ReadUsersCSV reads users from CSV with a header naming its username and
+// email columns, in any order. A row that cannot be read is returned with Err
+// set rather than failing the file. Reading more than maxRows rows fails with
+// ErrTooManyRows, 0 allows any number. The users are not validated.
+func ReadUsersCSV(r io.Reader, maxRows int) ([]UserRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the CSV header: %v", err)
+	}
+	usernameColumn, emailColumn := -1, -1
+	for i, name := range header {
+		switch strings.TrimSpace(name) {
+		case "username":
+			usernameColumn = i
+		case "email":
+			emailColumn = i
+		}
+	}
+	if usernameColumn == -1 || emailColumn == -1 {
+		return nil, errors.New("the CSV header must have a username and an email column")
+	}
+
+	var rows []UserRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if maxRows > 0 && len(rows) == maxRows {
+			return nil, ErrTooManyRows
+		}
+
+		var row UserRow
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			row.Line = parseErr.StartLine
+			row.Err = parseErr.Err
+		} else if err != nil {
+			return nil, err
+		} else if len(record) <= max(usernameColumn, emailColumn) {
+			row.Line, _ = reader.FieldPos(0)
+			row.Err = errors.New("row is missing the username or email column")
+		} else {
+			row.Line, _ = reader.FieldPos(0)
+			row.User = User{Username: record[usernameColumn], Email: record[emailColumn]}
+		}
+		rows = append(rows, row)
+	}
+}
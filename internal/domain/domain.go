@@ -1,7 +1,116 @@
 package domain
 
+import "time"
+
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username" binding:"required"`
-	Email    string `json:"email" binding:"required,email"`
+	ID        int        `json:"id"`
+	Username  string     `json:"username" binding:"required,max=50"`
+	Email     string     `json:"email" binding:"required,email,max=100"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version starts at 1 and is incremented by every change to the user, it
+	// is served as the user's ETag.
+	Version int `json:"version,omitempty"`
+}
+
+// UserPatch holds the members of a JSON Merge Patch (RFC 7396) document for a
+// User. A nil field is left unchanged.
+type UserPatch struct {
+	Username *string `json:"username" binding:"omitnil,min=1,max=50"`
+	Email    *string `json:"email" binding:"omitnil,email,max=100"`
+}
+
+// Outcomes of a user in a batch insert.
+const (
+	BatchUserCreated    = "created"
+	BatchUserFailed     = "failed"
+	BatchUserRolledBack = "rolled_back"
+	BatchUserValid      = "valid"
+)
+
+// BatchInsertOptions controls how a batch of users is inserted.
+type BatchInsertOptions struct {
+	// Atomic inserts either every user or none of them.
+	Atomic bool
+	// DryRun reports what would happen without inserting anything, users that
+	// could be inserted are reported as valid.
+	DryRun bool
+}
+
+// BatchUserResult is the outcome of the user at Index in a batch insert. ID is
+// only set once the user has been created.
+type BatchUserResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	ID     int    `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// Idempotency-Key. StatusCode is 0 while the first request is in progress, and
+// until then ExpiresAt is the end of that request's lease on the key.
+// LeaseToken is only returned to the request that reserved the key, which
+// passes it back to complete or release the key.
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	LeaseToken  string
+	StatusCode  int
+	Body        []byte
+	UserID      *int
+	ExpiresAt   time.Time
+}
+
+// UsersPage is one page of a keyset paginated user listing. NextCursor is nil
+// on the last page.
+type UsersPage struct {
+	Users      []User  `json:"users"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// UsersQuery filters, sorts and paginates a user listing. Zero valued filters
+// are not applied.
+type UsersQuery struct {
+	UsernamePrefix string
+	EmailDomain    string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	Sort           []SortField
+	IncludeDeleted bool
+	After          *UsersCursor
+	Limit          int
+}
+
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// UsersCursor is the keyset position of the last user on a page, holding the
+// value of every ordering column as text.
+type UsersCursor struct {
+	Keys []string `json:"keys"`
+}
+
+// DatabaseHealth reports whether the database is reachable along with its
+// connection pool statistics and the latest applied migration.
+type DatabaseHealth struct {
+	Status           string    `json:"status"`
+	Error            string    `json:"error,omitempty"`
+	Pool             PoolStats `json:"pool"`
+	MigrationVersion int64     `json:"migration_version"`
+}
+
+// PoolStats is a snapshot of the database connection pool.
+type PoolStats struct {
+	MaxConnections          int32  `json:"max_connections"`
+	TotalConnections        int32  `json:"total_connections"`
+	AcquiredConnections     int32  `json:"acquired_connections"`
+	IdleConnections         int32  `json:"idle_connections"`
+	ConstructingConnections int32  `json:"constructing_connections"`
+	AcquireCount            int64  `json:"acquire_count"`
+	EmptyAcquireCount       int64  `json:"empty_acquire_count"`
+	CanceledAcquireCount    int64  `json:"canceled_acquire_count"`
+	AcquireDuration         string `json:"acquire_duration"`
 }
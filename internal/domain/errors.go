@@ -1,33 +1,145 @@
 package domain
 
+// Each error keeps the error that caused it, if any, in Err so that errors.Is
+// and errors.As see through to it, e.g. to a context.DeadlineExceeded from a
+// query that timed out.
+
 type UniqueConstraintDatabaseError struct {
 	Message string
+	Err     error
 }
 
 func (ucDE *UniqueConstraintDatabaseError) Error() string {
 	return ucDE.Message
 }
 
+func (ucDE *UniqueConstraintDatabaseError) Unwrap() error {
+	return ucDE.Err
+}
+
 type UnmappedDatabaseError struct {
 	Message string
+	Err     error
 }
 
 func (ucDE *UnmappedDatabaseError) Error() string {
 	return ucDE.Message
 }
 
+func (ucDE *UnmappedDatabaseError) Unwrap() error {
+	return ucDE.Err
+}
+
 type DatabaseTransactionError struct {
 	Message string
+	Err     error
 }
 
 func (ucDE *DatabaseTransactionError) Error() string {
 	return ucDE.Message
 }
 
+func (ucDE *DatabaseTransactionError) Unwrap() error {
+	return ucDE.Err
+}
+
 type UserNotFoundError struct {
 	Message string
+	Err     error
 }
 
 func (ucDE *UserNotFoundError) Error() string {
 	return ucDE.Message
 }
+
+func (ucDE *UserNotFoundError) Unwrap() error {
+	return ucDE.Err
+}
+
+type UserDeletedError struct {
+	Message string
+	Err     error
+}
+
+func (ucDE *UserDeletedError) Error() string {
+	return ucDE.Message
+}
+
+func (ucDE *UserDeletedError) Unwrap() error {
+	return ucDE.Err
+}
+
+type UserNotDeletedError struct {
+	Message string
+	Err     error
+}
+
+func (ucDE *UserNotDeletedError) Error() string {
+	return ucDE.Message
+}
+
+func (ucDE *UserNotDeletedError) Unwrap() error {
+	return ucDE.Err
+}
+
+// InvalidUserError reports a user the database refused to store, such as one
+// with a username longer than its column.
+type InvalidUserError struct {
+	Message string
+	Err     error
+}
+
+func (ucDE *InvalidUserError) Error() string {
+	return ucDE.Message
+}
+
+func (ucDE *InvalidUserError) Unwrap() error {
+	return ucDE.Err
+}
+
+// PreconditionFailedError reports a change to a user that was made against a
+// version other than the user's current one.
+type PreconditionFailedError struct {
+	Message string
+	Err     error
+}
+
+func (ucDE *PreconditionFailedError) Error() string {
+	return ucDE.Message
+}
+
+func (ucDE *PreconditionFailedError) Unwrap() error {
+	return ucDE.Err
+}
+
+// IdempotencyLeaseLostError reports a request completing or releasing an
+// Idempotency-Key it no longer holds, because its lease ran out and the key
+// was claimed again.
+type IdempotencyLeaseLostError struct {
+	Message string
+	Err     error
+}
+
+func (ucDE *IdempotencyLeaseLostError) Error() string {
+	return ucDE.Message
+}
+
+func (ucDE *IdempotencyLeaseLostError) Unwrap() error {
+	return ucDE.Err
+}
+
+// InvalidQueryError reports a filter, sort or pagination parameter that cannot
+// be applied. Parameter is the name of the offending query parameter.
+type InvalidQueryError struct {
+	Parameter string
+	Message   string
+	Err       error
+}
+
+func (ucDE *InvalidQueryError) Error() string {
+	return ucDE.Message
+}
+
+func (ucDE *InvalidQueryError) Unwrap() error {
+	return ucDE.Err
+}
@@ -1,23 +1,201 @@
 package environment
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/netip"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
-func getEnvOrDefault(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
+type Config struct {
+	HTTP     HTTPConfig     `yaml:"http"`
+	Database DatabaseConfig `yaml:"database"`
+	Log      LogConfig      `yaml:"log"`
+}
+
+type HTTPConfig struct {
+	Port         int           `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// IdempotencyKeyTTL is how long the response to a request made with an
+	// Idempotency-Key is replayed to retries.
+	IdempotencyKeyTTL time.Duration `yaml:"idempotency_key_ttl"`
+	// IdempotencyKeyLease is how long a key is held for a request that has not
+	// finished, after which a retry may claim it, as when the server crashed
+	// before storing the response.
+	IdempotencyKeyLease time.Duration `yaml:"idempotency_key_lease"`
+	// RequireIfMatch makes clients send If-Match with every change to a user.
+	RequireIfMatch bool `yaml:"require_if_match"`
+	// TrustedProxies are the IPs or CIDR ranges of the proxies whose
+	// X-Forwarded-For header is believed when recording a client's IP. With
+	// none the IP the request came from is recorded.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// Database drivers DatabaseConfig.Driver can select.
+const (
+	DriverPostgres = "postgres"
+	// DriverMemory keeps everything in memory, for local development and
+	// tests. Nothing is kept once the process exits.
+	DriverMemory = "memory"
+	// DriverSQLite keeps everything in the SQLite database file at
+	// DatabaseConfig.Path, for single node deployments without Postgres.
+	DriverSQLite = "sqlite"
+)
+
+type DatabaseConfig struct {
+	Driver   string `yaml:"driver"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+	// Path is the SQLite database file, used only by the sqlite driver.
+	Path string `yaml:"path"`
+	// QueryTimeout bounds the time a request may spend on database queries, 0
+	// disables the timeout.
+	QueryTimeout time.Duration `yaml:"query_timeout"`
+	Pool         PoolConfig    `yaml:"pool"`
+	// MigrateOnStart applies any pending migrations before the server starts.
+	MigrateOnStart bool `yaml:"migrate_on_start"`
+	// AuditHashKey keys the audit log's hash chain with HMAC-SHA256, so only
+	// those holding it can recompute the hash of an entry. Without it the
+	// hashes are plain SHA-256. It is not used by the memory driver.
+	AuditHashKey string `yaml:"audit_hash_key"`
+}
+
+// PoolConfig sizes the database connection pool and bounds how long its
+// connections live.
+type PoolConfig struct {
+	MaxConns          int32         `yaml:"max_conns"`
+	MinConns          int32         `yaml:"min_conns"`
+	MaxConnLifetime   time.Duration `yaml:"max_conn_lifetime"`
+	MaxConnIdleTime   time.Duration `yaml:"max_conn_idle_time"`
+	HealthCheckPeriod time.Duration `yaml:"health_check_period"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// DataSourceName returns the libpq style connection string for the database. It
+// holds the password so must never be logged, use String instead.
+func (dc DatabaseConfig) DataSourceName() string {
+	return fmt.Sprintf("user=%s password=%s dbname=%s port=%d host=%s sslmode=%s",
+		quoteDSNValue(dc.User), quoteDSNValue(dc.Password), quoteDSNValue(dc.Name), dc.Port, quoteDSNValue(dc.Host), quoteDSNValue(dc.SSLMode))
+}
+
+// String returns the connection string with the password redacted, so the
+// config is safe to print, or just the driver when it has none.
+func (dc DatabaseConfig) String() string {
+	switch dc.Driver {
+	case DriverMemory:
+		return dc.Driver
+	case DriverSQLite:
+		return dc.Driver + ":" + dc.Path
+	}
+	return RedactDataSourceName(dc.DataSourceName())
+}
+
+// quoteDSNValue quotes a keyword/value connection string value when it is
+// empty or holds characters that would otherwise end it early.
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " '\\\t\n") {
 		return value
 	}
-	return defaultValue
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+var dsnPasswordPattern = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactDataSourceName hides the password in a keyword/value or URL style
+// connection string.
+func RedactDataSourceName(dataSourceName string) string {
+	if strings.Contains(dataSourceName, "://") {
+		if parsed, err := url.Parse(dataSourceName); err == nil {
+			query := parsed.Query()
+			if query.Has("password") {
+				query.Set("password", redacted)
+				parsed.RawQuery = query.Encode()
+			}
+			return parsed.Redacted()
+		}
+		return "<unparseable connection string>"
+	}
+
+	return dsnPasswordPattern.ReplaceAllString(dataSourceName, "${1}"+redacted)
 }
 
-func GetEnvVar(path string) (int, string, string, string, string, string) {
+const redacted = "xxxxx"
 
+// NewLogger returns a logger writing to w at the configured level and format.
+func (lc LogConfig) NewLogger(w io.Writer) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(lc.Level))
+
+	options := &slog.HandlerOptions{Level: level}
+	if lc.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+func Default() Config {
+	return Config{
+		HTTP: HTTPConfig{
+			Port:                8080,
+			ReadTimeout:         10 * time.Second,
+			WriteTimeout:        30 * time.Second,
+			IdleTimeout:         time.Minute,
+			IdempotencyKeyTTL:   24 * time.Hour,
+			IdempotencyKeyLease: 30 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Driver:       DriverPostgres,
+			Host:         "localhost",
+			Port:         5432,
+			User:         "postgres",
+			Password:     "postgres",
+			Name:         "golang_db",
+			SSLMode:      "disable",
+			Path:         "db_access.sqlite",
+			QueryTimeout: 5 * time.Second,
+			Pool: PoolConfig{
+				MaxConns:          10,
+				MinConns:          0,
+				MaxConnLifetime:   time.Hour,
+				MaxConnIdleTime:   30 * time.Minute,
+				HealthCheckPeriod: time.Minute,
+			},
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// Load builds the Config from, in increasing order of precedence, the
+// defaults, the .env file at path, environment variables and the YAML file
+// named by CONFIG_FILE if it is set. The .env file is skipped when ENV is
+// production. Any variable can instead be read from a file by setting its
+// name suffixed with _FILE, e.g. POSTGRES_PASSWORD_FILE. Every problem found
+// is reported together in the returned error.
+func Load(path string) (Config, error) {
 	if os.Getenv("ENV") != "production" {
 		err := godotenv.Load(path)
 		if err != nil {
@@ -26,28 +204,233 @@ func GetEnvVar(path string) (int, string, string, string, string, string) {
 		}
 	}
 
-	applicationPortString := getEnvOrDefault("APP_PORT", "8080")
-	appPort, err := strconv.Atoi(applicationPortString)
-	if err != nil {
-		log.Println("Unable to convert appPortString to Int")
+	config := Default()
+	problems := config.applyEnv()
+
+	if configFile, exists := os.LookupEnv("CONFIG_FILE"); exists {
+		err := config.applyYAML(configFile)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	problems = append(problems, config.Validate())
+
+	return config, errors.Join(problems...)
+}
+
+func (c *Config) applyEnv() []error {
+	var problems []error
+
+	// lookup reads key, or the contents of the file named by key_FILE so
+	// secrets can be mounted as Docker or Kubernetes secrets.
+	lookup := func(key string) (string, bool) {
+		value, exists := os.LookupEnv(key)
+		file, fileExists := os.LookupEnv(key + "_FILE")
+		if !fileExists {
+			return value, exists
+		}
+		if exists {
+			problems = append(problems, fmt.Errorf("only one of %s and %s_FILE may be set", key, key))
+			return "", false
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("unable to read %s_FILE: %w", key, err))
+			return "", false
+		}
+		return strings.TrimRight(string(data), "\r\n"), true
 	}
 
-	dbHost := getEnvOrDefault("DB_HOST", "localhost")
+	lookupInt := func(key string, target *int) {
+		if value, exists := lookup(key); exists {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s must be an integer, got %q", key, value))
+				return
+			}
+			*target = parsed
+		}
+	}
+	lookupInt32 := func(key string, target *int32) {
+		if value, exists := lookup(key); exists {
+			parsed, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s must be an integer, got %q", key, value))
+				return
+			}
+			*target = int32(parsed)
+		}
+	}
+	lookupDuration := func(key string, target *time.Duration) {
+		if value, exists := lookup(key); exists {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s must be a duration such as 5s, got %q", key, value))
+				return
+			}
+			*target = parsed
+		}
+	}
+	lookupBool := func(key string, target *bool) {
+		if value, exists := lookup(key); exists {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s must be true or false, got %q", key, value))
+				return
+			}
+			*target = parsed
+		}
+	}
+	lookupString := func(key string, target *string) {
+		if value, exists := lookup(key); exists {
+			*target = value
+		}
+	}
+	lookupList := func(key string, target *[]string) {
+		if value, exists := lookup(key); exists {
+			*target = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*target = append(*target, item)
+				}
+			}
+		}
+	}
 
-	runningMode := getEnvOrDefault("RUNNING_MODE", "locally")
+	lookupInt("APP_PORT", &c.HTTP.Port)
+	lookupDuration("HTTP_READ_TIMEOUT", &c.HTTP.ReadTimeout)
+	lookupDuration("HTTP_WRITE_TIMEOUT", &c.HTTP.WriteTimeout)
+	lookupDuration("HTTP_IDLE_TIMEOUT", &c.HTTP.IdleTimeout)
+	lookupDuration("IDEMPOTENCY_KEY_TTL", &c.HTTP.IdempotencyKeyTTL)
+	lookupDuration("IDEMPOTENCY_KEY_LEASE", &c.HTTP.IdempotencyKeyLease)
+	lookupBool("REQUIRE_IF_MATCH", &c.HTTP.RequireIfMatch)
+	lookupList("TRUSTED_PROXIES", &c.HTTP.TrustedProxies)
 
-	var dbPort string
-	if runningMode == "docker" {
-		dbPort = getEnvOrDefault("INTERNAL_DB_PORT", "5432")
+	lookupString("DB_DRIVER", &c.Database.Driver)
+	lookupString("DB_HOST", &c.Database.Host)
+	if os.Getenv("RUNNING_MODE") == "docker" {
+		lookupInt("INTERNAL_DB_PORT", &c.Database.Port)
 	} else {
-		dbPort = getEnvOrDefault("EXTERNAL_DB_PORT", "5432")
+		lookupInt("EXTERNAL_DB_PORT", &c.Database.Port)
 	}
+	lookupString("POSTGRES_USER", &c.Database.User)
+	lookupString("POSTGRES_PASSWORD", &c.Database.Password)
+	lookupString("POSTGRES_DB", &c.Database.Name)
+	lookupString("DB_SSLMODE", &c.Database.SSLMode)
+	lookupString("DB_PATH", &c.Database.Path)
+	lookupDuration("DB_QUERY_TIMEOUT", &c.Database.QueryTimeout)
+	lookupInt32("DB_POOL_MAX_CONNS", &c.Database.Pool.MaxConns)
+	lookupInt32("DB_POOL_MIN_CONNS", &c.Database.Pool.MinConns)
+	lookupDuration("DB_POOL_MAX_CONN_LIFETIME", &c.Database.Pool.MaxConnLifetime)
+	lookupDuration("DB_POOL_MAX_CONN_IDLE_TIME", &c.Database.Pool.MaxConnIdleTime)
+	lookupDuration("DB_POOL_HEALTH_CHECK_PERIOD", &c.Database.Pool.HealthCheckPeriod)
+	lookupBool("MIGRATE_ON_START", &c.Database.MigrateOnStart)
+	lookupString("AUDIT_HASH_KEY", &c.Database.AuditHashKey)
 
-	postgresUser := getEnvOrDefault("POSTGRES_USER", "postgres")
+	lookupString("LOG_LEVEL", &c.Log.Level)
+	lookupString("LOG_FORMAT", &c.Log.Format)
 
-	postgresPassword := getEnvOrDefault("POSTGRES_PASSWORD", "postgres")
+	return problems
+}
+
+// applyYAML overrides the config with every field set in the YAML file.
+func (c *Config) applyYAML(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read CONFIG_FILE: %w", err)
+	}
 
-	postgresDb := getEnvOrDefault("POSTGRES_DB", "golang_db")
+	err = yaml.Unmarshal(data, c)
+	if err != nil {
+		return fmt.Errorf("unable to parse CONFIG_FILE %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var problems []error
+
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		problems = append(problems, fmt.Errorf("http port must be between 1 and 65535, got %d", c.HTTP.Port))
+	}
+	if c.HTTP.ReadTimeout < 0 || c.HTTP.WriteTimeout < 0 || c.HTTP.IdleTimeout < 0 {
+		problems = append(problems, errors.New("http timeouts must not be negative"))
+	}
+	if c.HTTP.IdempotencyKeyTTL <= 0 {
+		problems = append(problems, errors.New("idempotency key ttl must be positive"))
+	}
+	// A lease that runs out while the request is still in the database would
+	// let a retry run it a second time.
+	if c.HTTP.IdempotencyKeyLease <= 0 || c.HTTP.IdempotencyKeyLease <= c.Database.QueryTimeout {
+		problems = append(problems, fmt.Errorf("idempotency key lease must be positive and longer than the database query timeout, got %v", c.HTTP.IdempotencyKeyLease))
+	}
+	for _, proxy := range c.HTTP.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(proxy); err != nil {
+			problems = append(problems, fmt.Errorf("trusted proxy must be an IP or CIDR range, got %q", proxy))
+		}
+	}
+
+	switch c.Database.Driver {
+	case DriverPostgres:
+		if c.Database.Host == "" {
+			problems = append(problems, errors.New("database host must be set"))
+		}
+		if c.Database.Port < 1 || c.Database.Port > 65535 {
+			problems = append(problems, fmt.Errorf("database port must be between 1 and 65535, got %d", c.Database.Port))
+		}
+		if c.Database.User == "" {
+			problems = append(problems, errors.New("database user must be set"))
+		}
+		if c.Database.Name == "" {
+			problems = append(problems, errors.New("database name must be set"))
+		}
+		switch c.Database.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			problems = append(problems, fmt.Errorf("database sslmode %q is not supported", c.Database.SSLMode))
+		}
+		if c.Database.Pool.MaxConns < 1 {
+			problems = append(problems, fmt.Errorf("database pool max conns must be at least 1, got %d", c.Database.Pool.MaxConns))
+		}
+		if c.Database.Pool.MinConns < 0 || c.Database.Pool.MinConns > c.Database.Pool.MaxConns {
+			problems = append(problems, fmt.Errorf("database pool min conns must be between 0 and max conns, got %d", c.Database.Pool.MinConns))
+		}
+		if c.Database.Pool.MaxConnLifetime <= 0 || c.Database.Pool.MaxConnIdleTime <= 0 || c.Database.Pool.HealthCheckPeriod <= 0 {
+			problems = append(problems, errors.New("database pool durations must be positive"))
+		}
+	case DriverMemory:
+	case DriverSQLite:
+		if c.Database.Path == "" {
+			problems = append(problems, errors.New("database path must be set"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("database driver must be %s, %s or %s, got %q", DriverPostgres, DriverSQLite, DriverMemory, c.Database.Driver))
+	}
+	if c.Database.QueryTimeout < 0 {
+		problems = append(problems, errors.New("database query timeout must not be negative"))
+	}
+	// HMAC-SHA256 keys shorter than its output weaken it.
+	if c.Database.AuditHashKey != "" && len(c.Database.AuditHashKey) < 32 {
+		problems = append(problems, fmt.Errorf("audit hash key must be at least 32 bytes, got %d", len(c.Database.AuditHashKey)))
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Errorf("log level must be one of debug, info, warn or error, got %q", c.Log.Level))
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		problems = append(problems, fmt.Errorf("log format must be text or json, got %q", c.Log.Format))
+	}
 
-	return appPort, dbHost, dbPort, postgresUser, postgresPassword, postgresDb
+	return errors.Join(problems...)
 }
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"db_access/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// actorHeader names who is making the request. The API has no
+	// authentication of its own, so it is expected to be set by a trusted
+	// gateway in front of it.
+	actorHeader = "X-Actor"
+
+	anonymousActor    = "anonymous"
+	maxAuditValueSize = 255
+)
+
+var auditActions = map[string]bool{
+	domain.AuditActionInsert:  true,
+	domain.AuditActionUpdate:  true,
+	domain.AuditActionDelete:  true,
+	domain.AuditActionRestore: true,
+}
+
+// AuditContextMiddleware attaches the actor, request id and client IP of the
+// request to its context, so the database can record them against any change
+// the request makes. The request id is taken from X-Request-ID, or generated,
+// and echoed back in the response.
+func (s *Server) AuditContextMiddleware(c *gin.Context) {
+	requestId := c.GetHeader(requestIDHeader)
+	if requestId == "" || len(requestId) > maxAuditValueSize {
+		requestId = newRequestID()
+	}
+	c.Header(requestIDHeader, requestId)
+
+	actor := c.GetHeader(actorHeader)
+	if actor == "" || len(actor) > maxAuditValueSize {
+		actor = anonymousActor
+	}
+
+	audit := domain.AuditContext{Actor: actor, RequestID: requestId, ClientIP: c.ClientIP()}
+	c.Request = c.Request.WithContext(domain.WithAuditContext(c.Request.Context(), audit))
+	c.Next()
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// GetUserHistoryHandler lists every change made to a user, oldest first. The
+// history of a deleted user can still be read.
+func (s *Server) GetUserHistoryHandler(c *gin.Context) {
+	userId, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	entries, err := s.Db.GetUserHistory(c.Request.Context(), userId)
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// GetAuditLogHandler lists the audit log oldest first, filtered by user_id,
+// actor, action, request_id, created_after and created_before.
+func (s *Server) GetAuditLogHandler(c *gin.Context) {
+	query, err := parseAuditQuery(c)
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+
+	entries, next, err := s.Db.GetAuditLog(c.Request.Context(), query)
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+
+	page := domain.AuditPage{Entries: entries}
+	if next != nil {
+		nextCursor := encodeAuditCursor(auditCursor{AfterID: *next})
+		page.NextCursor = &nextCursor
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// VerifyAuditLogHandler walks the audit log's hash chain. It responds 200 when
+// every entry verifies and 409 with the first broken entry otherwise, so it
+// can be polled by monitoring.
+func (s *Server) VerifyAuditLogHandler(c *gin.Context) {
+	verification, err := s.Db.VerifyAuditLog(c.Request.Context())
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+
+	if !verification.Valid {
+		c.JSON(http.StatusConflict, verification)
+		return
+	}
+
+	c.JSON(http.StatusOK, verification)
+}
+
+// auditCursor is handed to clients as opaque base64 encoded JSON, like the
+// user listing cursor.
+type auditCursor struct {
+	AfterID int64 `json:"after_id"`
+}
+
+func encodeAuditCursor(c auditCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAuditCursor(value string) (auditCursor, error) {
+	var c auditCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, invalidParameter("cursor", "invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.AfterID < 1 {
+		return auditCursor{}, invalidParameter("cursor", "invalid cursor")
+	}
+
+	return c, nil
+}
+
+// parseAuditQuery reads the filter and pagination parameters of the audit log.
+func parseAuditQuery(c *gin.Context) (domain.AuditQuery, error) {
+	var query domain.AuditQuery
+	var err error
+
+	if query.Limit, err = parseLimit(c.Query("limit")); err != nil {
+		return query, err
+	}
+
+	if value := c.Query("user_id"); value != "" {
+		query.UserID, err = strconv.Atoi(value)
+		if err != nil || query.UserID < 1 {
+			return query, invalidParameter("user_id", "invalid user_id. Must be a positive integer")
+		}
+	}
+
+	query.Actor = c.Query("actor")
+	if len(query.Actor) > maxAuditValueSize {
+		return query, invalidParameter("actor", "invalid actor. Must be at most 255 characters")
+	}
+
+	query.Action = c.Query("action")
+	if query.Action != "" && !auditActions[query.Action] {
+		return query, invalidParameter("action", "invalid action. Must be one of insert, update, delete or restore")
+	}
+
+	query.RequestID = c.Query("request_id")
+	if len(query.RequestID) > maxAuditValueSize {
+		return query, invalidParameter("request_id", "invalid request_id. Must be at most 255 characters")
+	}
+
+	if query.CreatedAfter, err = parseTime("created_after", c.Query("created_after")); err != nil {
+		return query, err
+	}
+	if query.CreatedBefore, err = parseTime("created_before", c.Query("created_before")); err != nil {
+		return query, err
+	}
+	if query.CreatedAfter != nil && query.CreatedBefore != nil && !query.CreatedAfter.Before(*query.CreatedBefore) {
+		return query, invalidParameter("created_before", "invalid created_before. Must be later than created_after")
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		after, err := decodeAuditCursor(value)
+		if err != nil {
+			return query, err
+		}
+		query.AfterID = after.AfterID
+	}
+
+	return query, nil
+}
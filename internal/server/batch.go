@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"db_access/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxBatchSize bounds the number of users a single batch may create.
+	maxBatchSize = 1000
+	// maxBatchBytes bounds the request body, which is read whole before the
+	// users are counted. A full batch of the longest users fits comfortably.
+	maxBatchBytes = 1 << 20
+)
+
+// BatchUsersResponse reports the outcome of every user in a batch, in order.
+type BatchUsersResponse struct {
+	Atomic  bool                     `json:"atomic"`
+	Created int                      `json:"created"`
+	Failed  int                      `json:"failed"`
+	Results []domain.BatchUserResult `json:"results"`
+}
+
+// InsertUsersBatchHandler creates a JSON array of users in one transaction.
+// With atomic=true either every user is created or none are. Otherwise the
+// valid users are created and each failure is reported alongside them.
+func (s *Server) InsertUsersBatchHandler(c *gin.Context) {
+	atomic := false
+	if value := c.Query("atomic"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(c, invalidParameter("atomic", "atomic must be true or false"))
+			return
+		}
+		atomic = parsed
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes)
+	body, err := io.ReadAll(c.Request.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithProblem(c, problemPayloadTooLarge.problem(fmt.Sprintf("batch must not be larger than %d bytes", maxBatchBytes)))
+		return
+	}
+	if err != nil {
+		respondWithProblem(c, problemUnreadableBody.problem("Unable to read the request body"))
+		return
+	}
+
+	// Decode without binding so every invalid user is reported rather than
+	// only the first.
+	var users []domain.User
+	if err := json.Unmarshal(body, &users); err != nil {
+		respondWithProblem(c, problemValidationFailed.problem("batch must be a JSON array of users"))
+		return
+	}
+	if len(users) == 0 {
+		respondWithProblem(c, problemValidationFailed.problem("batch must contain at least one user"))
+		return
+	}
+	if len(users) > maxBatchSize {
+		respondWithProblem(c, problemPayloadTooLarge.problem(fmt.Sprintf("batch must not contain more than %d users", maxBatchSize)))
+		return
+	}
+
+	results := make([]domain.BatchUserResult, len(users))
+	var valid []domain.User
+	var positions []int
+	for i, user := range users {
+		results[i].Index = i
+		if err := validateItem(user); err != nil {
+			results[i].Status = domain.BatchUserFailed
+			results[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, user)
+		positions = append(positions, i)
+	}
+
+	invalid := len(valid) < len(users)
+	if invalid && atomic {
+		for _, i := range positions {
+			results[i].Status = domain.BatchUserRolledBack
+		}
+		c.JSON(http.StatusUnprocessableEntity, newBatchUsersResponse(atomic, results))
+		return
+	}
+
+	if len(valid) > 0 {
+		inserted, err := s.Db.InsertUsers(c.Request.Context(), valid, domain.BatchInsertOptions{Atomic: atomic})
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		for j, result := range inserted {
+			result.Index = positions[j]
+			results[positions[j]] = result
+		}
+	}
+
+	response := newBatchUsersResponse(atomic, results)
+	switch {
+	case response.Failed == 0:
+		c.JSON(http.StatusCreated, response)
+	case atomic:
+		c.JSON(http.StatusConflict, response)
+	default:
+		c.JSON(http.StatusMultiStatus, response)
+	}
+}
+
+func newBatchUsersResponse(atomic bool, results []domain.BatchUserResult) BatchUsersResponse {
+	response := BatchUsersResponse{Atomic: atomic, Results: results}
+	for _, result := range results {
+		switch result.Status {
+		case domain.BatchUserCreated:
+			response.Created++
+		case domain.BatchUserFailed:
+			response.Failed++
+		}
+	}
+	return response
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"db_access/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	etagHeader        = "ETag"
+	ifMatchHeader     = "If-Match"
+	ifNoneMatchHeader = "If-None-Match"
+)
+
+// userETag is the strong entity tag of a user, its quoted version.
+func userETag(user domain.User) string {
+	return strconv.Quote(strconv.Itoa(user.Version))
+}
+
+// expectedVersions reads the versions a change is conditional on from
+// If-Match. A missing header or * puts no condition on the change, returning
+// nil, unless RequireIfMatch is set. It responds itself and reports false when
+// the change must not go ahead.
+func (s *Server) expectedVersions(c *gin.Context) ([]int, bool) {
+	value := strings.TrimSpace(c.GetHeader(ifMatchHeader))
+	if value == "" {
+		if s.RequireIfMatch {
+			respondWithProblem(c, problemIfMatchRequired.problem("If-Match is required to change this user"))
+			return nil, false
+		}
+		return nil, true
+	}
+
+	versions := []int{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+		// If-Match uses the strong comparison, which a weak tag never passes.
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		version, err := parseVersionTag(tag)
+		if err != nil {
+			respondWithProblem(c, problemInvalidHeader.problem("If-Match must be a list of ETags or *"))
+			return nil, false
+		}
+		versions = append(versions, version)
+	}
+
+	if len(versions) == 0 {
+		respondWithProblem(c, problemVersionMismatch.problem("User has been changed since it was read"))
+		return nil, false
+	}
+	return versions, true
+}
+
+// changeAtVersion makes change conditional on each of versions in turn until
+// one of them is the user's current version, so If-Match may list several
+// ETags. Each attempt is conditional, so a user changed between attempts is
+// never overwritten. A nil versions makes the change unconditionally.
+func changeAtVersion(versions []int, change func(expectedVersion *int) error) error {
+	if versions == nil {
+		return change(nil)
+	}
+
+	var err error
+	for _, version := range versions {
+		err = change(&version)
+		var stale *domain.PreconditionFailedError
+		if !errors.As(err, &stale) {
+			return err
+		}
+	}
+	return err
+}
+
+// notModified reports whether If-None-Match lists etag, using the weak
+// comparison, in which case the client's copy is current and a 304 is sent.
+func notModified(c *gin.Context, etag string) bool {
+	value := c.GetHeader(ifNoneMatchHeader)
+	if value == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseVersionTag(tag string) (int, error) {
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil || !strings.HasPrefix(tag, `"`) {
+		return 0, fmt.Errorf("%s is not a quoted ETag", tag)
+	}
+	return strconv.Atoi(unquoted)
+}
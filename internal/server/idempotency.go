@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencyRecordTimeout = 5 * time.Second
+	jsonContentType          = "application/json; charset=utf-8"
+)
+
+// idempotentResponse is a handler's response in a form that can be stored.
+type idempotentResponse struct {
+	status int
+	body   any
+	userId *int
+}
+
+// respondIdempotently runs handle once per Idempotency-Key. The first response
+// is stored and replayed to retries with the same key and payload, while a
+// different payload is rejected with a 422. Server errors are not stored so
+// the request can be retried, and neither is the response of a request that
+// never finished, whose key a retry can claim once its lease runs out.
+func (s *Server) respondIdempotently(c *gin.Context, key string, payload any, handle func(ctx context.Context) idempotentResponse) {
+	if len(key) > maxIdempotencyKeyLength {
+		respondWithProblem(c, problemInvalidHeader.problem("Idempotency-Key must not be longer than 255 characters"))
+		return
+	}
+
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+	hash := sha256.Sum256(encodedPayload)
+	requestHash := hex.EncodeToString(hash[:])
+
+	record, reserved, err := s.Db.ReserveIdempotencyKey(c.Request.Context(), key, requestHash, s.IdempotencyKeyLease)
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+
+	if !reserved {
+		switch {
+		case record.RequestHash != requestHash:
+			respondWithProblem(c, problemIdempotencyKeyReused.problem("Idempotency-Key has already been used with a different request"))
+		case record.StatusCode == 0:
+			respondWithProblem(c, problemIdempotencyKeyInProgress.problem("A request with this Idempotency-Key is still being processed"))
+		default:
+			c.Header(idempotentReplayedHeader, "true")
+			c.Data(record.StatusCode, responseContentType(record.StatusCode), record.Body)
+		}
+		return
+	}
+
+	response := handle(c.Request.Context())
+	body, err := json.Marshal(response.body)
+	if err != nil {
+		problem := problemFor(err)
+		response = idempotentResponse{status: problem.Status, body: problem}
+		body, _ = json.Marshal(response.body)
+	}
+
+	// Record the outcome even if the client has gone away, otherwise the key
+	// would stay in progress until it expires.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), idempotencyRecordTimeout)
+	defer cancel()
+	if response.status >= http.StatusInternalServerError {
+		err = s.Db.ReleaseIdempotencyKey(ctx, key, record.LeaseToken)
+	} else {
+		err = s.Db.CompleteIdempotencyKey(ctx, key, record.LeaseToken, response.status, body, response.userId, s.IdempotencyKeyTTL)
+	}
+	if err != nil {
+		log.Println("Unable to record the response for an Idempotency-Key:", err)
+	}
+
+	c.Data(response.status, responseContentType(response.status), body)
+}
+
+// responseContentType is the Content-Type of a stored response, which is a
+// problem when it reports an error.
+func responseContentType(status int) string {
+	if status >= http.StatusBadRequest {
+		return problemContentType
+	}
+	return jsonContentType
+}
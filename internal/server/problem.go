@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"db_access/internal/domain"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object. Code identifies the kind of
+// problem and is stable, so clients can branch on it rather than on Detail.
+// Parameter names the query parameter at fault and Errors lists every field
+// of the request body that failed validation.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      string       `json:"code"`
+	Parameter string       `json:"parameter,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is one field of a request body that failed validation. Code is
+// the rule that failed, such as required or email.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FieldErrors reports fields of a request body that failed validation outside
+// of binding, such as the members of a merge patch.
+type FieldErrors []FieldError
+
+func (fieldErrors FieldErrors) Error() string {
+	messages := make([]string, len(fieldErrors))
+	for i, fieldError := range fieldErrors {
+		messages[i] = fieldError.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+// problemType is a kind of problem, its status and its stable code and title.
+type problemType struct {
+	status int
+	code   string
+	title  string
+}
+
+var (
+	problemInvalidUserID            = problemType{http.StatusBadRequest, "invalid_user_id", "Invalid user id"}
+	problemInvalidParameter         = problemType{http.StatusBadRequest, "invalid_parameter", "Invalid query parameter"}
+	problemInvalidHeader            = problemType{http.StatusBadRequest, "invalid_header", "Invalid header"}
+	problemUnreadableBody           = problemType{http.StatusBadRequest, "unreadable_body", "Unreadable request body"}
+	problemUserNotFound             = problemType{http.StatusNotFound, "user_not_found", "User not found"}
+	problemUserDeleted              = problemType{http.StatusGone, "user_deleted", "User has been deleted"}
+	problemUserNotDeleted           = problemType{http.StatusConflict, "user_not_deleted", "User has not been deleted"}
+	problemEmailTaken               = problemType{http.StatusConflict, "email_taken", "Email already in use"}
+	problemIdempotencyKeyInProgress = problemType{http.StatusConflict, "idempotency_key_in_progress", "Request in progress"}
+	problemVersionMismatch          = problemType{http.StatusPreconditionFailed, "version_mismatch", "User has changed"}
+	problemPayloadTooLarge          = problemType{http.StatusRequestEntityTooLarge, "payload_too_large", "Request too large"}
+	problemUnsupportedMediaType     = problemType{http.StatusUnsupportedMediaType, "unsupported_media_type", "Unsupported media type"}
+	problemValidationFailed         = problemType{http.StatusUnprocessableEntity, "validation_failed", "Validation failed"}
+	problemIdempotencyKeyReused     = problemType{http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key reused"}
+	problemIfMatchRequired          = problemType{http.StatusPreconditionRequired, "if_match_required", "If-Match required"}
+	problemInternal                 = problemType{http.StatusInternalServerError, "internal_error", "Internal server error"}
+	problemDatabaseUnavailable      = problemType{http.StatusServiceUnavailable, "database_unavailable", "Database unavailable"}
+	problemTimeout                  = problemType{http.StatusGatewayTimeout, "timeout", "Request timed out"}
+)
+
+func (t problemType) problem(detail string) Problem {
+	return Problem{
+		Type:   "urn:problem-type:" + t.code,
+		Title:  t.title,
+		Status: t.status,
+		Detail: detail,
+		Code:   t.code,
+	}
+}
+
+// respondWithProblem writes problem as application/problem+json.
+func respondWithProblem(c *gin.Context, problem Problem) {
+	// The JSON renderer keeps a Content-Type that has already been set.
+	c.Header("Content-Type", problemContentType)
+	c.JSON(problem.Status, problem)
+}
+
+// respondWithError writes the problem err maps to.
+func respondWithError(c *gin.Context, err error) {
+	respondWithProblem(c, problemFor(err))
+}
+
+// problemFor maps an error returned by the database to a problem. Errors are
+// matched with errors.As, so they may be wrapped. The details of errors the
+// client cannot act on are logged rather than returned, so the internals of
+// the database do not leak.
+func problemFor(err error) Problem {
+	var invalidQuery *domain.InvalidQueryError
+	var notFound *domain.UserNotFoundError
+	var deleted *domain.UserDeletedError
+	var notDeleted *domain.UserNotDeletedError
+	var uniqueConstraint *domain.UniqueConstraintDatabaseError
+	var invalidUser *domain.InvalidUserError
+	var preconditionFailed *domain.PreconditionFailedError
+	var transaction *domain.DatabaseTransactionError
+
+	switch {
+	case errors.As(err, &invalidQuery):
+		problem := problemInvalidParameter.problem(invalidQuery.Message)
+		problem.Parameter = invalidQuery.Parameter
+		return problem
+	case errors.As(err, &notFound):
+		return problemUserNotFound.problem(notFound.Message)
+	case errors.As(err, &deleted):
+		return problemUserDeleted.problem(deleted.Message)
+	case errors.As(err, &notDeleted):
+		return problemUserNotDeleted.problem(notDeleted.Message)
+	case errors.As(err, &uniqueConstraint):
+		return problemEmailTaken.problem("This email is already used by another user")
+	case errors.As(err, &invalidUser):
+		log.Println("Invalid user:", err)
+		return problemValidationFailed.problem("A field is longer than the database allows")
+	case errors.As(err, &preconditionFailed):
+		return problemVersionMismatch.problem("User has been changed since it was read")
+	}
+
+	log.Println("Unable to complete the request. [Reason]:", err)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return problemTimeout.problem("The database did not respond in time")
+	case errors.As(err, &transaction):
+		return problemDatabaseUnavailable.problem("The database could not run the request. Try again later")
+	default:
+		return problemInternal.problem("The request could not be completed")
+	}
+}
+
+// bindingProblem maps an error from binding a request body into obj to a
+// validation problem, listing every field that failed under errors.
+func bindingProblem(err error, obj any) Problem {
+	var validationErrors validator.ValidationErrors
+	var fieldErrors FieldErrors
+	var typeError *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &validationErrors):
+		fieldErrors = newFieldErrors(validationErrors, obj)
+	case errors.As(err, &fieldErrors):
+	case errors.As(err, &typeError) && typeError.Field != "":
+		fieldErrors = FieldErrors{{
+			Field:   typeError.Field,
+			Code:    "type",
+			Message: fmt.Sprintf("%s must be a %s", typeError.Field, typeError.Type),
+		}}
+	default:
+		return problemValidationFailed.problem(err.Error())
+	}
+
+	problem := problemValidationFailed.problem("The request body has invalid fields")
+	problem.Errors = fieldErrors
+	return problem
+}
+
+// validateItem validates one item of a batch or import file like binding
+// validates a request body, so its errors read the same as those of a problem.
+func validateItem(obj any) error {
+	err := binding.Validator.ValidateStruct(obj)
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		return newFieldErrors(validationErrors, obj)
+	}
+	return err
+}
+
+func newFieldErrors(validationErrors validator.ValidationErrors, obj any) FieldErrors {
+	fieldErrors := make(FieldErrors, len(validationErrors))
+	for i, validationError := range validationErrors {
+		fieldErrors[i] = newFieldError(jsonFieldName(obj, validationError.StructField()), validationError)
+	}
+	return fieldErrors
+}
+
+func newFieldError(field string, validationError validator.FieldError) FieldError {
+	var message string
+	switch validationError.Tag() {
+	case "required":
+		message = fmt.Sprintf("%s is required", field)
+	case "email":
+		message = fmt.Sprintf("%s must be a valid email address", field)
+	case "min":
+		message = fmt.Sprintf("%s must be at least %s characters", field, validationError.Param())
+	case "max":
+		message = fmt.Sprintf("%s must be at most %s characters", field, validationError.Param())
+	default:
+		message = fmt.Sprintf("%s failed the %s rule", field, validationError.Tag())
+	}
+	return FieldError{Field: field, Code: validationError.Tag(), Message: message}
+}
+
+// jsonFieldName returns the name a field of obj has in JSON, so errors name
+// the field as the client sent it.
+func jsonFieldName(obj any, structField string) string {
+	objType := reflect.TypeOf(obj)
+	for objType != nil && objType.Kind() == reflect.Pointer {
+		objType = objType.Elem()
+	}
+	if objType == nil || objType.Kind() != reflect.Struct {
+		return structField
+	}
+
+	field, ok := objType.FieldByName(structField)
+	if !ok {
+		return structField
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return structField
+	}
+	return name
+}
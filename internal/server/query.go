@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"db_access/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+var emailDomainPattern = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*$`)
+
+// cursor is handed to clients as opaque base64 encoded JSON so its contents can
+// change without breaking them. It records the sort it was issued for, since
+// its keys mean nothing under a different one.
+type cursor struct {
+	domain.UsersCursor
+	Sort string `json:"sort,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (cursor, error) {
+	var c cursor
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, invalidParameter("cursor", "invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil || len(c.Keys) == 0 {
+		return cursor{}, invalidParameter("cursor", "invalid cursor")
+	}
+
+	return c, nil
+}
+
+func invalidParameter(parameter, message string) error {
+	return &domain.InvalidQueryError{Parameter: parameter, Message: message}
+}
+
+func parseLimit(value string) (int, error) {
+	if value == "" {
+		return defaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, invalidParameter("limit", fmt.Sprintf("invalid limit. Must be an integer between 1 and %d", maxPageLimit))
+	}
+
+	return limit, nil
+}
+
+// parseTime accepts an RFC 3339 timestamp or a plain date, read as midnight UTC.
+func parseTime(parameter, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return &parsed, nil
+		}
+	}
+
+	return nil, invalidParameter(parameter, fmt.Sprintf("invalid %s. Must be an RFC 3339 timestamp or a YYYY-MM-DD date", parameter))
+}
+
+// parseSort reads a comma separated list of fields, each optionally prefixed
+// with - to sort in descending order. Which fields are allowed is decided by
+// the database layer.
+func parseSort(value string) ([]domain.SortField, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var fields []domain.SortField
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		field := domain.SortField{Field: strings.TrimPrefix(part, "-"), Descending: strings.HasPrefix(part, "-")}
+		if field.Field == "" {
+			return nil, invalidParameter("sort", "invalid sort. Must be a comma separated list of fields")
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// parseUsersQuery reads the filter, sort and pagination parameters of a user
+// listing.
+func parseUsersQuery(c *gin.Context) (domain.UsersQuery, error) {
+	var query domain.UsersQuery
+	var err error
+
+	if query.Limit, err = parseLimit(c.Query("limit")); err != nil {
+		return query, err
+	}
+
+	query.UsernamePrefix = c.Query("username")
+	if len(query.UsernamePrefix) > 50 {
+		return query, invalidParameter("username", "invalid username. Must be at most 50 characters")
+	}
+
+	query.EmailDomain = c.Query("email_domain")
+	if query.EmailDomain != "" && !emailDomainPattern.MatchString(query.EmailDomain) {
+		return query, invalidParameter("email_domain", "invalid email_domain. Must be a domain name such as example.com")
+	}
+
+	if query.CreatedAfter, err = parseTime("created_after", c.Query("created_after")); err != nil {
+		return query, err
+	}
+	if query.CreatedBefore, err = parseTime("created_before", c.Query("created_before")); err != nil {
+		return query, err
+	}
+	if query.CreatedAfter != nil && query.CreatedBefore != nil && !query.CreatedAfter.Before(*query.CreatedBefore) {
+		return query, invalidParameter("created_before", "invalid created_before. Must be later than created_after")
+	}
+
+	if value := c.Query("include_deleted"); value != "" {
+		if query.IncludeDeleted, err = strconv.ParseBool(value); err != nil {
+			return query, invalidParameter("include_deleted", "invalid include_deleted. Must be true or false")
+		}
+	}
+
+	sort := c.Query("sort")
+	if query.Sort, err = parseSort(sort); err != nil {
+		return query, err
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		after, err := decodeCursor(value)
+		if err != nil {
+			return query, err
+		}
+		if after.Sort != sort {
+			return query, invalidParameter("cursor", "cursor does not match the requested sort")
+		}
+		query.After = &after.UsersCursor
+	}
+
+	return query, nil
+}
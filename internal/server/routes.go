@@ -1,62 +1,229 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"db_access/internal/domain"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"runtime/debug"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 func (s *Server) RegisterRoutes() http.Handler {
-	router := gin.Default()
+	router := gin.New()
 
-	router.POST("/user", s.InsertNewUserHandler)
+	// gin trusts every proxy unless told otherwise, and keeps doing so if the
+	// list fails to parse, so fall back to trusting none.
+	err := router.SetTrustedProxies(s.TrustedProxies)
+	if err != nil {
+		log.Println("Unable to set the trusted proxies, trusting none:", err)
+		router.SetTrustedProxies(nil)
+	}
+
+	router.Use(gin.Logger(), gin.CustomRecoveryWithWriter(nil, recoverHandler))
+
+	router.Use(s.AuditContextMiddleware)
+
+	router.GET("/health/live", s.LivenessHandler)
+
+	router.GET("/health/ready", s.ReadinessHandler)
+
+	// Exports, imports and audit log verification read or write every row, so
+	// they run for as long as the client waits rather than QueryTimeout.
+	router.GET("/users/export", s.ExportUsersHandler)
+
+	router.POST("/users/import", s.ImportUsersHandler)
+
+	router.GET("/admin/audit/verify", s.VerifyAuditLogHandler)
+
+	timed := router.Group("", s.QueryTimeoutMiddleware)
+
+	timed.POST("/user", s.InsertNewUserHandler)
+
+	timed.GET("/users", s.GetAllUsersHandler)
+
+	timed.POST("/users/batch", s.InsertUsersBatchHandler)
+
+	timed.GET("/user/:userId", s.GetUserByIDHandler)
+
+	timed.PUT("/user/:userId", s.UpdateUserHandler)
 
-	router.GET("/users", s.GetAllUsersHandler)
+	timed.PATCH("/user/:userId", s.PatchUserHandler)
 
-	router.DELETE("/user/:userId", s.DeleteUserHandler)
+	timed.DELETE("/user/:userId", s.DeleteUserHandler)
+
+	timed.POST("/user/:userId/restore", s.RestoreUserHandler)
+
+	timed.GET("/user/:userId/history", s.GetUserHistoryHandler)
+
+	timed.GET("/audit", s.GetAuditLogHandler)
 
 	return router
 }
 
+// recoverHandler logs a handler's panic and responds 500, except to a handler
+// that panicked with http.ErrAbortHandler to abort its response, which is
+// passed on so the server closes the connection.
+func recoverHandler(c *gin.Context, err any) {
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+	log.Printf("Recovered from a panic: %v\n%s", err, debug.Stack())
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// QueryTimeoutMiddleware gives the request context a deadline of QueryTimeout.
+// Handlers pass the request context on to the database so a slow query is
+// cancelled once the deadline passes, the client disconnects or the server
+// shuts down.
+func (s *Server) QueryTimeoutMiddleware(c *gin.Context) {
+	if s.QueryTimeout <= 0 {
+		c.Next()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.QueryTimeout)
+	defer cancel()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// LivenessHandler reports that the process is up and serving requests. It does
+// not touch the database so a database outage does not get the process restarted.
+func (s *Server) LivenessHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "up"})
+}
+
+// ReadinessHandler reports whether the server can take traffic, which needs
+// the database to be reachable and migrated up to ExpectedMigrationVersion.
+func (s *Server) ReadinessHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	health := s.Db.Health(ctx)
+	if health.Status != "up" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "down", "database": health})
+		return
+	}
+
+	if health.MigrationVersion < s.ExpectedMigrationVersion {
+		message := fmt.Sprintf("database is at migration %d, expected %d", health.MigrationVersion, s.ExpectedMigrationVersion)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "down", "error": message, "database": health})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "up", "database": health})
+}
+
 func (s *Server) GetAllUsersHandler(c *gin.Context) {
-	users, err := s.Db.GetAllUsers()
+	query, err := parseUsersQuery(c)
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+
+	users, next, err := s.Db.GetUsersPage(c.Request.Context(), query)
+	if err != nil {
+		respondWithError(c, err)
+		return
+	}
+
+	page := domain.UsersPage{Users: users}
+	if next != nil {
+		nextCursor := encodeCursor(cursor{UsersCursor: *next, Sort: c.Query("sort")})
+		page.NextCursor = &nextCursor
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// parseUserID reads the userId path parameter. It responds itself and reports
+// false when the id is not an integer.
+func parseUserID(c *gin.Context) (int, bool) {
+	userId, err := strconv.Atoi(c.Param("userId"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{})
+		respondWithProblem(c, problemInvalidUserID.problem("userId must be an integer"))
+		return 0, false
+	}
+	return userId, true
+}
+
+func (s *Server) GetUserByIDHandler(c *gin.Context) {
+	userId, ok := parseUserID(c)
+	if !ok {
 		return
 	}
 
-	if len(users) == 0 {
-		c.JSON(http.StatusOK, gin.H{})
+	user, err := s.Db.GetUserByID(c.Request.Context(), userId)
+	if err != nil {
+		respondWithError(c, err)
 		return
-	} else {
-		c.JSON(http.StatusOK, users)
+	}
+
+	etag := userETag(user)
+	c.Header(etagHeader, etag)
+	if notModified(c, etag) {
+		c.Status(http.StatusNotModified)
 		return
 	}
+	c.JSON(http.StatusOK, user)
 }
 
 func (s *Server) DeleteUserHandler(c *gin.Context) {
-	userIdParam := c.Param("userId")
+	userId, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	versions, ok := s.expectedVersions(c)
+	if !ok {
+		return
+	}
 
-	userId, err := strconv.Atoi(userIdParam)
+	err := changeAtVersion(versions, func(expectedVersion *int) error {
+		return s.Db.SoftDeleteUser(c.Request.Context(), userId, expectedVersion)
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid userId format. Must be an integer."})
+		respondWithError(c, err)
 		return
 	}
 
-	err = s.Db.SoftDeleteUser(userId)
-	switch err.(type) {
-	case *domain.UniqueConstraintDatabaseError:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to delete this user as they have already been deleted"})
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) RestoreUserHandler(c *gin.Context) {
+	userId, ok := parseUserID(c)
+	if !ok {
 		return
-	case *domain.UserNotFoundError:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to delete this user as they do not exist"})
+	}
+
+	versions, ok := s.expectedVersions(c)
+	if !ok {
 		return
-	default:
-		c.JSON(http.StatusNoContent, gin.H{})
+	}
+
+	var user domain.User
+	err := changeAtVersion(versions, func(expectedVersion *int) error {
+		var err error
+		user, err = s.Db.RestoreUser(c.Request.Context(), userId, expectedVersion)
+		return err
+	})
+	if err != nil {
+		respondWithError(c, err)
 		return
 	}
+
+	c.Header(etagHeader, userETag(user))
+	c.JSON(http.StatusOK, user)
 }
 
 func (s *Server) InsertNewUserHandler(c *gin.Context) {
@@ -64,17 +231,143 @@ func (s *Server) InsertNewUserHandler(c *gin.Context) {
 	var newUser domain.User
 
 	if err := c.ShouldBindJSON(&newUser); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		respondWithProblem(c, bindingProblem(err, newUser))
+		return
+	}
+
+	insert := func(ctx context.Context) idempotentResponse {
+		userId, err := s.Db.InsertNewUser(ctx, newUser)
+		if err != nil {
+			problem := problemFor(err)
+			return idempotentResponse{status: problem.Status, body: problem}
+		}
+		return idempotentResponse{status: http.StatusCreated, body: gin.H{"userId": userId}, userId: &userId}
+	}
+
+	if key := c.GetHeader(idempotencyKeyHeader); key != "" {
+		s.respondIdempotently(c, key, newUser, insert)
+		return
+	}
+
+	response := insert(c.Request.Context())
+	if problem, ok := response.body.(Problem); ok {
+		respondWithProblem(c, problem)
+		return
+	}
+	c.JSON(response.status, response.body)
+}
+
+func (s *Server) UpdateUserHandler(c *gin.Context) {
+	userId, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	var user domain.User
+
+	if err := c.ShouldBindJSON(&user); err != nil {
+		respondWithProblem(c, bindingProblem(err, user))
+		return
+	}
+
+	versions, ok := s.expectedVersions(c)
+	if !ok {
+		return
+	}
+
+	var updatedUser domain.User
+	err := changeAtVersion(versions, func(expectedVersion *int) error {
+		var err error
+		updatedUser, err = s.Db.UpdateUser(c.Request.Context(), userId, user, expectedVersion)
+		return err
+	})
+	respondWithUpdatedUser(c, updatedUser, err)
+}
+
+func (s *Server) PatchUserHandler(c *gin.Context) {
+	userId, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	contentType := c.ContentType()
+	if contentType != "application/merge-patch+json" && contentType != binding.MIMEJSON {
+		respondWithProblem(c, problemUnsupportedMediaType.problem("Content-Type must be application/merge-patch+json"))
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondWithProblem(c, problemUnreadableBody.problem("Unable to read the request body"))
+		return
+	}
+
+	patch, err := decodeUserMergePatch(body)
+	if err != nil {
+		respondWithProblem(c, bindingProblem(err, patch))
+		return
+	}
+
+	if err := binding.Validator.ValidateStruct(patch); err != nil {
+		respondWithProblem(c, bindingProblem(err, patch))
 		return
 	}
 
-	userId, err := s.Db.InsertNewUser(newUser)
-	switch err.(type) {
-	case *domain.UniqueConstraintDatabaseError:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot insert user as this email is already used"})
+	versions, ok := s.expectedVersions(c)
+	if !ok {
 		return
-	default:
-		c.JSON(http.StatusCreated, gin.H{"userId": userId})
+	}
+
+	var updatedUser domain.User
+	err = changeAtVersion(versions, func(expectedVersion *int) error {
+		var err error
+		updatedUser, err = s.Db.PatchUser(c.Request.Context(), userId, patch, expectedVersion)
+		return err
+	})
+	respondWithUpdatedUser(c, updatedUser, err)
+}
+
+// decodeUserMergePatch reads a JSON Merge Patch (RFC 7396) document. Members
+// that are not part of a user are ignored, and since every user field is
+// required a null member, which would remove it, is rejected.
+func decodeUserMergePatch(body []byte) (domain.UserPatch, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil || members == nil {
+		return domain.UserPatch{}, fmt.Errorf("merge patch must be a JSON object")
+	}
+
+	var patch domain.UserPatch
+	fields := []struct {
+		name  string
+		value **string
+	}{
+		{"username", &patch.Username},
+		{"email", &patch.Email},
+	}
+	for _, field := range fields {
+		raw, ok := members[field.name]
+		if !ok {
+			continue
+		}
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			return domain.UserPatch{}, FieldErrors{{Field: field.name, Code: "required", Message: fmt.Sprintf("%s cannot be removed", field.name)}}
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return domain.UserPatch{}, FieldErrors{{Field: field.name, Code: "type", Message: fmt.Sprintf("%s must be a string", field.name)}}
+		}
+		*field.value = &value
+	}
+
+	return patch, nil
+}
+
+func respondWithUpdatedUser(c *gin.Context, user domain.User, err error) {
+	if err != nil {
+		respondWithError(c, err)
 		return
 	}
+
+	c.Header(etagHeader, userETag(user))
+	c.JSON(http.StatusOK, user)
 }
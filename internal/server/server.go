@@ -16,23 +16,48 @@ import (
 type Server struct {
 	Port int
 	Db   database.DatabaseService
+	// ExpectedMigrationVersion is the migration the database must be at for
+	// the server to report itself ready, 0 skips the check.
+	ExpectedMigrationVersion int64
+	// QueryTimeout bounds the time a request may spend in the database, 0
+	// leaves requests bounded only by the client.
+	QueryTimeout time.Duration
+	// IdempotencyKeyTTL is how long a response to a request with an
+	// Idempotency-Key is replayed.
+	IdempotencyKeyTTL time.Duration
+	// IdempotencyKeyLease is how long an Idempotency-Key is held for a request
+	// that has not finished before a retry may claim it.
+	IdempotencyKeyLease time.Duration
+	// RequireIfMatch rejects changes to a user made without an If-Match header
+	// with 428, rather than applying them unconditionally.
+	RequireIfMatch bool
+	// TrustedProxies are the IPs or CIDR ranges whose X-Forwarded-For header
+	// is believed for the client IP. With none the remote address is used,
+	// so clients cannot put any IP they like into the audit log.
+	TrustedProxies []string
 }
 
-func New() *http.Server {
+// New returns the HTTP server for the API, backed by db. Closing db is left to
+// the caller once the server has shut down.
+func New(config environment.Config, db database.DatabaseService) *http.Server {
 
-	appPort, dbHost, dbPort, postgresUser, postgresPassword, postgresDb := environment.GetEnvVar(".env")
-
-	dataSourceName := func(user, password, dbName, port, host string) string {
-		return fmt.Sprintf("user=%s password=%s dbname=%s port=%s host=%s sslmode=disable", user, password, dbName, dbPort, host)
-	}(postgresUser, postgresPassword, postgresDb, dbPort, dbHost)
-
-	db := database.New(dataSourceName)
-	message := fmt.Sprintf("Database connection on: %v", dataSourceName)
+	message := fmt.Sprintf("Database connection on: %v", config.Database)
 	log.Println(message)
 
+	expectedMigrationVersion, err := database.LatestMigrationVersion()
+	if err != nil {
+		log.Println("Unable to read the migrations, readiness will not check the migration version:", err)
+	}
+
 	NewServer := &Server{
-		Port: appPort,
-		Db:   db,
+		Port:                     config.HTTP.Port,
+		Db:                       db,
+		ExpectedMigrationVersion: expectedMigrationVersion,
+		QueryTimeout:             config.Database.QueryTimeout,
+		IdempotencyKeyTTL:        config.HTTP.IdempotencyKeyTTL,
+		IdempotencyKeyLease:      config.HTTP.IdempotencyKeyLease,
+		RequireIfMatch:           config.HTTP.RequireIfMatch,
+		TrustedProxies:           config.HTTP.TrustedProxies,
 	}
 
 	address := fmt.Sprintf(":%d", NewServer.Port)
@@ -43,9 +68,9 @@ func New() *http.Server {
 	server := &http.Server{
 		Addr:         address,
 		Handler:      NewServer.RegisterRoutes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  config.HTTP.IdleTimeout,
+		ReadTimeout:  config.HTTP.ReadTimeout,
+		WriteTimeout: config.HTTP.WriteTimeout,
 	}
 
 	return server
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"db_access/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	mimeNDJSON = "application/x-ndjson"
+	mimeCSV    = "text/csv"
+
+	// exportFlushInterval is the number of rows written between flushes, so the
+	// client receives the export as it is read rather than all at the end.
+	exportFlushInterval = 500
+
+	maxImportBytes = 32 << 20
+	maxImportRows  = 10000
+	// importReadTimeout is how long a client has to upload an import file.
+	importReadTimeout = 5 * time.Minute
+)
+
+var userCSVHeader = []string{"id", "username", "email", "created_at", "updated_at", "deleted_at"}
+
+func formatCSVTime(value *time.Time) string {
+	if value == nil {
+		return ""
+	}
+	return value.Format(time.RFC3339Nano)
+}
+
+// ExportUsersHandler streams every user as CSV or NDJSON, reading rows from the
+// database as they are written so the export is never held in memory.
+func (s *Server) ExportUsersHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", formatCSV)
+	if format != formatCSV && format != formatNDJSON {
+		respondWithError(c, invalidParameter("format", "format must be csv or ndjson"))
+		return
+	}
+
+	includeDeleted := false
+	if value := c.Query("include_deleted"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(c, invalidParameter("include_deleted", "include_deleted must be true or false"))
+			return
+		}
+		includeDeleted = parsed
+	}
+
+	// An export takes as long as there are users to write, so it is not cut
+	// off by the server's write timeout.
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	csvWriter := csv.NewWriter(c.Writer)
+	encoder := json.NewEncoder(c.Writer)
+
+	// The status and headers are only sent with the first row, so a database
+	// that cannot be read is still reported as an error.
+	started := false
+	start := func() {
+		started = true
+		contentType := mimeCSV + "; charset=utf-8"
+		if format == formatNDJSON {
+			contentType = mimeNDJSON
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+		c.Status(http.StatusOK)
+		if format == formatCSV {
+			csvWriter.Write(userCSVHeader)
+		}
+	}
+
+	flush := func() error {
+		csvWriter.Flush()
+		c.Writer.Flush()
+		return csvWriter.Error()
+	}
+
+	written := 0
+	err := s.Db.ExportUsers(c.Request.Context(), includeDeleted, func(user domain.User) error {
+		if !started {
+			start()
+		}
+
+		if format == formatCSV {
+			csvWriter.Write([]string{
+				strconv.Itoa(user.ID),
+				user.Username,
+				user.Email,
+				formatCSVTime(user.CreatedAt),
+				formatCSVTime(user.UpdatedAt),
+				formatCSVTime(user.DeletedAt),
+			})
+		} else if err := encoder.Encode(user); err != nil {
+			return err
+		}
+
+		written++
+		if written%exportFlushInterval == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !started {
+			respondWithError(c, err)
+			return
+		}
+		// The rows already sent cannot be taken back, so the connection is
+		// closed before the response is complete for the client to see the
+		// export failed, rather than a body that looks whole.
+		log.Printf("User export stopped after %d rows: %v", written, err)
+		flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	if !started {
+		start()
+	}
+	flush()
+}
+
+// ImportError reports why the row on Line was not imported.
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportUsersResponse summarises an import. Valid counts the rows a dry run
+// found could be imported.
+type ImportUsersResponse struct {
+	DryRun  bool          `json:"dry_run"`
+	Rows    int           `json:"rows"`
+	Created int           `json:"created"`
+	Valid   int           `json:"valid"`
+	Failed  int           `json:"failed"`
+	Errors  []ImportError `json:"errors"`
+}
+
+// ImportUsersHandler creates the users in a CSV or NDJSON file uploaded in the
+// multipart field file. Every row is validated like POST /user, and those that
+// fail are listed in the response, which is a CSV error report when the client
+// accepts text/csv. With dry_run=true nothing is created.
+func (s *Server) ImportUsersHandler(c *gin.Context) {
+	dryRun := false
+	if value := c.Query("dry_run"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(c, invalidParameter("dry_run", "dry_run must be true or false"))
+			return
+		}
+		dryRun = parsed
+	}
+
+	// A large file takes longer to upload than the server's read timeout
+	// allows, so the import has a deadline of its own.
+	http.NewResponseController(c.Writer).SetReadDeadline(time.Now().Add(importReadTimeout))
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithProblem(c, problemPayloadTooLarge.problem(fmt.Sprintf("import file must not be larger than %d bytes", maxImportBytes)))
+			return
+		}
+		respondWithProblem(c, problemUnreadableBody.problem("a CSV or NDJSON file must be uploaded in the multipart field file"))
+		return
+	}
+	defer file.Close()
+
+	format := c.Query("format")
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(header.Filename)) {
+		case ".csv":
+			format = formatCSV
+		case ".ndjson", ".jsonl":
+			format = formatNDJSON
+		}
+	}
+
+	var rows []domain.UserRow
+	switch format {
+	case formatCSV:
+		rows, err = domain.ReadUsersCSV(file, maxImportRows)
+	case formatNDJSON:
+		rows, err = readNDJSONUsers(file)
+	default:
+		respondWithError(c, invalidParameter("format", "format must be csv or ndjson"))
+		return
+	}
+	if errors.Is(err, domain.ErrTooManyRows) {
+		respondWithProblem(c, problemPayloadTooLarge.problem(fmt.Sprintf("import file must not contain more than %d users", maxImportRows)))
+		return
+	}
+	if err != nil {
+		respondWithProblem(c, problemValidationFailed.problem(err.Error()))
+		return
+	}
+	if len(rows) == 0 {
+		respondWithProblem(c, problemValidationFailed.problem("import file must contain at least one user"))
+		return
+	}
+
+	var valid []domain.User
+	var positions []int
+	for i := range rows {
+		if rows[i].Err == nil {
+			rows[i].Err = validateItem(rows[i].User)
+		}
+		if rows[i].Err == nil {
+			valid = append(valid, rows[i].User)
+			positions = append(positions, i)
+		}
+	}
+
+	response := ImportUsersResponse{DryRun: dryRun, Rows: len(rows), Errors: []ImportError{}}
+
+	if len(valid) > 0 {
+		results, err := s.Db.InsertUsers(c.Request.Context(), valid, domain.BatchInsertOptions{DryRun: dryRun})
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		for j, result := range results {
+			switch result.Status {
+			case domain.BatchUserCreated:
+				response.Created++
+			case domain.BatchUserValid:
+				response.Valid++
+			default:
+				rows[positions[j]].Err = errors.New(result.Error)
+			}
+		}
+	}
+
+	for _, row := range rows {
+		if row.Err != nil {
+			response.Failed++
+			response.Errors = append(response.Errors, ImportError{Line: row.Line, Error: row.Err.Error()})
+		}
+	}
+
+	status := http.StatusCreated
+	switch {
+	case dryRun:
+		status = http.StatusOK
+	case response.Failed == len(rows):
+		status = http.StatusUnprocessableEntity
+	case response.Failed > 0:
+		status = http.StatusMultiStatus
+	}
+
+	if c.NegotiateFormat(gin.MIMEJSON, mimeCSV) == mimeCSV {
+		c.Header("Content-Type", mimeCSV+"; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="import-errors.csv"`)
+		c.Status(status)
+		writer := csv.NewWriter(c.Writer)
+		writer.Write([]string{"line", "error"})
+		for _, importError := range response.Errors {
+			writer.Write([]string{strconv.Itoa(importError.Line), importError.Error})
+		}
+		writer.Flush()
+		return
+	}
+
+	c.JSON(status, response)
+}
+
+// readNDJSONUsers reads one JSON user per line, skipping blank lines.
+func readNDJSONUsers(r io.Reader) ([]domain.UserRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	var rows []domain.UserRow
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if len(rows) == maxImportRows {
+			return nil, domain.ErrTooManyRows
+		}
+
+		row := domain.UserRow{Line: line}
+		if err := json.Unmarshal([]byte(text), &row.User); err != nil {
+			row.Err = errors.New("line is not a JSON user object")
+		}
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read the NDJSON file: %v", err)
+	}
+
+	return rows, nil
+}
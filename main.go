@@ -4,15 +4,20 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"db_access/internal/cli"
+	"db_access/internal/database"
+	"db_access/internal/environment"
 	"db_access/internal/server"
 )
 
-func gracefulShutdown(apiServer *http.Server, done chan bool) {
+func gracefulShutdown(apiServer *http.Server, db database.DatabaseService, done chan bool) {
 	// Create context that listens for the interrupt signal from the OS.
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -30,23 +35,120 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 		log.Printf("Server forced to shutdown with error: %v", err)
 	}
 
+	// Only close the database once no request can still be using it
+	db.Close()
+
 	log.Println("Server exiting")
 
 	// Notify the main goroutine that the shutdown is complete
 	done <- true
 }
 
+const usage = `usage: main [command]
+
+commands:
+  serve         run the HTTP API, the default
+  migrate       apply or inspect the database migrations
+  user          create, list, delete, restore or import users
+  verify-audit  check the audit log's hash chain for tampering`
+
 func main() {
+	command, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		command, args = os.Args[1], os.Args[2:]
+	}
+
+	config, err := environment.Load(".env")
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	slog.SetDefault(config.Log.NewLogger(os.Stderr))
+
+	switch command {
+	case "serve":
+		serve(config)
+	case "migrate":
+		err := runMigrate(config, args, os.Stdout)
+		if err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+	case "user":
+		os.Exit(runUser(config, args))
+	case "verify-audit":
+		os.Exit(runVerifyAudit(config, args))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s\n", command, usage)
+		os.Exit(cli.ExitUsage)
+	}
+}
+
+// connect opens the configured database, bounding the initial connection so
+// an unreachable database fails fast rather than hanging.
+func connect(config environment.Config) (database.DatabaseService, error) {
+	if config.Database.Driver == environment.DriverMemory {
+		return database.NewMemory(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if config.Database.Driver == environment.DriverSQLite {
+		return database.NewSQLite(ctx, config.Database.Path, []byte(config.Database.AuditHashKey))
+	}
+	return database.New(ctx, config.Database.DataSourceName(), config.Database.Pool, []byte(config.Database.AuditHashKey))
+}
+
+// runUser runs a user management command and returns its exit code.
+func runUser(config environment.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, cli.UserUsage)
+		return cli.ExitUsage
+	}
+
+	db, err := connect(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: unable to connect to the database:", err)
+		return cli.ExitDatabase
+	}
+	defer db.Close()
+
+	return cli.RunUser(context.Background(), db, args, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// runVerifyAudit verifies the audit log's hash chain and returns the exit code.
+func runVerifyAudit(config environment.Config, args []string) int {
+	db, err := connect(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: unable to connect to the database:", err)
+		return cli.ExitDatabase
+	}
+	defer db.Close()
+
+	return cli.RunVerifyAudit(context.Background(), db, args, os.Stdout, os.Stderr)
+}
+
+func serve(config environment.Config) {
+	if config.Database.MigrateOnStart {
+		err := migrateOnStart(config)
+		if err != nil {
+			log.Fatalf("unable to migrate the database: %v", err)
+		}
+	}
+
+	db, err := connect(config)
+	if err != nil {
+		log.Fatalf("unable to connect to the database: %v", err)
+	}
 
-	server := server.New()
+	server := server.New(config, db)
 
 	// Create a done channel to signal when the shutdown is complete
 	done := make(chan bool, 1)
 
 	// Run graceful shutdown in a separate goroutine
-	go gracefulShutdown(server, done)
+	go gracefulShutdown(server, db, done)
 
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		panic(fmt.Sprintf("http server error: %s", err))
 	}
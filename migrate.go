@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"text/tabwriter"
+	"time"
+
+	"db_access/internal/database"
+	"db_access/internal/environment"
+)
+
+const migrateUsage = "usage: main migrate up|down|status|redo|version"
+
+// runMigrate runs one migrate subcommand against the configured database and
+// writes its outcome to out.
+func runMigrate(config environment.Config, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+	if config.Database.Driver == environment.DriverMemory {
+		return errors.New("the memory driver has no schema to migrate")
+	}
+
+	migrator, err := newMigrator(config)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		results, err := migrator.Up(ctx)
+		for _, result := range results {
+			fmt.Fprintln(out, result)
+		}
+		if err != nil {
+			return err
+		}
+		if len(results) == 0 {
+			fmt.Fprintln(out, "no migrations to apply")
+		}
+	case "down":
+		result, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, result)
+	case "redo":
+		results, err := migrator.Redo(ctx)
+		for _, result := range results {
+			fmt.Fprintln(out, result)
+		}
+		if err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "APPLIED AT\tMIGRATION")
+		for _, status := range statuses {
+			appliedAt := "Pending"
+			if !status.AppliedAt.IsZero() {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(table, "%s\t%s\n", appliedAt, status.Source.Path)
+		}
+		return table.Flush()
+	case "version":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, version)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], migrateUsage)
+	}
+
+	return nil
+}
+
+// newMigrator returns a Migrator for the configured database.
+func newMigrator(config environment.Config) (*database.Migrator, error) {
+	if config.Database.Driver == environment.DriverSQLite {
+		return database.NewSQLiteMigrator(config.Database.Path)
+	}
+	return database.NewMigrator(config.Database.DataSourceName())
+}
+
+// migrateOnStart applies any pending migrations before the server starts. The
+// migrator's advisory lock makes concurrent replicas wait for each other.
+func migrateOnStart(config environment.Config) error {
+	if config.Database.Driver == environment.DriverMemory {
+		return nil
+	}
+
+	migrator, err := newMigrator(config)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	results, err := migrator.Up(context.Background())
+	for _, result := range results {
+		log.Println("Migration applied:", result)
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION increment_version() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.version = OLD.version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER users_increment_version
+    BEFORE UPDATE ON users
+    FOR EACH ROW
+    EXECUTE FUNCTION increment_version();
+
+-- +goose Down
+DROP TRIGGER users_increment_version ON users;
+DROP FUNCTION increment_version();
+ALTER TABLE users DROP COLUMN version;
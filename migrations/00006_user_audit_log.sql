@@ -0,0 +1,32 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS user_audit_log(
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    action VARCHAR(20) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    before JSONB,
+    after JSONB,
+    request_id VARCHAR(255),
+    client_ip VARCHAR(45),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX user_audit_log_user_id ON user_audit_log(user_id, id);
+CREATE INDEX user_audit_log_created_at ON user_audit_log(created_at);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION reject_audit_log_change() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'user_audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER user_audit_log_append_only
+    BEFORE UPDATE OR DELETE ON user_audit_log
+    FOR EACH ROW
+    EXECUTE FUNCTION reject_audit_log_change();
+
+-- +goose Down
+DROP TABLE user_audit_log;
+DROP FUNCTION reject_audit_log_change();
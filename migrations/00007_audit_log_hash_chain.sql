@@ -0,0 +1,10 @@
+-- +goose Up
+-- Entries recorded before this migration have no hash and are reported as
+-- unhashed when the chain is verified. The chain starts at the first entry
+-- written after it, whose previous_hash is null.
+ALTER TABLE user_audit_log ADD COLUMN previous_hash VARCHAR(64);
+ALTER TABLE user_audit_log ADD COLUMN hash VARCHAR(64);
+
+-- +goose Down
+ALTER TABLE user_audit_log DROP COLUMN hash;
+ALTER TABLE user_audit_log DROP COLUMN previous_hash;
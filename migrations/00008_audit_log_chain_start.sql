@@ -0,0 +1,28 @@
+-- +goose Up
+-- Records the id of the first entry that must be hashed, so verification only
+-- accepts unhashed entries written before the chain was introduced. Without it
+-- an audit log with every hash removed would verify. The table is read-only
+-- once written.
+CREATE TABLE IF NOT EXISTS user_audit_log_chain(
+    unhashed_before BIGINT NOT NULL
+);
+
+INSERT INTO user_audit_log_chain (unhashed_before)
+SELECT COALESCE(MIN(id) FILTER (WHERE hash IS NOT NULL), MAX(id) + 1, 1) FROM user_audit_log;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION reject_audit_log_chain_change() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'user_audit_log_chain is read-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER user_audit_log_chain_read_only
+    BEFORE INSERT OR UPDATE OR DELETE ON user_audit_log_chain
+    FOR EACH ROW
+    EXECUTE FUNCTION reject_audit_log_chain_change();
+
+-- +goose Down
+DROP TABLE user_audit_log_chain;
+DROP FUNCTION reject_audit_log_chain_change();
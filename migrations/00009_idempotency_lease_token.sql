@@ -0,0 +1,7 @@
+-- +goose Up
+-- Identifies the reservation of a key, so a request whose lease ran out and
+-- whose key was claimed again cannot complete or release the new reservation.
+ALTER TABLE idempotency_keys ADD COLUMN lease_token CHAR(32);
+
+-- +goose Down
+ALTER TABLE idempotency_keys DROP COLUMN lease_token;
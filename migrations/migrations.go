@@ -0,0 +1,16 @@
+// Package migrations embeds the goose SQL migrations so the binary can apply
+// them itself.
+package migrations
+
+import "embed"
+
+// FS holds the Postgres migrations.
+//
+//go:embed *.sql
+var FS embed.FS
+
+// SQLiteFS holds the SQLite migrations under sqlite/. Each has the version of
+// the Postgres migration it matches, so both schemas are at the same version.
+//
+//go:embed sqlite/*.sql
+var SQLiteFS embed.FS
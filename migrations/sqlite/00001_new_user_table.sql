@@ -0,0 +1,13 @@
+-- +goose Up
+-- Timestamps are stored as text in UTC to the microsecond, in a fixed width
+-- format so they sort as they compare. SQLite does not enforce the length of a
+-- VARCHAR, so check constraints hold the columns to the lengths Postgres does.
+CREATE TABLE IF NOT EXISTS users(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(50) NOT NULL CHECK (length(username) <= 50),
+    email VARCHAR(100) NOT NULL UNIQUE CHECK (length(email) <= 100),
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%f000Z', 'now'))
+);
+
+-- +goose Down
+DROP TABLE users;
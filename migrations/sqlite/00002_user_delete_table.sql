@@ -0,0 +1,8 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS user_deletes(
+    user_id INTEGER NOT NULL UNIQUE REFERENCES users(id),
+    deletion_date TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%f000Z', 'now'))
+);
+
+-- +goose Down
+DROP TABLE user_deletes;
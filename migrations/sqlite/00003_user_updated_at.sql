@@ -0,0 +1,8 @@
+-- +goose Up
+-- SQLite cannot give a trigger's timestamp the microseconds of the others, so
+-- updated_at is set by every statement that updates a user instead.
+ALTER TABLE users ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+UPDATE users SET updated_at = created_at;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN updated_at;
@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+    idempotency_key VARCHAR(255) PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status_code INTEGER,
+    response_body BLOB,
+    user_id INTEGER,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%f000Z', 'now')),
+    expires_at TEXT NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+-- +goose Down
+DROP TABLE idempotency_keys;
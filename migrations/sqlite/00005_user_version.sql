@@ -0,0 +1,7 @@
+-- +goose Up
+-- As with updated_at, the version is incremented by every statement that
+-- updates a user.
+ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN version;
@@ -0,0 +1,34 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS user_audit_log(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    action VARCHAR(20) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    before TEXT,
+    after TEXT,
+    request_id VARCHAR(255),
+    client_ip VARCHAR(45),
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%f000Z', 'now'))
+);
+
+CREATE INDEX user_audit_log_user_id ON user_audit_log(user_id, id);
+CREATE INDEX user_audit_log_created_at ON user_audit_log(created_at);
+
+-- +goose StatementBegin
+CREATE TRIGGER user_audit_log_append_only_update
+    BEFORE UPDATE ON user_audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'user_audit_log is append-only');
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER user_audit_log_append_only_delete
+    BEFORE DELETE ON user_audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'user_audit_log is append-only');
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TABLE user_audit_log;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE user_audit_log ADD COLUMN previous_hash VARCHAR(64);
+ALTER TABLE user_audit_log ADD COLUMN hash VARCHAR(64);
+
+-- +goose Down
+ALTER TABLE user_audit_log DROP COLUMN hash;
+ALTER TABLE user_audit_log DROP COLUMN previous_hash;
@@ -0,0 +1,34 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS user_audit_log_chain(
+    unhashed_before INTEGER NOT NULL
+);
+
+INSERT INTO user_audit_log_chain (unhashed_before)
+SELECT COALESCE((SELECT MIN(id) FROM user_audit_log WHERE hash IS NOT NULL), MAX(id) + 1, 1) FROM user_audit_log;
+
+-- +goose StatementBegin
+CREATE TRIGGER user_audit_log_chain_read_only_insert
+    BEFORE INSERT ON user_audit_log_chain
+BEGIN
+    SELECT RAISE(ABORT, 'user_audit_log_chain is read-only');
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER user_audit_log_chain_read_only_update
+    BEFORE UPDATE ON user_audit_log_chain
+BEGIN
+    SELECT RAISE(ABORT, 'user_audit_log_chain is read-only');
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER user_audit_log_chain_read_only_delete
+    BEFORE DELETE ON user_audit_log_chain
+BEGIN
+    SELECT RAISE(ABORT, 'user_audit_log_chain is read-only');
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TABLE user_audit_log_chain;
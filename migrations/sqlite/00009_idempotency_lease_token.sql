@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE idempotency_keys ADD COLUMN lease_token TEXT;
+
+-- +goose Down
+ALTER TABLE idempotency_keys DROP COLUMN lease_token;
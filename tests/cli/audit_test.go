@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"db_access/internal/cli"
+	"db_access/internal/domain"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestVerifyAuditSuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("VerifyAuditLog", mock.Anything).Return(domain.AuditVerification{Valid: true, Checked: 4, Unhashed: 1, LastHash: "abc"}, nil)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunVerifyAudit(context.Background(), service, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v, [stderr]: %v", cli.ExitOK, code, errOut.String()))
+	expected := "valid:     true\nchecked:   4\nunhashed:  1\nlast_hash: abc\n"
+	assert.Equal(t, expected, out.String(), fmt.Sprintf("Expected output to equal %v. [actual]: %v", expected, out.String()))
+}
+
+func TestVerifyAuditTamperedFailure(t *testing.T) {
+	brokenAt := int64(5)
+	service := new(testMocks.MockDBService)
+	service.On("VerifyAuditLog", mock.Anything).Return(domain.AuditVerification{Checked: 4, BrokenAt: &brokenAt, Reason: "entry has no hash", LastHash: "abc"}, nil)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunVerifyAudit(context.Background(), service, []string{"--output", "csv"}, &out, &errOut)
+
+	assert.Equal(t, cli.ExitTampered, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitTampered, code))
+	expected := "valid,checked,unhashed,broken_at,reason,last_hash\nfalse,4,0,5,entry has no hash,abc\n"
+	assert.Equal(t, expected, out.String(), fmt.Sprintf("Expected output to equal %v. [actual]: %v", expected, out.String()))
+}
+
+func TestVerifyAuditDatabaseFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("VerifyAuditLog", mock.Anything).Return(domain.AuditVerification{}, errors.New("connection reset"))
+
+	var out, errOut bytes.Buffer
+	code := cli.RunVerifyAudit(context.Background(), service, nil, &out, &errOut)
+
+	assert.NotEqual(t, cli.ExitOK, code, "Expected a failed verification to exit with an error")
+	assert.NotEqual(t, cli.ExitTampered, code, "Expected a database error not to be reported as tampering")
+	assert.Equal(t, "", out.String(), fmt.Sprintf("Expected no output. [actual]: %v", out.String()))
+}
+
+func TestVerifyAuditArgumentsFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunVerifyAudit(context.Background(), service, []string{"extra"}, &out, &errOut)
+
+	assert.Equal(t, cli.ExitUsage, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitUsage, code))
+	service.AssertNotCalled(t, "VerifyAuditLog", mock.Anything)
+}
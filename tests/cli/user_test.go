@@ -0,0 +1,292 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"db_access/internal/cli"
+	"db_access/internal/domain"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestUserCreateSuccess(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	user := domain.User{
+		Username: "New User",
+		Email:    "NewEmail@github.com",
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertNewUser", mock.Anything, user).Return(7, nil)
+	service.On("GetUserByID", mock.Anything, 7).Return(domain.User{ID: 7, Username: user.Username, Email: user.Email, CreatedAt: &createdAt, UpdatedAt: &createdAt}, nil)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"create", "--username", "New User", "--email", "NewEmail@github.com", "--output", "csv"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v, [stderr]: %v", cli.ExitOK, code, errOut.String()))
+	expected := "id,username,email,created_at,updated_at,deleted_at\n7,New User,NewEmail@github.com,2024-01-02T03:04:05Z,2024-01-02T03:04:05Z,\n"
+	assert.Equal(t, expected, out.String(), fmt.Sprintf("Expected output to equal %v. [actual]: %v", expected, out.String()))
+}
+
+func TestUserCreateInvalidEmailFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"create", "--username", "New User", "--email", "not-an-email"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitInvalid, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitInvalid, code))
+	service.AssertNotCalled(t, "InsertNewUser", mock.Anything, mock.Anything)
+}
+
+func TestUserCreateDuplicateEmailFailure(t *testing.T) {
+	user := domain.User{
+		Username: "New User",
+		Email:    "NewEmail@github.com",
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertNewUser", mock.Anything, user).Return(0, &domain.UniqueConstraintDatabaseError{Message: "duplicate key value violates unique constraint"})
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"create", "--username", "New User", "--email", "NewEmail@github.com"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitConflict, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitConflict, code))
+	expected := "error: duplicate key value violates unique constraint\n"
+	assert.Equal(t, expected, errOut.String(), fmt.Sprintf("Expected stderr to equal %v. [actual]: %v", expected, errOut.String()))
+}
+
+func TestUserListWalksEveryPageSuccess(t *testing.T) {
+	first := domain.User{ID: 1, Username: "first", Email: "first@example.com"}
+	second := domain.User{ID: 2, Username: "second", Email: "second@example.com"}
+	next := &domain.UsersCursor{Keys: []string{"1"}}
+
+	service := new(testMocks.MockDBService)
+	service.On("GetUsersPage", mock.Anything, domain.UsersQuery{EmailDomain: "example.com", Limit: 500}).Return([]domain.User{first}, next, nil)
+	service.On("GetUsersPage", mock.Anything, domain.UsersQuery{EmailDomain: "example.com", Limit: 500, After: next}).Return([]domain.User{second}, (*domain.UsersCursor)(nil), nil)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"list", "--email-domain", "example.com", "--output", "json"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v, [stderr]: %v", cli.ExitOK, code, errOut.String()))
+	expected := `[
+  {
+    "id": 1,
+    "username": "first",
+    "email": "first@example.com"
+  },
+  {
+    "id": 2,
+    "username": "second",
+    "email": "second@example.com"
+  }
+]
+`
+	assert.Equal(t, expected, out.String(), fmt.Sprintf("Expected output to equal %v. [actual]: %v", expected, out.String()))
+}
+
+func TestUserListTableSuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("GetUsersPage", mock.Anything, domain.UsersQuery{Limit: 500}).Return([]domain.User{{ID: 1, Username: "first", Email: "first@example.com"}}, (*domain.UsersCursor)(nil), nil)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"list"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v, [stderr]: %v", cli.ExitOK, code, errOut.String()))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 2, len(lines), fmt.Sprintf("Expected a header and one row. [actual]: %v", out.String()))
+	assert.True(t, strings.HasPrefix(lines[0], "ID  USERNAME  EMAIL"), fmt.Sprintf("Expected the table header first. [actual]: %v", lines[0]))
+	assert.True(t, strings.HasPrefix(lines[1], "1   first     first@example.com"), fmt.Sprintf("Expected the user's row. [actual]: %v", lines[1]))
+}
+
+func TestUserDeleteSuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("SoftDeleteUser", mock.Anything, 3, (*int)(nil)).Return(nil)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"delete", "3"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v, [stderr]: %v", cli.ExitOK, code, errOut.String()))
+	assert.Equal(t, "Deleted user 3\n", out.String(), fmt.Sprintf("Expected the deletion to be reported. [actual]: %v", out.String()))
+}
+
+func TestUserDeleteInvalidIDFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"delete", "abc"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitUsage, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitUsage, code))
+	service.AssertNotCalled(t, "SoftDeleteUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUserRestoreFlagsAfterIDSuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("RestoreUser", mock.Anything, 4, (*int)(nil)).Return(domain.User{ID: 4, Username: "back", Email: "back@example.com"}, nil)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"restore", "4", "--output", "csv"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v, [stderr]: %v", cli.ExitOK, code, errOut.String()))
+	expected := "id,username,email,created_at,updated_at,deleted_at\n4,back,back@example.com,,,\n"
+	assert.Equal(t, expected, out.String(), fmt.Sprintf("Expected output to equal %v. [actual]: %v", expected, out.String()))
+}
+
+func TestUserRestoreExitCodesFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "not found", err: &domain.UserNotFoundError{Message: "User with id 4 does not exist"}, expected: cli.ExitNotFound},
+		{name: "not deleted", err: &domain.UserNotDeletedError{Message: "User with id 4 has not been deleted"}, expected: cli.ExitConflict},
+		{name: "transaction", err: &domain.DatabaseTransactionError{Message: "connection reset"}, expected: cli.ExitDatabase},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := new(testMocks.MockDBService)
+			service.On("RestoreUser", mock.Anything, 4, (*int)(nil)).Return(domain.User{}, test.err)
+
+			var out, errOut bytes.Buffer
+			code := cli.RunUser(context.Background(), service, []string{"restore", "4"}, nil, &out, &errOut)
+
+			assert.Equal(t, test.expected, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", test.expected, code))
+			assert.Equal(t, "error: "+test.err.Error()+"\n", errOut.String(), "Expected the error to be written to stderr")
+		})
+	}
+}
+
+func TestUserImportSuccess(t *testing.T) {
+	users := []domain.User{
+		{Username: "first", Email: "first@example.com"},
+		{Username: "second", Email: "second@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+		{Index: 1, Status: domain.BatchUserCreated, ID: 2},
+	}, nil)
+
+	in := strings.NewReader("email,username\nfirst@example.com,first\nsecond@example.com,second\n")
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"import", "--output", "csv", "-"}, in, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v, [stderr]: %v", cli.ExitOK, code, errOut.String()))
+	expected := "line,id,error\n2,1,\n3,2,\n"
+	assert.Equal(t, expected, out.String(), fmt.Sprintf("Expected output to equal %v. [actual]: %v", expected, out.String()))
+	service.AssertNumberOfCalls(t, "InsertUsers", 1)
+}
+
+func TestUserImportPaddedHeaderSuccess(t *testing.T) {
+	users := []domain.User{{Username: "first", Email: "first@example.com"}}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+	}, nil)
+
+	in := strings.NewReader(" username , email\nfirst,first@example.com\n")
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"import", "--output", "csv", "-"}, in, &out, &errOut)
+
+	assert.Equal(t, cli.ExitOK, code, fmt.Sprintf("Expected the header to be read as the API reads it. [actual]: %v, [stderr]: %v", code, errOut.String()))
+	expected := "line,id,error\n2,1,\n"
+	assert.Equal(t, expected, out.String(), fmt.Sprintf("Expected output to equal %v. [actual]: %v", expected, out.String()))
+}
+
+func TestUserImportPartialFailure(t *testing.T) {
+	users := []domain.User{
+		{Username: "first", Email: "first@example.com"},
+		{Username: "dupe", Email: "first@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+		{Index: 1, Status: domain.BatchUserFailed, Error: "email is already used earlier in this batch"},
+	}, nil)
+
+	in := strings.NewReader("username,email\nfirst,first@example.com\nbad,not-an-email\ndupe,first@example.com\n")
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"import", "-", "--output", "json"}, in, &out, &errOut)
+
+	assert.Equal(t, cli.ExitInvalid, code, fmt.Sprintf("Expected the first failed row to set the exit code %v. [actual]: %v", cli.ExitInvalid, code))
+	assert.Contains(t, out.String(), `"line": 3`, "Expected the invalid row to be reported")
+	assert.Contains(t, out.String(), `"error": "email is already used earlier in this batch"`, "Expected the duplicate row to be reported")
+	service.AssertNumberOfCalls(t, "InsertUsers", 1)
+}
+
+func TestUserImportConflictFailure(t *testing.T) {
+	users := []domain.User{{Username: "taken", Email: "taken@example.com"}}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserFailed, Error: "email is already used"},
+	}, nil)
+
+	in := strings.NewReader("username,email\ntaken,taken@example.com\n")
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"import", "-"}, in, &out, &errOut)
+
+	assert.Equal(t, cli.ExitConflict, code, fmt.Sprintf("Expected a taken email to set the exit code %v. [actual]: %v", cli.ExitConflict, code))
+}
+
+func TestUserImportMissingColumnFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	in := strings.NewReader("username\nfirst\n")
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"import", "-"}, in, &out, &errOut)
+
+	assert.Equal(t, cli.ExitInvalid, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitInvalid, code))
+	service.AssertNotCalled(t, "InsertUsers", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUserUnknownCommandFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"promote"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitUsage, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitUsage, code))
+	assert.Contains(t, errOut.String(), `unknown user command "promote"`, "Expected the unknown command to be reported")
+}
+
+func TestUserInvalidOutputFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	var out, errOut bytes.Buffer
+	code := cli.RunUser(context.Background(), service, []string{"list", "--output", "xml"}, nil, &out, &errOut)
+
+	assert.Equal(t, cli.ExitUsage, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitUsage, code))
+	service.AssertNotCalled(t, "GetUsersPage", mock.Anything, mock.Anything)
+}
+
+func TestExitCodeWrappedErrorSuccess(t *testing.T) {
+	err := fmt.Errorf("deleting user 3: %w", &domain.UserDeletedError{Message: "User with id 3 has already been deleted"})
+
+	code := cli.ExitCode(err)
+
+	assert.Equal(t, cli.ExitDeleted, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitDeleted, code))
+}
+
+func TestExitCodeInvalidUserSuccess(t *testing.T) {
+	err := &domain.InvalidUserError{Message: "value too long for type character varying(50)"}
+
+	code := cli.ExitCode(err)
+
+	assert.Equal(t, cli.ExitInvalid, code, fmt.Sprintf("Expected exit code to equal %v. [actual]: %v", cli.ExitInvalid, code))
+}
@@ -0,0 +1,634 @@
+// Package contract holds the behaviour every DatabaseService implementation
+// must share. Each implementation's tests call Run with a function returning a
+// new, empty service, so the implementations cannot drift apart.
+package contract
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"db_access/internal/database"
+	"db_access/internal/domain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run runs every contract test against a new service from newService, which
+// must be empty and is closed once the test is done.
+func Run(t *testing.T, newService func(t *testing.T) database.DatabaseService) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, underTest database.DatabaseService)
+	}{
+		{"InsertNewUser", testInsertNewUser},
+		{"InsertNewUserDuplicateEmail", testInsertNewUserDuplicateEmail},
+		{"UserFieldLengths", testUserFieldLengths},
+		{"GetUserByIDNotFound", testGetUserByIDNotFound},
+		{"SoftDeleteUser", testSoftDeleteUser},
+		{"SoftDeleteUserVersion", testSoftDeleteUserVersion},
+		{"RestoreUser", testRestoreUser},
+		{"RestoreUserVersion", testRestoreUserVersion},
+		{"UpdateUser", testUpdateUser},
+		{"PatchUser", testPatchUser},
+		{"InsertUsers", testInsertUsers},
+		{"InsertUsersAtomicAndDryRun", testInsertUsersAtomicAndDryRun},
+		{"GetUsersPage", testGetUsersPage},
+		{"GetUsersPageByteOrder", testGetUsersPageByteOrder},
+		{"GetUsersPageInvalidQuery", testGetUsersPageInvalidQuery},
+		{"ExportUsers", testExportUsers},
+		{"IdempotencyKey", testIdempotencyKey},
+		{"IdempotencyKeyLease", testIdempotencyKeyLease},
+		{"IdempotencyKeyExpiredLease", testIdempotencyKeyExpiredLease},
+		{"AuditLog", testAuditLog},
+		{"CancelledContext", testCancelledContext},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			underTest := newService(t)
+			t.Cleanup(underTest.Close)
+			test.test(t, underTest)
+		})
+	}
+}
+
+func insertUser(t *testing.T, underTest database.DatabaseService, username string) int {
+	t.Helper()
+	id, err := underTest.InsertNewUser(context.Background(), domain.User{Username: username, Email: username + "@test.com"})
+	if err != nil {
+		t.Fatalf("Some error occurred inserting %s. [actual]: %v", username, err)
+	}
+	return id
+}
+
+func assertErrorAs[T error](t *testing.T, err error, message string) {
+	t.Helper()
+	var target T
+	assert.True(t, errors.As(err, &target), "%s. [actual]: %v", message, err)
+}
+
+func testInsertNewUser(t *testing.T, underTest database.DatabaseService) {
+	id := insertUser(t, underTest, "alice")
+
+	user, err := underTest.GetUserByID(context.Background(), id)
+	assert.Equal(t, nil, err, "Some error occurred getting the user. expected nil")
+	assert.Equal(t, id, user.ID, "Expected the inserted user's id")
+	assert.Equal(t, "alice", user.Username, "Expected the inserted username")
+	assert.Equal(t, "alice@test.com", user.Email, "Expected the inserted email")
+	assert.Equal(t, 1, user.Version, "Expected a new user to be at version 1")
+	assert.NotNil(t, user.CreatedAt, "Expected a new user to have a creation time")
+	assert.NotNil(t, user.UpdatedAt, "Expected a new user to have an update time")
+	assert.Nil(t, user.DeletedAt, "Expected a new user not to be deleted")
+
+	users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred getting the users. expected nil")
+	assert.Equal(t, 1, len(users), "Expected the inserted user to be listed")
+}
+
+func testInsertNewUserDuplicateEmail(t *testing.T, underTest database.DatabaseService) {
+	insertUser(t, underTest, "alice")
+
+	_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "other", Email: "alice@test.com"})
+	assertErrorAs[*domain.UniqueConstraintDatabaseError](t, err, "Expected a UniqueConstraintDatabaseError")
+}
+
+func testUserFieldLengths(t *testing.T, underTest database.DatabaseService) {
+	longUsername := strings.Repeat("é", 51)
+	longEmail := strings.Repeat("a", 92) + "@test.com"
+
+	id, err := underTest.InsertNewUser(context.Background(), domain.User{Username: strings.Repeat("é", 50), Email: strings.Repeat("a", 91) + "@test.com"})
+	assert.Equal(t, nil, err, fmt.Sprintf("Expected a username and email as long as their columns to be inserted. [actual]: %v", err))
+
+	_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: longUsername, Email: "alice@test.com"})
+	assertErrorAs[*domain.InvalidUserError](t, err, "Expected inserting a username longer than 50 characters to return an InvalidUserError")
+
+	_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: "alice", Email: longEmail})
+	assertErrorAs[*domain.InvalidUserError](t, err, "Expected inserting an email longer than 100 characters to return an InvalidUserError")
+
+	_, err = underTest.UpdateUser(context.Background(), id, domain.User{Username: longUsername, Email: "alice@test.com"}, nil)
+	assertErrorAs[*domain.InvalidUserError](t, err, "Expected updating to a username longer than 50 characters to return an InvalidUserError")
+
+	_, err = underTest.PatchUser(context.Background(), id, domain.UserPatch{Email: &longEmail}, nil)
+	assertErrorAs[*domain.InvalidUserError](t, err, "Expected patching to an email longer than 100 characters to return an InvalidUserError")
+
+	_, err = underTest.InsertUsers(context.Background(), []domain.User{{Username: "bob", Email: "bob@test.com"}, {Username: longUsername, Email: "carol@test.com"}}, domain.BatchInsertOptions{})
+	assertErrorAs[*domain.InvalidUserError](t, err, "Expected a batch with a username longer than 50 characters to return an InvalidUserError")
+
+	users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred getting the users. expected nil")
+	assert.Equal(t, 1, len(users), "Expected none of the users that were too long to be stored")
+}
+
+func testGetUserByIDNotFound(t *testing.T, underTest database.DatabaseService) {
+	_, err := underTest.GetUserByID(context.Background(), 12)
+	assertErrorAs[*domain.UserNotFoundError](t, err, "Expected a UserNotFoundError")
+	assert.Equal(t, "User with id 12 does not exist", err.Error(), "Expected the missing user's id in the message")
+}
+
+func testSoftDeleteUser(t *testing.T, underTest database.DatabaseService) {
+	id := insertUser(t, underTest, "alice")
+	otherId := insertUser(t, underTest, "bob")
+
+	err := underTest.SoftDeleteUser(context.Background(), id, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+	_, err = underTest.GetUserByID(context.Background(), id)
+	assertErrorAs[*domain.UserDeletedError](t, err, "Expected getting a deleted user to return a UserDeletedError")
+
+	users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred getting the users. expected nil")
+	assert.Equal(t, 1, len(users), "Expected the deleted user not to be listed")
+	assert.Equal(t, otherId, users[0].ID, "Expected only the active user to be listed")
+
+	err = underTest.SoftDeleteUser(context.Background(), id, nil)
+	assertErrorAs[*domain.UserDeletedError](t, err, "Expected deleting a deleted user again to return a UserDeletedError")
+
+	err = underTest.SoftDeleteUser(context.Background(), 99, nil)
+	assertErrorAs[*domain.UserNotFoundError](t, err, "Expected deleting a missing user to return a UserNotFoundError")
+
+	_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: "other", Email: "alice@test.com"})
+	assertErrorAs[*domain.UniqueConstraintDatabaseError](t, err, "Expected a deleted user to keep its email")
+
+	_, err = underTest.UpdateUser(context.Background(), id, domain.User{Username: "alice", Email: "new@test.com"}, nil)
+	assertErrorAs[*domain.UserDeletedError](t, err, "Expected updating a deleted user to return a UserDeletedError")
+}
+
+func testSoftDeleteUserVersion(t *testing.T, underTest database.DatabaseService) {
+	id := insertUser(t, underTest, "alice")
+
+	stale := 2
+	err := underTest.SoftDeleteUser(context.Background(), id, &stale)
+	assertErrorAs[*domain.PreconditionFailedError](t, err, "Expected deleting a stale version to return a PreconditionFailedError")
+
+	current := 1
+	err = underTest.SoftDeleteUser(context.Background(), id, &current)
+	assert.Equal(t, nil, err, "Some error occurred deleting the current version. expected nil")
+
+	history, err := underTest.GetUserHistory(context.Background(), id)
+	assert.Equal(t, nil, err, "Some error occurred getting the user's history. expected nil")
+	if len(history) == 2 {
+		var after domain.User
+		err = json.Unmarshal(history[1].After, &after)
+		assert.Equal(t, nil, err, "Expected after to hold the user as JSON")
+		assert.Equal(t, 2, after.Version, "Expected deleting the user to move its version on")
+	} else {
+		t.Errorf("Expected an insert and a delete in the user's history. [actual]: %v", len(history))
+	}
+}
+
+func testRestoreUser(t *testing.T, underTest database.DatabaseService) {
+	id := insertUser(t, underTest, "alice")
+
+	_, err := underTest.RestoreUser(context.Background(), id, nil)
+	assertErrorAs[*domain.UserNotDeletedError](t, err, "Expected restoring an active user to return a UserNotDeletedError")
+
+	_, err = underTest.RestoreUser(context.Background(), 99, nil)
+	assertErrorAs[*domain.UserNotFoundError](t, err, "Expected restoring a missing user to return a UserNotFoundError")
+
+	err = underTest.SoftDeleteUser(context.Background(), id, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+	restored, err := underTest.RestoreUser(context.Background(), id, nil)
+	assert.Equal(t, nil, err, "Some error occurred restoring the user. expected nil")
+	assert.Equal(t, id, restored.ID, "Expected the restored user's id")
+	assert.Equal(t, 3, restored.Version, "Expected deleting and restoring to each move the version on")
+	assert.Nil(t, restored.DeletedAt, "Expected the restored user not to be deleted")
+
+	_, err = underTest.GetUserByID(context.Background(), id)
+	assert.Equal(t, nil, err, "Expected the restored user to be found. [actual]: %v", err)
+}
+
+func testRestoreUserVersion(t *testing.T, underTest database.DatabaseService) {
+	id := insertUser(t, underTest, "alice")
+
+	current := 1
+	_, err := underTest.RestoreUser(context.Background(), id, &current)
+	assertErrorAs[*domain.UserNotDeletedError](t, err, "Expected restoring an active user at its version to return a UserNotDeletedError")
+
+	err = underTest.SoftDeleteUser(context.Background(), id, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+	_, err = underTest.RestoreUser(context.Background(), id, &current)
+	assertErrorAs[*domain.PreconditionFailedError](t, err, "Expected restoring the version from before the delete to return a PreconditionFailedError")
+
+	deleted := 2
+	restored, err := underTest.RestoreUser(context.Background(), id, &deleted)
+	assert.Equal(t, nil, err, "Some error occurred restoring the deleted version. expected nil")
+	assert.Equal(t, 3, restored.Version, "Expected restoring the user to move its version on")
+}
+
+func testUpdateUser(t *testing.T, underTest database.DatabaseService) {
+	id := insertUser(t, underTest, "alice")
+	insertUser(t, underTest, "bob")
+
+	user, err := underTest.UpdateUser(context.Background(), id, domain.User{Username: "alicia", Email: "alicia@test.com"}, nil)
+	assert.Equal(t, nil, err, "Some error occurred updating the user. expected nil")
+	assert.Equal(t, "alicia", user.Username, "Expected the updated username")
+	assert.Equal(t, "alicia@test.com", user.Email, "Expected the updated email")
+	assert.Equal(t, 2, user.Version, "Expected an update to increment the version")
+
+	stale := 1
+	_, err = underTest.UpdateUser(context.Background(), id, domain.User{Username: "alice", Email: "alice@test.com"}, &stale)
+	assertErrorAs[*domain.PreconditionFailedError](t, err, "Expected updating a stale version to return a PreconditionFailedError")
+
+	_, err = underTest.UpdateUser(context.Background(), id, domain.User{Username: "alicia", Email: "bob@test.com"}, nil)
+	assertErrorAs[*domain.UniqueConstraintDatabaseError](t, err, "Expected taking another user's email to return a UniqueConstraintDatabaseError")
+
+	_, err = underTest.UpdateUser(context.Background(), 99, domain.User{Username: "nobody", Email: "nobody@test.com"}, nil)
+	assertErrorAs[*domain.UserNotFoundError](t, err, "Expected updating a missing user to return a UserNotFoundError")
+
+	_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: "other", Email: "alice@test.com"})
+	assert.Equal(t, nil, err, "Expected an email given up by an update to be free. [actual]: %v", err)
+}
+
+func testPatchUser(t *testing.T, underTest database.DatabaseService) {
+	id := insertUser(t, underTest, "alice")
+
+	username := "alicia"
+	user, err := underTest.PatchUser(context.Background(), id, domain.UserPatch{Username: &username}, nil)
+	assert.Equal(t, nil, err, "Some error occurred patching the user. expected nil")
+	assert.Equal(t, "alicia", user.Username, "Expected the patched username")
+	assert.Equal(t, "alice@test.com", user.Email, "Expected the email to be left unchanged")
+	assert.Equal(t, 2, user.Version, "Expected a patch to increment the version")
+
+	version := 2
+	user, err = underTest.PatchUser(context.Background(), id, domain.UserPatch{}, &version)
+	assert.Equal(t, nil, err, "Some error occurred patching the user. expected nil")
+	assert.Equal(t, 3, user.Version, "Expected an empty patch to still increment the version")
+}
+
+func testInsertUsers(t *testing.T, underTest database.DatabaseService) {
+	insertUser(t, underTest, "alice")
+
+	users := []domain.User{
+		{Username: "bob", Email: "bob@test.com"},
+		{Username: "alice", Email: "alice@test.com"},
+		{Username: "carol", Email: "carol@test.com"},
+		{Username: "bob again", Email: "bob@test.com"},
+	}
+	results, err := underTest.InsertUsers(context.Background(), users, domain.BatchInsertOptions{})
+	assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+	if len(results) != len(users) {
+		t.Fatalf("Expected a result for every user. [actual]: %v", results)
+	}
+
+	expected := []struct {
+		status string
+		error  string
+	}{
+		{domain.BatchUserCreated, ""},
+		{domain.BatchUserFailed, "email is already used"},
+		{domain.BatchUserCreated, ""},
+		{domain.BatchUserFailed, "email is already used earlier in this batch"},
+	}
+	for i, result := range results {
+		assert.Equal(t, i, result.Index, "Expected results in the order of the users")
+		assert.Equal(t, expected[i].status, result.Status, "Expected the status of user %d", i)
+		assert.Equal(t, expected[i].error, result.Error, "Expected the error of user %d", i)
+	}
+
+	user, err := underTest.GetUserByID(context.Background(), results[2].ID)
+	assert.Equal(t, nil, err, "Some error occurred getting a created user. expected nil")
+	assert.Equal(t, "carol", user.Username, "Expected the created user's id to be reported")
+}
+
+func testInsertUsersAtomicAndDryRun(t *testing.T, underTest database.DatabaseService) {
+	insertUser(t, underTest, "alice")
+
+	users := []domain.User{
+		{Username: "bob", Email: "bob@test.com"},
+		{Username: "alice", Email: "alice@test.com"},
+	}
+	results, err := underTest.InsertUsers(context.Background(), users, domain.BatchInsertOptions{Atomic: true})
+	assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+	assert.Equal(t, domain.BatchUserRolledBack, results[0].Status, "Expected the valid user to be rolled back")
+	assert.Equal(t, 0, results[0].ID, "Expected a rolled back user to have no id")
+	assert.Equal(t, domain.BatchUserFailed, results[1].Status, "Expected the duplicate email to fail")
+
+	results, err = underTest.InsertUsers(context.Background(), users[:1], domain.BatchInsertOptions{DryRun: true})
+	assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+	assert.Equal(t, domain.BatchUserValid, results[0].Status, "Expected a dry run to report the user as valid")
+
+	all, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred getting the users. expected nil")
+	assert.Equal(t, 1, len(all), "Expected neither an atomic failure nor a dry run to insert anything")
+}
+
+func testGetUsersPage(t *testing.T, underTest database.DatabaseService) {
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		insertUser(t, underTest, username)
+	}
+	_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "frank", Email: "frank@Example.org"})
+	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+	deletedId := insertUser(t, underTest, "bella")
+	err = underTest.SoftDeleteUser(context.Background(), deletedId, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+	query := domain.UsersQuery{Sort: []domain.SortField{{Field: "username", Descending: true}}, Limit: 2}
+	var usernames []string
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("Expected the pages to end")
+		}
+		users, cursor, err := underTest.GetUsersPage(context.Background(), query)
+		assert.Equal(t, nil, err, "Some error occurred getting a page of users. expected nil")
+		for _, user := range users {
+			usernames = append(usernames, user.Username)
+		}
+		if cursor == nil {
+			break
+		}
+		query.After = cursor
+	}
+	assert.Equal(t, []string{"frank", "erin", "dave", "carol", "bob", "alice"}, usernames, "Expected every active user once, in username order descending")
+
+	users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{UsernamePrefix: "b", IncludeDeleted: true, Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred getting a page of users. expected nil")
+	if len(users) != 2 {
+		t.Fatalf("Expected the users whose username starts with b, deleted or not. [actual]: %v", users)
+	}
+	assert.Equal(t, "bob", users[0].Username, "Expected users in id order by default")
+	assert.Nil(t, users[0].DeletedAt, "Expected an active user to have no deletion time")
+	assert.NotNil(t, users[1].DeletedAt, "Expected a deleted user to have its deletion time")
+
+	users, _, err = underTest.GetUsersPage(context.Background(), domain.UsersQuery{EmailDomain: "example.ORG", Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred getting a page of users. expected nil")
+	if len(users) != 1 {
+		t.Fatalf("Expected the email domain to match case insensitively. [actual]: %v", users)
+	}
+	assert.Equal(t, "frank", users[0].Username, "Expected the user with the email domain")
+}
+
+func testGetUsersPageByteOrder(t *testing.T, underTest database.DatabaseService) {
+	for _, username := range []string{"alice", "Zoe", "bob", "Carl"} {
+		insertUser(t, underTest, username)
+	}
+
+	query := domain.UsersQuery{Sort: []domain.SortField{{Field: "username"}}, Limit: 1}
+	var usernames []string
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("Expected the pages to end")
+		}
+		users, cursor, err := underTest.GetUsersPage(context.Background(), query)
+		assert.Equal(t, nil, err, "Some error occurred getting a page of users. expected nil")
+		for _, user := range users {
+			usernames = append(usernames, user.Username)
+		}
+		if cursor == nil {
+			break
+		}
+		query.After = cursor
+	}
+	assert.Equal(t, []string{"Carl", "Zoe", "alice", "bob"}, usernames, "Expected usernames in byte order, upper case first")
+}
+
+func testGetUsersPageInvalidQuery(t *testing.T, underTest database.DatabaseService) {
+	insertUser(t, underTest, "alice")
+
+	tests := []struct {
+		name              string
+		query             domain.UsersQuery
+		expectedParameter string
+	}{
+		{"unknown sort field", domain.UsersQuery{Sort: []domain.SortField{{Field: "password"}}, Limit: 10}, "sort"},
+		{"repeated sort field", domain.UsersQuery{Sort: []domain.SortField{{Field: "email"}, {Field: "email"}}, Limit: 10}, "sort"},
+		{"cursor for another sort", domain.UsersQuery{After: &domain.UsersCursor{Keys: []string{"alice", "1"}}, Limit: 10}, "cursor"},
+		{"malformed cursor", domain.UsersQuery{After: &domain.UsersCursor{Keys: []string{"one"}}, Limit: 10}, "cursor"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := underTest.GetUsersPage(context.Background(), test.query)
+			var invalidQuery *domain.InvalidQueryError
+			if !errors.As(err, &invalidQuery) {
+				t.Fatalf("Expected an InvalidQueryError. [actual]: %v", err)
+			}
+			assert.Equal(t, test.expectedParameter, invalidQuery.Parameter, "Expected the parameter at fault")
+		})
+	}
+}
+
+func testExportUsers(t *testing.T, underTest database.DatabaseService) {
+	insertUser(t, underTest, "alice")
+	deletedId := insertUser(t, underTest, "bob")
+	insertUser(t, underTest, "carol")
+	err := underTest.SoftDeleteUser(context.Background(), deletedId, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+	export := func(includeDeleted bool) []string {
+		var usernames []string
+		err := underTest.ExportUsers(context.Background(), includeDeleted, func(user domain.User) error {
+			usernames = append(usernames, user.Username)
+			return nil
+		})
+		assert.Equal(t, nil, err, "Some error occurred exporting the users. expected nil")
+		return usernames
+	}
+
+	assert.Equal(t, []string{"alice", "carol"}, export(false), "Expected only active users to be exported, in id order")
+	assert.Equal(t, []string{"alice", "bob", "carol"}, export(true), "Expected deleted users to be exported when asked for")
+
+	stop := errors.New("stop")
+	calls := 0
+	err = underTest.ExportUsers(context.Background(), true, func(domain.User) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err, "Expected the error from yield to be returned as is")
+	assert.Equal(t, 1, calls, "Expected an error from yield to stop the export")
+}
+
+func testIdempotencyKey(t *testing.T, underTest database.DatabaseService) {
+	ctx := context.Background()
+
+	held, reserved, err := underTest.ReserveIdempotencyKey(ctx, "key-1", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected an unused key to be reserved")
+	assert.NotEmpty(t, held.LeaseToken, "Expected the request holding the key to be given a lease token")
+
+	record, reserved, err := underTest.ReserveIdempotencyKey(ctx, "key-1", "hash-2", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.False(t, reserved, "Expected a key in use not to be reserved again")
+	assert.Equal(t, "hash-1", record.RequestHash, "Expected the hash of the request holding the key")
+	assert.Equal(t, 0, record.StatusCode, "Expected a key in progress to have no stored response")
+	assert.Empty(t, record.LeaseToken, "Expected the lease token only to be given to the request holding the key")
+
+	userId := 7
+	err = underTest.CompleteIdempotencyKey(ctx, "key-1", held.LeaseToken, 201, []byte(`{"userId":7}`), &userId, time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred completing the key. expected nil")
+
+	record, reserved, err = underTest.ReserveIdempotencyKey(ctx, "key-1", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.False(t, reserved, "Expected a completed key not to be reserved again")
+	assert.Equal(t, 201, record.StatusCode, "Expected the stored status code")
+	assert.Equal(t, `{"userId":7}`, string(record.Body), "Expected the stored response body")
+	assert.Equal(t, &userId, record.UserID, "Expected the stored user id")
+
+	err = underTest.CompleteIdempotencyKey(ctx, "key-1", held.LeaseToken, 409, []byte(`{}`), nil, time.Hour)
+	assertErrorAs[*domain.IdempotencyLeaseLostError](t, err, "Expected a completed key not to be completed again")
+	err = underTest.ReleaseIdempotencyKey(ctx, "key-1", held.LeaseToken)
+	assertErrorAs[*domain.IdempotencyLeaseLostError](t, err, "Expected a completed key not to be released")
+
+	held, _, err = underTest.ReserveIdempotencyKey(ctx, "key-2", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	err = underTest.ReleaseIdempotencyKey(ctx, "key-2", held.LeaseToken)
+	assert.Equal(t, nil, err, "Some error occurred releasing the key. expected nil")
+
+	_, reserved, err = underTest.ReserveIdempotencyKey(ctx, "key-2", "hash-2", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected a released key to be reserved again")
+
+	held, reserved, err = underTest.ReserveIdempotencyKey(ctx, "key-3", "hash-1", time.Millisecond)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected an unused key to be reserved")
+	err = underTest.CompleteIdempotencyKey(ctx, "key-3", held.LeaseToken, 201, []byte(`{"userId":8}`), nil, time.Millisecond)
+	assert.Equal(t, nil, err, "Some error occurred completing the key. expected nil")
+	time.Sleep(10 * time.Millisecond)
+
+	_, reserved, err = underTest.ReserveIdempotencyKey(ctx, "key-3", "hash-2", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected a key whose response has expired to be reserved again")
+}
+
+// testIdempotencyKeyLease checks a key reserved by a request that never
+// finished is freed once its lease runs out, while a completed key is kept
+// for its ttl however short the lease was.
+func testIdempotencyKeyLease(t *testing.T, underTest database.DatabaseService) {
+	ctx := context.Background()
+
+	_, reserved, err := underTest.ReserveIdempotencyKey(ctx, "stale", "hash-1", time.Millisecond)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected an unused key to be reserved")
+
+	held, reserved, err := underTest.ReserveIdempotencyKey(ctx, "completed", "hash-1", time.Millisecond)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected an unused key to be reserved")
+	err = underTest.CompleteIdempotencyKey(ctx, "completed", held.LeaseToken, 201, []byte(`{"userId":7}`), nil, time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred completing the key. expected nil")
+
+	time.Sleep(10 * time.Millisecond)
+
+	_, reserved, err = underTest.ReserveIdempotencyKey(ctx, "stale", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected a retry to claim a key whose lease ran out before its request finished")
+
+	record, reserved, err := underTest.ReserveIdempotencyKey(ctx, "completed", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.False(t, reserved, "Expected a completed key to outlive its lease")
+	assert.Equal(t, 201, record.StatusCode, "Expected the stored status code to be replayed")
+}
+
+// testIdempotencyKeyExpiredLease checks a request that outlived its lease,
+// once a retry has claimed the key, can neither overwrite the retry's response
+// nor release the retry's reservation.
+func testIdempotencyKeyExpiredLease(t *testing.T, underTest database.DatabaseService) {
+	ctx := context.Background()
+
+	slow, reserved, err := underTest.ReserveIdempotencyKey(ctx, "key-1", "hash-1", time.Millisecond)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected an unused key to be reserved")
+
+	time.Sleep(10 * time.Millisecond)
+
+	retry, reserved, err := underTest.ReserveIdempotencyKey(ctx, "key-1", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected a retry to claim a key whose lease ran out")
+	assert.NotEqual(t, slow.LeaseToken, retry.LeaseToken, "Expected the retry to be given a new lease token")
+
+	err = underTest.ReleaseIdempotencyKey(ctx, "key-1", slow.LeaseToken)
+	assertErrorAs[*domain.IdempotencyLeaseLostError](t, err, "Expected the slow request not to release the retry's reservation")
+
+	record, reserved, err := underTest.ReserveIdempotencyKey(ctx, "key-1", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.False(t, reserved, "Expected the retry to still hold the key")
+	assert.Equal(t, 0, record.StatusCode, "Expected the retry to still be in progress")
+
+	userId := 8
+	err = underTest.CompleteIdempotencyKey(ctx, "key-1", retry.LeaseToken, 201, []byte(`{"userId":8}`), &userId, time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred completing the key. expected nil")
+
+	err = underTest.CompleteIdempotencyKey(ctx, "key-1", slow.LeaseToken, 201, []byte(`{"userId":7}`), nil, time.Hour)
+	assertErrorAs[*domain.IdempotencyLeaseLostError](t, err, "Expected the slow request not to overwrite the retry's response")
+
+	record, _, err = underTest.ReserveIdempotencyKey(ctx, "key-1", "hash-1", time.Hour)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.Equal(t, `{"userId":8}`, string(record.Body), "Expected the retry's response to be replayed")
+	assert.Equal(t, &userId, record.UserID, "Expected the retry's user id to be replayed")
+}
+
+func testAuditLog(t *testing.T, underTest database.DatabaseService) {
+	ctx := domain.WithAuditContext(context.Background(), domain.AuditContext{Actor: "admin", RequestID: "request-1", ClientIP: "10.0.0.1"})
+
+	id, err := underTest.InsertNewUser(ctx, domain.User{Username: "alice", Email: "alice@test.com"})
+	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+	_, err = underTest.UpdateUser(ctx, id, domain.User{Username: "alicia", Email: "alice@test.com"}, nil)
+	assert.Equal(t, nil, err, "Some error occurred updating the user. expected nil")
+	err = underTest.SoftDeleteUser(ctx, id, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+	_, err = underTest.RestoreUser(ctx, id, nil)
+	assert.Equal(t, nil, err, "Some error occurred restoring the user. expected nil")
+	insertUser(t, underTest, "bob")
+
+	history, err := underTest.GetUserHistory(context.Background(), id)
+	assert.Equal(t, nil, err, "Some error occurred getting the user's history. expected nil")
+	var actions []string
+	for _, entry := range history {
+		actions = append(actions, entry.Action)
+		assert.Equal(t, "admin", entry.Actor, "Expected the actor of the AuditContext")
+		assert.Equal(t, "request-1", entry.RequestID, "Expected the request id of the AuditContext")
+		assert.Equal(t, "10.0.0.1", entry.ClientIP, "Expected the client ip of the AuditContext")
+	}
+	assert.Equal(t, []string{domain.AuditActionInsert, domain.AuditActionUpdate, domain.AuditActionDelete, domain.AuditActionRestore}, actions, "Expected every change to the user, oldest first")
+	if len(history) == 4 {
+		assert.Equal(t, "null", string(history[0].Before), "Expected an insert to have no before")
+		var after domain.User
+		err = json.Unmarshal(history[1].After, &after)
+		assert.Equal(t, nil, err, "Expected after to hold the user as JSON")
+		assert.Equal(t, "alicia", after.Username, "Expected after to hold the updated user")
+		assert.Equal(t, 2, after.Version, "Expected after to hold the updated version")
+	}
+
+	_, err = underTest.GetUserHistory(context.Background(), 99)
+	assertErrorAs[*domain.UserNotFoundError](t, err, "Expected the history of a missing user to return a UserNotFoundError")
+
+	entries, next, err := underTest.GetAuditLog(context.Background(), domain.AuditQuery{Limit: 3})
+	assert.Equal(t, nil, err, "Some error occurred getting the audit log. expected nil")
+	assert.Equal(t, 3, len(entries), "Expected a full page of entries")
+	if next == nil {
+		t.Fatal("Expected a cursor to the next page")
+	}
+	entries, next, err = underTest.GetAuditLog(context.Background(), domain.AuditQuery{AfterID: *next, Limit: 3})
+	assert.Equal(t, nil, err, "Some error occurred getting the audit log. expected nil")
+	assert.Equal(t, 2, len(entries), "Expected the rest of the entries")
+	assert.Nil(t, next, "Expected the last page to have no cursor")
+
+	entries, _, err = underTest.GetAuditLog(context.Background(), domain.AuditQuery{Actor: unknownActor, Limit: 10})
+	assert.Equal(t, nil, err, "Some error occurred getting the audit log. expected nil")
+	assert.Equal(t, 1, len(entries), "Expected changes made without an AuditContext to be filtered by their actor")
+
+	verification, err := underTest.VerifyAuditLog(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+	assert.True(t, verification.Valid, fmt.Sprintf("Expected the audit log to verify. [actual]: %+v", verification))
+	assert.Equal(t, int64(5), verification.Checked, "Expected every entry to be checked")
+	assert.Equal(t, 64, len(verification.LastHash), "Expected the hex encoded SHA-256 hash of the last entry")
+}
+
+// unknownActor is recorded against changes made without an AuditContext.
+const unknownActor = "unknown"
+
+func testCancelledContext(t *testing.T, underTest database.DatabaseService) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := underTest.GetUserByID(ctx, 1)
+	assert.True(t, errors.Is(err, context.Canceled), "Expected a cancelled context to fail the call. [actual]: %v", err)
+
+	_, err = underTest.InsertNewUser(ctx, domain.User{Username: "alice", Email: "alice@test.com"})
+	assert.True(t, errors.Is(err, context.Canceled), "Expected a cancelled context to fail the call. [actual]: %v", err)
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"db_access/internal/database"
+	"db_access/internal/domain"
+	"db_access/tests/contract"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryContract(t *testing.T) {
+	contract.Run(t, func(t *testing.T) database.DatabaseService {
+		return database.NewMemory()
+	})
+}
+
+func TestMemoryConcurrentInsertsSuccess(t *testing.T) {
+	underTest := database.NewMemory()
+	t.Cleanup(underTest.Close)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "user", Email: fmt.Sprintf("user%d@test.com", i%10)})
+			if err != nil {
+				assert.IsType(t, &domain.UniqueConstraintDatabaseError{}, err, "Expected only unique constraint errors. [actual]: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 100})
+	assert.Equal(t, nil, err, "Some error occurred getting the users. expected nil")
+	assert.Equal(t, 10, len(users), "Expected one user for every distinct email")
+
+	verification, err := underTest.VerifyAuditLog(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+	assert.Equal(t, true, verification.Valid, "Expected concurrent inserts to keep the audit log chained")
+	assert.Equal(t, int64(10), verification.Checked, "Expected an audit entry for every user inserted")
+}
+
+func TestMemoryHealthSuccess(t *testing.T) {
+	underTest := database.NewMemory()
+	t.Cleanup(underTest.Close)
+
+	latest, err := database.LatestMigrationVersion()
+	assert.Equal(t, nil, err, "Some error occurred reading the embedded migrations. expected nil")
+
+	health := underTest.Health(context.Background())
+	assert.Equal(t, "up", health.Status, "Expected the memory database to always be up")
+	assert.Equal(t, latest, health.MigrationVersion, "Expected the memory database to report the latest migration, so the server is ready")
+}
@@ -0,0 +1,15 @@
+package database
+
+import (
+	"testing"
+
+	"db_access/internal/database"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatestMigrationVersionSuccess(t *testing.T) {
+	version, err := database.LatestMigrationVersion()
+	assert.Equal(t, nil, err, "Some error occurred reading the embedded migrations. expected nil")
+	assert.Equal(t, int64(9), version, "Expected the latest embedded migration to be 00009_idempotency_lease_token.sql")
+}
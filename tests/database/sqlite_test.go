@@ -0,0 +1,279 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"db_access/internal/database"
+	"db_access/internal/domain"
+	"db_access/tests/contract"
+
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+)
+
+// newSQLite returns a service backed by a migrated SQLite database in a
+// temporary directory, along with the database's path.
+func newSQLite(t *testing.T) (database.DatabaseService, string) {
+	path := filepath.Join(t.TempDir(), "db_access.sqlite")
+
+	migrator, err := database.NewSQLiteMigrator(path)
+	if err != nil {
+		t.Fatalf("Unable to create the migrator: %v", err)
+	}
+	_, err = migrator.Up(context.Background())
+	migrator.Close()
+	if err != nil {
+		t.Fatalf("Unable to apply the migrations: %v", err)
+	}
+
+	db, err := database.NewSQLite(context.Background(), path, nil)
+	if err != nil {
+		t.Fatalf("Unable to open the database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	return db, path
+}
+
+func TestSQLiteContract(t *testing.T) {
+	contract.Run(t, func(t *testing.T) database.DatabaseService {
+		db, _ := newSQLite(t)
+		return db
+	})
+}
+
+func TestSQLiteMigratorUpDownSuccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_access.sqlite")
+
+	underTest, err := database.NewSQLiteMigrator(path)
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred creating the migrator. expected nil [actual]: %v", err))
+	t.Cleanup(func() { underTest.Close() })
+
+	latest, err := database.LatestMigrationVersion()
+	assert.Equal(t, nil, err, "Some error occurred reading the embedded migrations. expected nil")
+
+	results, err := underTest.Up(context.Background())
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred applying the migrations. expected nil [actual]: %v", err))
+	assert.Equal(t, int(latest), len(results), "Expected the SQLite migrations to mirror every Postgres migration")
+
+	version, err := underTest.Version(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred reading the version. expected nil")
+	assert.Equal(t, latest, version, "Expected the SQLite schema to reach the latest migration version")
+
+	for range latest {
+		_, err := underTest.Down(context.Background())
+		assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred rolling back a migration. expected nil [actual]: %v", err))
+	}
+
+	version, err = underTest.Version(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred reading the version. expected nil")
+	assert.Equal(t, int64(0), version, "Expected every migration to be rolled back")
+}
+
+func TestSQLiteHealthSuccess(t *testing.T) {
+	underTest, _ := newSQLite(t)
+
+	latest, err := database.LatestMigrationVersion()
+	assert.Equal(t, nil, err, "Some error occurred reading the embedded migrations. expected nil")
+
+	health := underTest.Health(context.Background())
+	assert.Equal(t, "up", health.Status, fmt.Sprintf("Expected the database to be up [actual]: %s", health.Error))
+	assert.Equal(t, latest, health.MigrationVersion, "Expected the database to report the latest migration")
+}
+
+func TestSQLiteHealthUnmigratedSuccess(t *testing.T) {
+	underTest, err := database.NewSQLite(context.Background(), filepath.Join(t.TempDir(), "db_access.sqlite"), nil)
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred opening the database. expected nil [actual]: %v", err))
+	t.Cleanup(underTest.Close)
+
+	health := underTest.Health(context.Background())
+	assert.Equal(t, "up", health.Status, fmt.Sprintf("Expected the database to be up [actual]: %s", health.Error))
+	assert.Equal(t, int64(0), health.MigrationVersion, "Expected an unmigrated database to report version 0")
+}
+
+func TestSQLiteSoftDeleteUserTwiceFailure(t *testing.T) {
+	underTest, _ := newSQLite(t)
+
+	id, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "user", Email: "user@test.com"})
+	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+	err = underTest.SoftDeleteUser(context.Background(), id, nil)
+	assert.Equal(t, nil, err, "Some error occurred deleting the user. expected nil")
+
+	err = underTest.SoftDeleteUser(context.Background(), id, nil)
+	assert.IsType(t, &domain.UserDeletedError{}, err, fmt.Sprintf("Expected the unique user_deletes violation to map to UserDeletedError [actual]: %v", err))
+}
+
+func TestSQLiteSoftDeleteUserNotFoundFailure(t *testing.T) {
+	underTest, _ := newSQLite(t)
+
+	err := underTest.SoftDeleteUser(context.Background(), 42, nil)
+	assert.IsType(t, &domain.UserNotFoundError{}, err, fmt.Sprintf("Expected the foreign key violation to map to UserNotFoundError [actual]: %v", err))
+}
+
+func TestSQLiteAuditLogAppendOnlyFailure(t *testing.T) {
+	underTest, path := newSQLite(t)
+
+	_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "user", Email: "user@test.com"})
+	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+	db, err := sql.Open("sqlite", path)
+	assert.Equal(t, nil, err, "Some error occurred opening the database. expected nil")
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec("UPDATE user_audit_log SET actor = 'someone else'")
+	assert.ErrorContains(t, err, "user_audit_log is append-only", "Expected the audit log to reject updates")
+
+	_, err = db.Exec("DELETE FROM user_audit_log")
+	assert.ErrorContains(t, err, "user_audit_log is append-only", "Expected the audit log to reject deletes")
+}
+
+func TestSQLiteConcurrentInsertsSuccess(t *testing.T) {
+	underTest, _ := newSQLite(t)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "user", Email: fmt.Sprintf("user%d@test.com", i%10)})
+			if err != nil {
+				assert.IsType(t, &domain.UniqueConstraintDatabaseError{}, err, "Expected only unique constraint errors. [actual]: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	users, _, err := underTest.GetUsersPage(context.Background(), domain.UsersQuery{Limit: 100})
+	assert.Equal(t, nil, err, "Some error occurred getting the users. expected nil")
+	assert.Equal(t, 10, len(users), "Expected one user for every distinct email")
+
+	verification, err := underTest.VerifyAuditLog(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+	assert.Equal(t, true, verification.Valid, "Expected concurrent inserts to keep the audit log chained")
+	assert.Equal(t, int64(10), verification.Checked, "Expected an audit entry for every user inserted")
+}
+
+// tamperSQLite runs statement against the audit log at path with its
+// append-only triggers dropped, as someone with direct access to the database
+// file could.
+func tamperSQLite(t *testing.T, path string, statement string) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Unable to open the database: %v", err)
+	}
+	defer db.Close()
+
+	for _, step := range []string{
+		"DROP TRIGGER user_audit_log_append_only_update",
+		"DROP TRIGGER user_audit_log_append_only_delete",
+		statement,
+	} {
+		_, err = db.Exec(step)
+		if err != nil {
+			t.Fatalf("Unable to tamper with the audit log: %v", err)
+		}
+	}
+}
+
+func TestSQLiteVerifyAuditLogStrippedHashesFailure(t *testing.T) {
+	underTest, path := newSQLite(t)
+
+	for i := range 3 {
+		_, err := underTest.InsertNewUser(context.Background(), domain.User{Username: "user", Email: fmt.Sprintf("user%d@test.com", i)})
+		assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+	}
+
+	tamperSQLite(t, path, "UPDATE user_audit_log SET previous_hash = NULL, hash = NULL")
+
+	verification, err := underTest.VerifyAuditLog(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+	assert.False(t, verification.Valid, fmt.Sprintf("Expected an audit log with every hash removed not to verify. [actual]: %+v", verification))
+	if verification.BrokenAt == nil {
+		t.Fatal("Expected the broken entry to be reported")
+	}
+	assert.Equal(t, int64(1), *verification.BrokenAt, "Expected the first entry written after the chain was introduced to be reported")
+	assert.Equal(t, "entry has no hash", verification.Reason, "Expected the reason the entry does not verify")
+}
+
+func TestSQLiteVerifyAuditLogUnhashedBeforeChainSuccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_access.sqlite")
+
+	migrator, err := database.NewSQLiteMigrator(path)
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred creating the migrator. expected nil [actual]: %v", err))
+	t.Cleanup(func() { migrator.Close() })
+
+	_, err = migrator.Up(context.Background())
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred applying the migrations. expected nil [actual]: %v", err))
+	for range 2 {
+		_, err = migrator.Down(context.Background())
+		assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred rolling back to before the hash chain. expected nil [actual]: %v", err))
+	}
+
+	db, err := sql.Open("sqlite", path)
+	assert.Equal(t, nil, err, "Some error occurred opening the database. expected nil")
+	_, err = db.Exec(`INSERT INTO users (username, email) VALUES ('old', 'old@test.com');
+		INSERT INTO user_audit_log (user_id, action, actor) VALUES (1, 'insert', 'admin'), (1, 'update', 'admin')`)
+	db.Close()
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred recording the entries from before the chain. expected nil [actual]: %v", err))
+
+	_, err = migrator.Up(context.Background())
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred applying the hash chain migrations. expected nil [actual]: %v", err))
+
+	underTest, err := database.NewSQLite(context.Background(), path, nil)
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred opening the database. expected nil [actual]: %v", err))
+	t.Cleanup(underTest.Close)
+
+	_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: "new", Email: "new@test.com"})
+	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+	verification, err := underTest.VerifyAuditLog(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+	assert.True(t, verification.Valid, fmt.Sprintf("Expected entries from before the chain to be allowed without a hash. [actual]: %+v", verification))
+	assert.Equal(t, int64(2), verification.Unhashed, "Expected the entries from before the chain to be counted as unhashed")
+	assert.Equal(t, int64(1), verification.Checked, "Expected the entry written after the chain to be checked")
+}
+
+func TestSQLiteAuditLogChainReadOnlyFailure(t *testing.T) {
+	_, path := newSQLite(t)
+
+	db, err := sql.Open("sqlite", path)
+	assert.Equal(t, nil, err, "Some error occurred opening the database. expected nil")
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec("UPDATE user_audit_log_chain SET unhashed_before = 1000")
+	assert.ErrorContains(t, err, "user_audit_log_chain is read-only", "Expected the start of the chain not to be movable")
+
+	_, err = db.Exec("DELETE FROM user_audit_log_chain")
+	assert.ErrorContains(t, err, "user_audit_log_chain is read-only", "Expected the start of the chain not to be removable")
+}
+
+func TestSQLiteVerifyAuditLogHashKeySuccess(t *testing.T) {
+	_, path := newSQLite(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	underTest, err := database.NewSQLite(context.Background(), path, key)
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred opening the database. expected nil [actual]: %v", err))
+	t.Cleanup(underTest.Close)
+
+	_, err = underTest.InsertNewUser(context.Background(), domain.User{Username: "user", Email: "user@test.com"})
+	assert.Equal(t, nil, err, "Some error occurred inserting the user. expected nil")
+
+	verification, err := underTest.VerifyAuditLog(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+	assert.True(t, verification.Valid, fmt.Sprintf("Expected the log to verify with the key it was hashed with. [actual]: %+v", verification))
+
+	unkeyed, err := database.NewSQLite(context.Background(), path, nil)
+	assert.Equal(t, nil, err, fmt.Sprintf("Some error occurred opening the database. expected nil [actual]: %v", err))
+	t.Cleanup(unkeyed.Close)
+
+	verification, err = unkeyed.VerifyAuditLog(context.Background())
+	assert.Equal(t, nil, err, "Some error occurred verifying the audit log. expected nil")
+	assert.False(t, verification.Valid, "Expected the keyed hashes not to be reproducible without the key")
+	assert.Equal(t, "hash does not match the content of the entry", verification.Reason, "Expected the reason the entry does not verify")
+}
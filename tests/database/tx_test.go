@@ -0,0 +1,210 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"db_access/internal/database"
+	"db_access/internal/domain"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newMockTx(commitErr error) *testMocks.MockTx {
+	tx := new(testMocks.MockTx)
+	tx.On("Commit", mock.Anything).Return(commitErr)
+	tx.On("Rollback", mock.Anything).Return(nil)
+	return tx
+}
+
+func TestWithTxCommitSuccess(t *testing.T) {
+	tx := newMockTx(nil)
+	options := pgx.TxOptions{IsoLevel: pgx.Serializable}
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, options).Return(tx, nil)
+
+	calls := 0
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{TxOptions: options}, func(pgx.Tx) error {
+		calls++
+		return nil
+	})
+
+	assert.Equal(t, nil, err, "Some error occurred running the transaction. expected nil")
+	assert.Equal(t, 1, calls, "Expected the function to run once. [actual]: %v", calls)
+	beginner.AssertExpectations(t)
+	tx.AssertCalled(t, "Commit", mock.Anything)
+	tx.AssertNotCalled(t, "Rollback", mock.Anything)
+}
+
+func TestWithTxRollbackFailure(t *testing.T) {
+	tx := newMockTx(nil)
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+	expectedErr := &domain.UserNotFoundError{Message: "User with id 12 does not exist"}
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{}, func(pgx.Tx) error {
+		return expectedErr
+	})
+
+	assert.Equal(t, expectedErr, err, "Expected the function's error to be returned as is. [actual]: %v", err)
+	tx.AssertCalled(t, "Rollback", mock.Anything)
+	tx.AssertNotCalled(t, "Commit", mock.Anything)
+	beginner.AssertNumberOfCalls(t, "BeginTx", 1)
+}
+
+func TestWithTxErrRollbackSuccess(t *testing.T) {
+	tx := newMockTx(nil)
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{}, func(pgx.Tx) error {
+		return database.ErrRollback
+	})
+
+	assert.Equal(t, nil, err, "Expected ErrRollback not to be returned. [actual]: %v", err)
+	tx.AssertCalled(t, "Rollback", mock.Anything)
+	tx.AssertNotCalled(t, "Commit", mock.Anything)
+}
+
+func TestWithTxPanicFailure(t *testing.T) {
+	tx := newMockTx(nil)
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+	assert.PanicsWithValue(t, "boom", func() {
+		database.WithTx(context.Background(), beginner, database.TxOptions{}, func(pgx.Tx) error {
+			panic("boom")
+		})
+	}, "Expected the panic to carry on once the transaction is rolled back")
+	tx.AssertCalled(t, "Rollback", mock.Anything)
+	tx.AssertNotCalled(t, "Commit", mock.Anything)
+}
+
+func TestWithTxBeginFailure(t *testing.T) {
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(nil, errors.New("connection refused"))
+
+	calls := 0
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{}, func(pgx.Tx) error {
+		calls++
+		return nil
+	})
+
+	var transactionErr *domain.DatabaseTransactionError
+	assert.True(t, errors.As(err, &transactionErr), "Expected a DatabaseTransactionError. [actual]: %v", err)
+	assert.Equal(t, 0, calls, "Expected the function not to run. [actual]: %v", calls)
+}
+
+func TestWithTxCommitFailure(t *testing.T) {
+	tx := newMockTx(errors.New("connection reset"))
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{}, func(pgx.Tx) error {
+		return nil
+	})
+
+	var transactionErr *domain.DatabaseTransactionError
+	assert.True(t, errors.As(err, &transactionErr), "Expected a DatabaseTransactionError. [actual]: %v", err)
+	beginner.AssertNumberOfCalls(t, "BeginTx", 1)
+}
+
+func TestWithTxRetrySuccess(t *testing.T) {
+	for _, code := range []string{"40001", "40P01"} {
+		t.Run(code, func(t *testing.T) {
+			tx := newMockTx(nil)
+			beginner := new(testMocks.MockTxBeginner)
+			beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+			calls := 0
+			err := database.WithTx(context.Background(), beginner, database.TxOptions{Backoff: time.Microsecond}, func(pgx.Tx) error {
+				calls++
+				if calls < 3 {
+					return &domain.UnmappedDatabaseError{Message: "could not serialize access", Err: &pgconn.PgError{Code: code}}
+				}
+				return nil
+			})
+
+			assert.Equal(t, nil, err, "Some error occurred running the transaction. expected nil")
+			assert.Equal(t, 3, calls, "Expected the function to run until it succeeded. [actual]: %v", calls)
+			beginner.AssertNumberOfCalls(t, "BeginTx", 3)
+			tx.AssertNumberOfCalls(t, "Rollback", 2)
+			tx.AssertNumberOfCalls(t, "Commit", 1)
+		})
+	}
+}
+
+func TestWithTxRetryCommitSuccess(t *testing.T) {
+	failing := newMockTx(&pgconn.PgError{Code: "40001"})
+	tx := newMockTx(nil)
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(failing, nil).Once()
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil).Once()
+
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{Backoff: time.Microsecond}, func(pgx.Tx) error {
+		return nil
+	})
+
+	assert.Equal(t, nil, err, "Some error occurred running the transaction. expected nil")
+	beginner.AssertExpectations(t)
+	tx.AssertCalled(t, "Commit", mock.Anything)
+}
+
+func TestWithTxRetryExhaustedFailure(t *testing.T) {
+	tx := newMockTx(nil)
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+	expectedErr := &domain.UnmappedDatabaseError{Message: "deadlock detected", Err: &pgconn.PgError{Code: "40P01"}}
+	calls := 0
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{MaxAttempts: 2, Backoff: time.Microsecond}, func(pgx.Tx) error {
+		calls++
+		return expectedErr
+	})
+
+	var transactionErr *domain.DatabaseTransactionError
+	assert.True(t, errors.As(err, &transactionErr), "Expected a DatabaseTransactionError. [actual]: %v", err)
+	assert.True(t, errors.Is(err, expectedErr), "Expected the error to wrap the last error. [actual]: %v", err)
+	assert.Equal(t, 2, calls, "Expected the function to run MaxAttempts times. [actual]: %v", calls)
+}
+
+func TestWithTxNoRetryFailure(t *testing.T) {
+	tx := newMockTx(nil)
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+	calls := 0
+	err := database.WithTx(context.Background(), beginner, database.TxOptions{Backoff: time.Microsecond}, func(pgx.Tx) error {
+		calls++
+		return &domain.UniqueConstraintDatabaseError{Message: "duplicate key", Err: &pgconn.PgError{Code: "23505"}}
+	})
+
+	var uniqueErr *domain.UniqueConstraintDatabaseError
+	assert.True(t, errors.As(err, &uniqueErr), "Expected a UniqueConstraintDatabaseError. [actual]: %v", err)
+	assert.Equal(t, 1, calls, "Expected the function not to be retried. [actual]: %v", calls)
+}
+
+func TestWithTxRetryCancelledFailure(t *testing.T) {
+	tx := newMockTx(nil)
+	beginner := new(testMocks.MockTxBeginner)
+	beginner.On("BeginTx", mock.Anything, mock.Anything).Return(tx, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := database.WithTx(ctx, beginner, database.TxOptions{Backoff: time.Hour}, func(pgx.Tx) error {
+		calls++
+		cancel()
+		return &pgconn.PgError{Code: "40001"}
+	})
+
+	var transactionErr *domain.DatabaseTransactionError
+	assert.True(t, errors.As(err, &transactionErr), "Expected a DatabaseTransactionError. [actual]: %v", err)
+	assert.True(t, errors.Is(err, context.Canceled), "Expected the error to wrap context.Canceled. [actual]: %v", err)
+	assert.Equal(t, 1, calls, "Expected the backoff to stop at cancellation. [actual]: %v", calls)
+}
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"db_access/internal/domain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadUsersCSVSuccess(t *testing.T) {
+	in := strings.NewReader(" email , username\nfirst@example.com,first\nshort\n")
+
+	rows, err := domain.ReadUsersCSV(in, 0)
+
+	assert.NoError(t, err, fmt.Sprintf("Expected no error reading the CSV. [actual]: %v", err))
+	assert.Len(t, rows, 2, fmt.Sprintf("Expected 2 rows. [actual]: %v", rows))
+	expected := domain.User{Username: "first", Email: "first@example.com"}
+	assert.Equal(t, expected, rows[0].User, fmt.Sprintf("Expected the first row to equal %v. [actual]: %v", expected, rows[0].User))
+	assert.Equal(t, 2, rows[0].Line, fmt.Sprintf("Expected the first row to start on line 2. [actual]: %v", rows[0].Line))
+	assert.Error(t, rows[1].Err, "Expected the short row to carry an error")
+	assert.Equal(t, 3, rows[1].Line, fmt.Sprintf("Expected the short row to start on line 3. [actual]: %v", rows[1].Line))
+}
+
+func TestReadUsersCSVMissingColumnFailure(t *testing.T) {
+	_, err := domain.ReadUsersCSV(strings.NewReader("username\nfirst\n"), 0)
+
+	assert.Error(t, err, "Expected a header without an email column to fail")
+}
+
+func TestReadUsersCSVTooManyRowsFailure(t *testing.T) {
+	in := strings.NewReader("username,email\na,a@example.com\nb,b@example.com\n")
+
+	_, err := domain.ReadUsersCSV(in, 1)
+
+	assert.True(t, errors.Is(err, domain.ErrTooManyRows), fmt.Sprintf("Expected ErrTooManyRows. [actual]: %v", err))
+}
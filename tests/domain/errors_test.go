@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"db_access/internal/domain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorsUnwrapSuccess(t *testing.T) {
+	cause := context.DeadlineExceeded
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "unique constraint", err: &domain.UniqueConstraintDatabaseError{Message: "duplicate", Err: cause}},
+		{name: "unmapped", err: &domain.UnmappedDatabaseError{Message: "unmapped", Err: cause}},
+		{name: "transaction", err: &domain.DatabaseTransactionError{Message: "transaction", Err: cause}},
+		{name: "not found", err: &domain.UserNotFoundError{Message: "not found", Err: cause}},
+		{name: "deleted", err: &domain.UserDeletedError{Message: "deleted", Err: cause}},
+		{name: "not deleted", err: &domain.UserNotDeletedError{Message: "not deleted", Err: cause}},
+		{name: "precondition failed", err: &domain.PreconditionFailedError{Message: "stale", Err: cause}},
+		{name: "idempotency lease lost", err: &domain.IdempotencyLeaseLostError{Message: "lease lost", Err: cause}},
+		{name: "invalid query", err: &domain.InvalidQueryError{Parameter: "cursor", Message: "invalid cursor", Err: cause}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.True(t, errors.Is(test.err, cause), fmt.Sprintf("Expected errors.Is to find the cause of %v", test.err))
+			assert.Equal(t, cause, errors.Unwrap(test.err), "Expected Unwrap to return the cause")
+		})
+	}
+}
+
+func TestErrorsAsThroughWrappingSuccess(t *testing.T) {
+	err := fmt.Errorf("deleting user 3: %w", &domain.UserNotFoundError{Message: "User with id 3 does not exist"})
+
+	var notFoundError *domain.UserNotFoundError
+	assert.True(t, errors.As(err, &notFoundError), "Expected errors.As to find the UserNotFoundError")
+	assert.Equal(t, "User with id 3 does not exist", notFoundError.Message, "Expected the message to be kept")
+	assert.Equal(t, nil, errors.Unwrap(notFoundError), "Expected an error without a cause to unwrap to nil")
+}
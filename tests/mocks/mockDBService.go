@@ -1,7 +1,9 @@
 package tests
 
 import (
+	"context"
 	"db_access/internal/domain"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -10,24 +12,97 @@ type MockDBService struct {
 	mock.Mock
 }
 
-func (ms *MockDBService) Health() map[string]string {
+func (ms *MockDBService) Health(ctx context.Context) domain.DatabaseHealth {
+	args := ms.Called(ctx)
+	return args.Get(0).(domain.DatabaseHealth)
+}
+
+func (ms *MockDBService) PoolStats() domain.PoolStats {
 	args := ms.Called()
-	response := map[string]string{
-		"key1": args.String(0),
-	}
-	return response
+	return args.Get(0).(domain.PoolStats)
+}
+
+func (ms *MockDBService) Close() {
+	ms.Called()
 }
-func (ms *MockDBService) InsertNewUser(user domain.User) (int, error) {
-	args := ms.Called(user)
+
+func (ms *MockDBService) InsertNewUser(ctx context.Context, user domain.User) (int, error) {
+	args := ms.Called(ctx, user)
 	return args.Int(0), args.Error(1)
 }
 
-func (ms *MockDBService) GetAllUsers() ([]domain.User, error) {
-	args := ms.Called()
-	return args.Get(0).([]domain.User), args.Error(1)
+func (ms *MockDBService) InsertUsers(ctx context.Context, users []domain.User, options domain.BatchInsertOptions) ([]domain.BatchUserResult, error) {
+	args := ms.Called(ctx, users, options)
+	return args.Get(0).([]domain.BatchUserResult), args.Error(1)
 }
 
-func (ms *MockDBService) SoftDeleteUser(userId int) error {
-	args := ms.Called()
+// ExportUsers yields the users given to Return before returning its error.
+func (ms *MockDBService) ExportUsers(ctx context.Context, includeDeleted bool, yield func(domain.User) error) error {
+	args := ms.Called(ctx, includeDeleted, yield)
+	for _, user := range args.Get(0).([]domain.User) {
+		if err := yield(user); err != nil {
+			return err
+		}
+	}
+	return args.Error(1)
+}
+
+func (ms *MockDBService) ReserveIdempotencyKey(ctx context.Context, key string, requestHash string, lease time.Duration) (domain.IdempotencyRecord, bool, error) {
+	args := ms.Called(ctx, key, requestHash, lease)
+	return args.Get(0).(domain.IdempotencyRecord), args.Bool(1), args.Error(2)
+}
+
+func (ms *MockDBService) CompleteIdempotencyKey(ctx context.Context, key string, leaseToken string, statusCode int, body []byte, userId *int, ttl time.Duration) error {
+	args := ms.Called(ctx, key, leaseToken, statusCode, body, userId, ttl)
 	return args.Error(0)
 }
+
+func (ms *MockDBService) ReleaseIdempotencyKey(ctx context.Context, key string, leaseToken string) error {
+	args := ms.Called(ctx, key, leaseToken)
+	return args.Error(0)
+}
+
+func (ms *MockDBService) GetUsersPage(ctx context.Context, query domain.UsersQuery) ([]domain.User, *domain.UsersCursor, error) {
+	args := ms.Called(ctx, query)
+	return args.Get(0).([]domain.User), args.Get(1).(*domain.UsersCursor), args.Error(2)
+}
+
+func (ms *MockDBService) GetUserHistory(ctx context.Context, userId int) ([]domain.AuditEntry, error) {
+	args := ms.Called(ctx, userId)
+	return args.Get(0).([]domain.AuditEntry), args.Error(1)
+}
+
+func (ms *MockDBService) GetAuditLog(ctx context.Context, query domain.AuditQuery) ([]domain.AuditEntry, *int64, error) {
+	args := ms.Called(ctx, query)
+	return args.Get(0).([]domain.AuditEntry), args.Get(1).(*int64), args.Error(2)
+}
+
+func (ms *MockDBService) VerifyAuditLog(ctx context.Context) (domain.AuditVerification, error) {
+	args := ms.Called(ctx)
+	return args.Get(0).(domain.AuditVerification), args.Error(1)
+}
+
+func (ms *MockDBService) GetUserByID(ctx context.Context, userId int) (domain.User, error) {
+	args := ms.Called(ctx, userId)
+	return args.Get(0).(domain.User), args.Error(1)
+}
+
+func (ms *MockDBService) UpdateUser(ctx context.Context, userId int, user domain.User, expectedVersion *int) (domain.User, error) {
+	args := ms.Called(ctx, userId, user, expectedVersion)
+	return args.Get(0).(domain.User), args.Error(1)
+}
+
+func (ms *MockDBService) PatchUser(ctx context.Context, userId int, patch domain.UserPatch, expectedVersion *int) (domain.User, error) {
+	args := ms.Called(ctx, userId, patch, expectedVersion)
+	return args.Get(0).(domain.User), args.Error(1)
+}
+
+func (ms *MockDBService) SoftDeleteUser(ctx context.Context, userId int, expectedVersion *int) error {
+	args := ms.Called(ctx, userId, expectedVersion)
+	return args.Error(0)
+}
+
+func (ms *MockDBService) RestoreUser(ctx context.Context, userId int, expectedVersion *int) (domain.User, error) {
+	args := ms.Called(ctx, userId, expectedVersion)
+	return args.Get(0).(domain.User), args.Error(1)
+}
@@ -0,0 +1,35 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockTxBeginner struct {
+	mock.Mock
+}
+
+func (mb *MockTxBeginner) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	args := mb.Called(ctx, txOptions)
+	tx, _ := args.Get(0).(pgx.Tx)
+	return tx, args.Error(1)
+}
+
+// MockTx mocks the end of a transaction. The remaining methods of pgx.Tx are
+// left to the embedded nil interface and panic if called.
+type MockTx struct {
+	pgx.Tx
+	mock.Mock
+}
+
+func (mt *MockTx) Commit(ctx context.Context) error {
+	args := mt.Called(ctx)
+	return args.Error(0)
+}
+
+func (mt *MockTx) Rollback(ctx context.Context) error {
+	args := mt.Called(ctx)
+	return args.Error(0)
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"db_access/internal/domain"
+
+	sv "db_access/internal/server"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAuditContextMiddlewareSuccess(t *testing.T) {
+	s := &sv.Server{}
+	r := gin.New()
+	r.Use(s.AuditContextMiddleware)
+
+	var audit domain.AuditContext
+	r.GET("/", func(c *gin.Context) {
+		audit = domain.AuditContextFrom(c.Request.Context())
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Actor", "admin@example.com")
+	req.Header.Set("X-Request-ID", "request-1")
+	req.RemoteAddr = "192.0.2.10:1234"
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	expected := domain.AuditContext{Actor: "admin@example.com", RequestID: "request-1", ClientIP: "192.0.2.10"}
+	assert.Equal(t, expected, audit, fmt.Sprintf("Expected the audit context to equal %v. [actual]: %v", expected, audit))
+	assert.Equal(t, "request-1", rr.Header().Get("X-Request-ID"), "Expected the request id to be echoed back")
+}
+
+func TestAuditContextMiddlewareDefaultsSuccess(t *testing.T) {
+	s := &sv.Server{}
+	r := gin.New()
+	r.Use(s.AuditContextMiddleware)
+
+	var audit domain.AuditContext
+	r.GET("/", func(c *gin.Context) {
+		audit = domain.AuditContextFrom(c.Request.Context())
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, "anonymous", audit.Actor, fmt.Sprintf("Expected a request without X-Actor to be anonymous. [actual]: %v", audit.Actor))
+	assert.Equal(t, 32, len(audit.RequestID), fmt.Sprintf("Expected a request id to be generated. [actual]: %v", audit.RequestID))
+	assert.Equal(t, audit.RequestID, rr.Header().Get("X-Request-ID"), "Expected the generated request id to be returned")
+}
+
+func TestAuditContextReachesDatabaseSuccess(t *testing.T) {
+	hasAuditContext := mock.MatchedBy(func(ctx context.Context) bool {
+		return domain.AuditContextFrom(ctx).Actor == "admin@example.com"
+	})
+
+	service := new(testMocks.MockDBService)
+	service.On("SoftDeleteUser", hasAuditContext, 3, (*int)(nil)).Return(nil)
+
+	s := &sv.Server{Db: service}
+	r := gin.New()
+	r.Use(s.AuditContextMiddleware)
+	r.DELETE("/user/:userId", s.DeleteUserHandler)
+
+	req, _ := http.NewRequest("DELETE", "/user/3", nil)
+	req.Header.Set("X-Actor", "admin@example.com")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusNoContent
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	service.AssertCalled(t, "SoftDeleteUser", hasAuditContext, 3, (*int)(nil))
+}
+
+func TestAuditContextIgnoresSpoofedForwardedForSuccess(t *testing.T) {
+	hasClientIP := mock.MatchedBy(func(ctx context.Context) bool {
+		return domain.AuditContextFrom(ctx).ClientIP == "192.0.2.10"
+	})
+
+	service := new(testMocks.MockDBService)
+	service.On("SoftDeleteUser", hasClientIP, 3, (*int)(nil)).Return(nil)
+
+	s := &sv.Server{Db: service}
+	handler := s.RegisterRoutes()
+
+	req, _ := http.NewRequest("DELETE", "/user/3", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.RemoteAddr = "192.0.2.10:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusNoContent
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected X-Forwarded-For from an untrusted client to be ignored for the client ip. [actual]: %v", rr.Code))
+	service.AssertCalled(t, "SoftDeleteUser", hasClientIP, 3, (*int)(nil))
+}
+
+func TestAuditContextTrustedProxyForwardedForSuccess(t *testing.T) {
+	hasClientIP := mock.MatchedBy(func(ctx context.Context) bool {
+		return domain.AuditContextFrom(ctx).ClientIP == "203.0.113.7"
+	})
+
+	service := new(testMocks.MockDBService)
+	service.On("SoftDeleteUser", hasClientIP, 3, (*int)(nil)).Return(nil)
+
+	s := &sv.Server{Db: service, TrustedProxies: []string{"192.0.2.0/24"}}
+	handler := s.RegisterRoutes()
+
+	req, _ := http.NewRequest("DELETE", "/user/3", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.RemoteAddr = "192.0.2.10:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusNoContent
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected X-Forwarded-For from a trusted proxy to set the client ip. [actual]: %v", rr.Code))
+	service.AssertCalled(t, "SoftDeleteUser", hasClientIP, 3, (*int)(nil))
+}
+
+func TestGetUserHistoryHandlerSuccess(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []domain.AuditEntry{
+		{ID: 1, UserID: 3, Action: "insert", Actor: "admin", Before: json.RawMessage("null"), After: json.RawMessage(`{"id":3}`), RequestID: "request-1", ClientIP: "192.0.2.10", CreatedAt: createdAt},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("GetUserHistory", mock.Anything, 3).Return(entries, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/user/3/history", nil, nil)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"entries":[{"id":1,"user_id":3,"action":"insert","actor":"admin","before":null,"after":{"id":3},"request_id":"request-1","client_ip":"192.0.2.10","created_at":"2024-01-02T03:04:05Z"}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetUserHistoryHandlerUserNotFoundFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("GetUserHistory", mock.Anything, 12).Return([]domain.AuditEntry(nil), &domain.UserNotFoundError{Message: "User with id 12 does not exist"})
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/user/12/history", nil, nil)
+
+	expectedStatusCode := http.StatusNotFound
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:user_not_found","title":"User not found","status":404,"detail":"User with id 12 does not exist","code":"user_not_found"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetAuditLogHandlerFiltersSuccess(t *testing.T) {
+	createdAfter := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := domain.AuditQuery{
+		UserID:       3,
+		Actor:        "admin",
+		Action:       "delete",
+		RequestID:    "request-1",
+		CreatedAfter: &createdAfter,
+		Limit:        2,
+	}
+	next := int64(8)
+
+	service := new(testMocks.MockDBService)
+	service.On("GetAuditLog", mock.Anything, query).Return([]domain.AuditEntry{}, &next, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/audit?user_id=3&actor=admin&action=delete&request_id=request-1&created_after=2024-01-01&limit=2", nil, nil)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+
+	var page domain.AuditPage
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	if page.NextCursor == nil {
+		t.Fatal("Expected a cursor for the next page")
+	}
+
+	query.AfterID = next
+	service.On("GetAuditLog", mock.Anything, query).Return([]domain.AuditEntry{}, (*int64)(nil), nil)
+
+	rr = serve(&sv.Server{Db: service}, "GET", "/audit?user_id=3&actor=admin&action=delete&request_id=request-1&created_after=2024-01-01&limit=2&cursor="+*page.NextCursor, nil, nil)
+
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"entries":[],"next_cursor":null}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertCalled(t, "GetAuditLog", mock.Anything, query)
+}
+
+func TestGetAuditLogHandlerInvalidQueryFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		expected string
+	}{
+		{name: "action", target: "/audit?action=create", expected: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid action. Must be one of insert, update, delete or restore","code":"invalid_parameter","parameter":"action"}`},
+		{name: "user id", target: "/audit?user_id=abc", expected: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid user_id. Must be a positive integer","code":"invalid_parameter","parameter":"user_id"}`},
+		{name: "cursor", target: "/audit?cursor=not-a-cursor", expected: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid cursor","code":"invalid_parameter","parameter":"cursor"}`},
+		{name: "created_after", target: "/audit?created_after=yesterday", expected: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid created_after. Must be an RFC 3339 timestamp or a YYYY-MM-DD date","code":"invalid_parameter","parameter":"created_after"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := new(testMocks.MockDBService)
+
+			rr := serve(&sv.Server{Db: service}, "GET", test.target, nil, nil)
+
+			expectedStatusCode := http.StatusBadRequest
+			assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+			assert.Equal(t, test.expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", test.expected, rr.Body.String()))
+			service.AssertNotCalled(t, "GetAuditLog", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestGetAuditLogHandlerDatabaseFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("GetAuditLog", mock.Anything, mock.Anything).Return([]domain.AuditEntry(nil), (*int64)(nil), errors.New("connection reset"))
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/audit", nil, nil)
+
+	expectedStatusCode := http.StatusInternalServerError
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:internal_error","title":"Internal server error","status":500,"detail":"The request could not be completed","code":"internal_error"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestVerifyAuditLogHandlerSuccess(t *testing.T) {
+	lastHash := strings.Repeat("a", 64)
+	service := new(testMocks.MockDBService)
+	service.On("VerifyAuditLog", mock.Anything).Return(domain.AuditVerification{Valid: true, Checked: 3, LastHash: lastHash}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/admin/audit/verify", nil, nil)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"valid":true,"checked":3,"unhashed":0,"last_hash":"` + lastHash + `"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestVerifyAuditLogHandlerBrokenFailure(t *testing.T) {
+	brokenAt := int64(2)
+	service := new(testMocks.MockDBService)
+	service.On("VerifyAuditLog", mock.Anything).Return(domain.AuditVerification{Checked: 1, BrokenAt: &brokenAt, Reason: "hash does not match the content of the entry", LastHash: "abc"}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/admin/audit/verify", nil, nil)
+
+	expectedStatusCode := http.StatusConflict
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"valid":false,"checked":1,"unhashed":0,"broken_at":2,"reason":"hash does not match the content of the entry","last_hash":"abc"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestVerifyAuditLogHandlerDatabaseFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("VerifyAuditLog", mock.Anything).Return(domain.AuditVerification{}, errors.New("connection reset"))
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/admin/audit/verify", nil, nil)
+
+	expectedStatusCode := http.StatusInternalServerError
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:internal_error","title":"Internal server error","status":500,"detail":"The request could not be completed","code":"internal_error"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
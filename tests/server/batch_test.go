@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"db_access/internal/domain"
+
+	sv "db_access/internal/server"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestInsertUsersBatchSuccess(t *testing.T) {
+	users := []domain.User{
+		{Username: "first", Email: "first@example.com"},
+		{Username: "second", Email: "second@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{Atomic: false}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+		{Index: 1, Status: domain.BatchUserCreated, ID: 2},
+	}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/batch", strings.NewReader(`[{"username":"first","email":"first@example.com"},{"username":"second","email":"second@example.com"}]`), nil)
+
+	expectedStatusCode := http.StatusCreated
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"atomic":false,"created":2,"failed":0,"results":[{"index":0,"status":"created","id":1},{"index":1,"status":"created","id":2}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestInsertUsersBatchPartialFailure(t *testing.T) {
+	valid := []domain.User{
+		{Username: "first", Email: "first@example.com"},
+		{Username: "taken", Email: "taken@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, valid, domain.BatchInsertOptions{Atomic: false}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+		{Index: 1, Status: domain.BatchUserFailed, Error: "email is already used"},
+	}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/batch?atomic=false", strings.NewReader(`[{"username":"first","email":"first@example.com"},{"username":"bad","email":"not-an-email"},{"username":"taken","email":"taken@example.com"}]`), nil)
+
+	expectedStatusCode := http.StatusMultiStatus
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"atomic":false,"created":1,"failed":2,"results":[{"index":0,"status":"created","id":1},{"index":1,"status":"failed","error":"email must be a valid email address"},{"index":2,"status":"failed","error":"email is already used"}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected every user to be reported at its index. [actual]: %v", rr.Body.String()))
+}
+
+func TestInsertUsersBatchAtomicConflictFailure(t *testing.T) {
+	users := []domain.User{
+		{Username: "first", Email: "first@example.com"},
+		{Username: "again", Email: "first@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{Atomic: true}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserRolledBack},
+		{Index: 1, Status: domain.BatchUserFailed, Error: "email is already used earlier in this batch"},
+	}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/batch?atomic=true", strings.NewReader(`[{"username":"first","email":"first@example.com"},{"username":"again","email":"first@example.com"}]`), nil)
+
+	expectedStatusCode := http.StatusConflict
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"atomic":true,"created":0,"failed":1,"results":[{"index":0,"status":"rolled_back"},{"index":1,"status":"failed","error":"email is already used earlier in this batch"}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestInsertUsersBatchAtomicInvalidUserFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/batch?atomic=true", strings.NewReader(`[{"username":"first","email":"first@example.com"},{"email":"nameless@example.com"}]`), nil)
+
+	expectedStatusCode := http.StatusUnprocessableEntity
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	assert.True(t, strings.HasPrefix(rr.Body.String(), `{"atomic":true,"created":0,"failed":1,"results":[{"index":0,"status":"rolled_back"},{"index":1,"status":"failed"`), fmt.Sprintf("Expected nothing to be created. [actual]: %v", rr.Body.String()))
+	service.AssertNotCalled(t, "InsertUsers", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestInsertUsersBatchInvalidBodyFailure(t *testing.T) {
+	tests := []struct {
+		name               string
+		target             string
+		body               string
+		expectedStatusCode int
+		expected           string
+	}{
+		{name: "not an array", target: "/users/batch", body: `{"username":"first"}`, expectedStatusCode: http.StatusUnprocessableEntity, expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"batch must be a JSON array of users","code":"validation_failed"}`},
+		{name: "empty", target: "/users/batch", body: `[]`, expectedStatusCode: http.StatusUnprocessableEntity, expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"batch must contain at least one user","code":"validation_failed"}`},
+		{name: "invalid atomic", target: "/users/batch?atomic=maybe", body: `[]`, expectedStatusCode: http.StatusBadRequest, expected: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"atomic must be true or false","code":"invalid_parameter","parameter":"atomic"}`},
+		{name: "too many users", target: "/users/batch", body: "[" + strings.Repeat(`{"username":"a","email":"a@example.com"},`, 1000) + `{"username":"a","email":"a@example.com"}]`, expectedStatusCode: http.StatusRequestEntityTooLarge, expected: `{"type":"urn:problem-type:payload_too_large","title":"Request too large","status":413,"detail":"batch must not contain more than 1000 users","code":"payload_too_large"}`},
+		{name: "too many bytes", target: "/users/batch", body: `[{"username":"a","email":"a@example.com","padding":"` + strings.Repeat("a", 1<<20) + `"}]`, expectedStatusCode: http.StatusRequestEntityTooLarge, expected: `{"type":"urn:problem-type:payload_too_large","title":"Request too large","status":413,"detail":"batch must not be larger than 1048576 bytes","code":"payload_too_large"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := new(testMocks.MockDBService)
+
+			rr := serve(&sv.Server{Db: service}, "POST", test.target, strings.NewReader(test.body), nil)
+
+			assert.Equal(t, test.expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", test.expectedStatusCode, rr.Code))
+			assert.Equal(t, test.expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", test.expected, rr.Body.String()))
+			service.AssertNotCalled(t, "InsertUsers", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestInsertUsersBatchDatabaseFailure(t *testing.T) {
+	users := []domain.User{{Username: "first", Email: "first@example.com"}}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{Atomic: false}).Return([]domain.BatchUserResult(nil), errors.New("connection reset"))
+
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/batch", strings.NewReader(`[{"username":"first","email":"first@example.com"}]`), nil)
+
+	expectedStatusCode := http.StatusInternalServerError
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:internal_error","title":"Internal server error","status":500,"detail":"The request could not be completed","code":"internal_error"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
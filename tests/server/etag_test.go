@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"db_access/internal/domain"
+
+	sv "db_access/internal/server"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestGetUserByIDHandlerETagSuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("GetUserByID", mock.Anything, 3).Return(domain.User{ID: 3, Username: "user", Email: "user@email.com", Version: 4}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/user/3", nil, nil)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `"4"`
+	assert.Equal(t, expected, rr.Header().Get("ETag"), fmt.Sprintf("Expected the ETag to equal %v. [actual]: %v", expected, rr.Header().Get("ETag")))
+}
+
+func TestGetUserByIDHandlerIfNoneMatchNotModifiedSuccess(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+	}{
+		{name: "strong tag", ifNoneMatch: `"4"`},
+		{name: "weak tag", ifNoneMatch: `W/"4"`},
+		{name: "list", ifNoneMatch: `"2", "4"`},
+		{name: "any", ifNoneMatch: `*`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := new(testMocks.MockDBService)
+			service.On("GetUserByID", mock.Anything, 3).Return(domain.User{ID: 3, Username: "user", Email: "user@email.com", Version: 4}, nil)
+
+			rr := serve(&sv.Server{Db: service}, "GET", "/user/3", nil, map[string]string{"If-None-Match": test.ifNoneMatch})
+
+			expectedStatusCode := http.StatusNotModified
+			assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+			assert.Equal(t, "", rr.Body.String(), fmt.Sprintf("Expected an empty response body. [actual]: %v", rr.Body.String()))
+			assert.Equal(t, `"4"`, rr.Header().Get("ETag"), "Expected the 304 response to carry the ETag")
+		})
+	}
+}
+
+func TestGetUserByIDHandlerIfNoneMatchModifiedSuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("GetUserByID", mock.Anything, 3).Return(domain.User{ID: 3, Username: "user", Email: "user@email.com", Version: 4}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/user/3", nil, map[string]string{"If-None-Match": `"3"`})
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"id":3,"username":"user","email":"user@email.com","version":4}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestUpdateUserHandlerIfMatchSuccess(t *testing.T) {
+	user := domain.User{Username: "updated", Email: "updated@email.com"}
+	expectedVersion := 4
+
+	service := new(testMocks.MockDBService)
+	service.On("UpdateUser", mock.Anything, 3, user, &expectedVersion).Return(domain.User{ID: 3, Username: "updated", Email: "updated@email.com", Version: 5}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "PUT", "/user/3", strings.NewReader(`{"username":"updated","email":"updated@email.com"}`), map[string]string{"If-Match": `"4"`})
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `"5"`
+	assert.Equal(t, expected, rr.Header().Get("ETag"), fmt.Sprintf("Expected the ETag to equal %v. [actual]: %v", expected, rr.Header().Get("ETag")))
+}
+
+func TestUpdateUserHandlerIfMatchAnySuccess(t *testing.T) {
+	user := domain.User{Username: "updated", Email: "updated@email.com"}
+
+	service := new(testMocks.MockDBService)
+	service.On("UpdateUser", mock.Anything, 3, user, (*int)(nil)).Return(domain.User{ID: 3, Username: "updated", Email: "updated@email.com", Version: 5}, nil)
+
+	rr := serve(&sv.Server{Db: service, RequireIfMatch: true}, "PUT", "/user/3", strings.NewReader(`{"username":"updated","email":"updated@email.com"}`), map[string]string{"If-Match": `*`})
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+}
+
+func TestUpdateUserHandlerIfMatchListSuccess(t *testing.T) {
+	user := domain.User{Username: "updated", Email: "updated@email.com"}
+	staleVersion := 3
+	expectedVersion := 4
+
+	service := new(testMocks.MockDBService)
+	service.On("UpdateUser", mock.Anything, 3, user, &staleVersion).Return(domain.User{}, &domain.PreconditionFailedError{Message: "stale"})
+	service.On("UpdateUser", mock.Anything, 3, user, &expectedVersion).Return(domain.User{ID: 3, Username: "updated", Email: "updated@email.com", Version: 5}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "PUT", "/user/3", strings.NewReader(`{"username":"updated","email":"updated@email.com"}`), map[string]string{"If-Match": `"3", W/"4", "4"`})
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	service.AssertNumberOfCalls(t, "UpdateUser", 2)
+}
+
+func TestDeleteUserHandlerIfMatchListStaleVersionFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("SoftDeleteUser", mock.Anything, 3, mock.Anything).Return(&domain.PreconditionFailedError{Message: "stale"})
+
+	rr := serve(&sv.Server{Db: service}, "DELETE", "/user/3", nil, map[string]string{"If-Match": `"3", "4"`})
+
+	expectedStatusCode := http.StatusPreconditionFailed
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:version_mismatch","title":"User has changed","status":412,"detail":"User has been changed since it was read","code":"version_mismatch"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNumberOfCalls(t, "SoftDeleteUser", 2)
+}
+
+func TestPatchUserHandlerStaleVersionFailure(t *testing.T) {
+	username := "patched"
+	expectedVersion := 4
+
+	service := new(testMocks.MockDBService)
+	service.On("PatchUser", mock.Anything, 3, domain.UserPatch{Username: &username}, &expectedVersion).Return(domain.User{}, &domain.PreconditionFailedError{Message: "stale"})
+
+	rr := serve(&sv.Server{Db: service}, "PATCH", "/user/3", strings.NewReader(`{"username":"patched"}`), map[string]string{"If-Match": `"4"`})
+
+	expectedStatusCode := http.StatusPreconditionFailed
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:version_mismatch","title":"User has changed","status":412,"detail":"User has been changed since it was read","code":"version_mismatch"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestDeleteUserHandlerIfMatchSuccess(t *testing.T) {
+	expectedVersion := 4
+
+	service := new(testMocks.MockDBService)
+	service.On("SoftDeleteUser", mock.Anything, 3, &expectedVersion).Return(nil)
+
+	rr := serve(&sv.Server{Db: service}, "DELETE", "/user/3", nil, map[string]string{"If-Match": `"4"`})
+
+	expectedStatusCode := http.StatusNoContent
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	service.AssertCalled(t, "SoftDeleteUser", mock.Anything, 3, &expectedVersion)
+}
+
+func TestDeleteUserHandlerStaleVersionFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("SoftDeleteUser", mock.Anything, 3, mock.Anything).Return(&domain.PreconditionFailedError{Message: "stale"})
+
+	rr := serve(&sv.Server{Db: service}, "DELETE", "/user/3", nil, map[string]string{"If-Match": `"4"`})
+
+	expectedStatusCode := http.StatusPreconditionFailed
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:version_mismatch","title":"User has changed","status":412,"detail":"User has been changed since it was read","code":"version_mismatch"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestRestoreUserHandlerIfMatchSuccess(t *testing.T) {
+	expectedVersion := 2
+
+	service := new(testMocks.MockDBService)
+	service.On("RestoreUser", mock.Anything, 3, &expectedVersion).Return(domain.User{ID: 3, Username: "restored", Email: "restored@email.com", Version: 3}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "POST", "/user/3/restore", nil, map[string]string{"If-Match": `"2"`})
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expectedETag := `"3"`
+	assert.Equal(t, expectedETag, rr.Header().Get("ETag"), fmt.Sprintf("Expected ETag to equal %v. [actual]: %v", expectedETag, rr.Header().Get("ETag")))
+	service.AssertCalled(t, "RestoreUser", mock.Anything, 3, &expectedVersion)
+}
+
+func TestRestoreUserHandlerStaleVersionFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("RestoreUser", mock.Anything, 3, mock.Anything).Return(domain.User{}, &domain.PreconditionFailedError{Message: "stale"})
+
+	rr := serve(&sv.Server{Db: service}, "POST", "/user/3/restore", nil, map[string]string{"If-Match": `"1", "2"`})
+
+	expectedStatusCode := http.StatusPreconditionFailed
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:version_mismatch","title":"User has changed","status":412,"detail":"User has been changed since it was read","code":"version_mismatch"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNumberOfCalls(t, "RestoreUser", 2)
+}
+
+func TestIfMatchInvalidFailure(t *testing.T) {
+	tests := []struct {
+		name               string
+		server             *sv.Server
+		headers            map[string]string
+		expectedStatusCode int
+		expected           string
+	}{
+		{name: "weak tag", server: &sv.Server{}, headers: map[string]string{"If-Match": `W/"4"`}, expectedStatusCode: http.StatusPreconditionFailed, expected: `{"type":"urn:problem-type:version_mismatch","title":"User has changed","status":412,"detail":"User has been changed since it was read","code":"version_mismatch"}`},
+		{name: "unquoted tag", server: &sv.Server{}, headers: map[string]string{"If-Match": `4`}, expectedStatusCode: http.StatusBadRequest, expected: `{"type":"urn:problem-type:invalid_header","title":"Invalid header","status":400,"detail":"If-Match must be a list of ETags or *","code":"invalid_header"}`},
+		{name: "list with an unquoted tag", server: &sv.Server{}, headers: map[string]string{"If-Match": `"3", 4`}, expectedStatusCode: http.StatusBadRequest, expected: `{"type":"urn:problem-type:invalid_header","title":"Invalid header","status":400,"detail":"If-Match must be a list of ETags or *","code":"invalid_header"}`},
+		{name: "required", server: &sv.Server{RequireIfMatch: true}, headers: nil, expectedStatusCode: http.StatusPreconditionRequired, expected: `{"type":"urn:problem-type:if_match_required","title":"If-Match required","status":428,"detail":"If-Match is required to change this user","code":"if_match_required"}`},
+	}
+
+	for _, test := range tests {
+		for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+			t.Run(test.name+" "+method, func(t *testing.T) {
+				service := new(testMocks.MockDBService)
+				test.server.Db = service
+
+				rr := serve(test.server, method, "/user/3", strings.NewReader(`{"username":"updated","email":"updated@email.com"}`), test.headers)
+
+				assert.Equal(t, test.expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", test.expectedStatusCode, rr.Code))
+				assert.Equal(t, test.expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", test.expected, rr.Body.String()))
+				service.AssertNotCalled(t, "UpdateUser", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				service.AssertNotCalled(t, "PatchUser", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				service.AssertNotCalled(t, "SoftDeleteUser", mock.Anything, mock.Anything, mock.Anything)
+			})
+		}
+	}
+}
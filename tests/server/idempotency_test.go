@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"db_access/internal/domain"
+
+	sv "db_access/internal/server"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func requestHash(user domain.User) string {
+	payload, _ := json.Marshal(user)
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestInsertNewUserIdempotencyKeyFirstRequestSuccess(t *testing.T) {
+	user := domain.User{Username: "New User", Email: "NewEmail@github.com"}
+	userId := 3
+
+	service := new(testMocks.MockDBService)
+	service.On("ReserveIdempotencyKey", mock.Anything, "key-1", requestHash(user), 30*time.Second).Return(domain.IdempotencyRecord{LeaseToken: "lease-1"}, true, nil)
+	service.On("InsertNewUser", mock.Anything, user).Return(userId, nil)
+	service.On("CompleteIdempotencyKey", mock.Anything, "key-1", "lease-1", http.StatusCreated, []byte(`{"userId":3}`), &userId, time.Hour).Return(nil)
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"username":"New User","email":"NewEmail@github.com"}`), map[string]string{"Idempotency-Key": "key-1"})
+
+	expectedStatusCode := http.StatusCreated
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"userId":3}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	assert.Equal(t, "", rr.Header().Get("Idempotent-Replayed"), "Expected the first response not to be marked as replayed")
+	service.AssertCalled(t, "CompleteIdempotencyKey", mock.Anything, "key-1", "lease-1", http.StatusCreated, []byte(`{"userId":3}`), &userId, time.Hour)
+}
+
+func TestInsertNewUserIdempotencyKeyReplaySuccess(t *testing.T) {
+	user := domain.User{Username: "New User", Email: "NewEmail@github.com"}
+
+	service := new(testMocks.MockDBService)
+	service.On("ReserveIdempotencyKey", mock.Anything, "key-1", requestHash(user), 30*time.Second).Return(domain.IdempotencyRecord{
+		Key:         "key-1",
+		RequestHash: requestHash(user),
+		StatusCode:  http.StatusCreated,
+		Body:        []byte(`{"userId":3}`),
+	}, false, nil)
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"email":"NewEmail@github.com","username":"New User"}`), map[string]string{"Idempotency-Key": "key-1"})
+
+	expectedStatusCode := http.StatusCreated
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"userId":3}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"), "Expected the replayed response to be marked as replayed")
+	service.AssertNotCalled(t, "InsertNewUser", mock.Anything, mock.Anything)
+}
+
+func TestInsertNewUserIdempotencyKeyDifferentPayloadFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything, 30*time.Second).Return(domain.IdempotencyRecord{
+		Key:         "key-1",
+		RequestHash: requestHash(domain.User{Username: "Someone Else", Email: "else@github.com"}),
+		StatusCode:  http.StatusCreated,
+		Body:        []byte(`{"userId":3}`),
+	}, false, nil)
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"username":"New User","email":"NewEmail@github.com"}`), map[string]string{"Idempotency-Key": "key-1"})
+
+	expectedStatusCode := http.StatusUnprocessableEntity
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:idempotency_key_reused","title":"Idempotency-Key reused","status":422,"detail":"Idempotency-Key has already been used with a different request","code":"idempotency_key_reused"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNotCalled(t, "InsertNewUser", mock.Anything, mock.Anything)
+}
+
+func TestInsertNewUserIdempotencyKeyInProgressFailure(t *testing.T) {
+	user := domain.User{Username: "New User", Email: "NewEmail@github.com"}
+
+	service := new(testMocks.MockDBService)
+	service.On("ReserveIdempotencyKey", mock.Anything, "key-1", requestHash(user), 30*time.Second).Return(domain.IdempotencyRecord{
+		Key:         "key-1",
+		RequestHash: requestHash(user),
+	}, false, nil)
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"username":"New User","email":"NewEmail@github.com"}`), map[string]string{"Idempotency-Key": "key-1"})
+
+	expectedStatusCode := http.StatusConflict
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:idempotency_key_in_progress","title":"Request in progress","status":409,"detail":"A request with this Idempotency-Key is still being processed","code":"idempotency_key_in_progress"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNotCalled(t, "InsertNewUser", mock.Anything, mock.Anything)
+}
+
+func TestInsertNewUserIdempotencyKeyStoresDuplicateEmailSuccess(t *testing.T) {
+	user := domain.User{Username: "New User", Email: "NewEmail@github.com"}
+	var noUserId *int
+
+	service := new(testMocks.MockDBService)
+	service.On("ReserveIdempotencyKey", mock.Anything, "key-1", requestHash(user), 30*time.Second).Return(domain.IdempotencyRecord{LeaseToken: "lease-1"}, true, nil)
+	service.On("InsertNewUser", mock.Anything, user).Return(0, &domain.UniqueConstraintDatabaseError{Message: "duplicate"})
+	service.On("CompleteIdempotencyKey", mock.Anything, "key-1", "lease-1", http.StatusConflict, mock.Anything, noUserId, time.Hour).Return(nil)
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"username":"New User","email":"NewEmail@github.com"}`), map[string]string{"Idempotency-Key": "key-1"})
+
+	expectedStatusCode := http.StatusConflict
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expectedContentType := "application/problem+json"
+	assert.Equal(t, expectedContentType, rr.Header().Get("Content-Type"), fmt.Sprintf("Expected Content-Type to equal %v. [actual]: %v", expectedContentType, rr.Header().Get("Content-Type")))
+	service.AssertCalled(t, "CompleteIdempotencyKey", mock.Anything, "key-1", "lease-1", http.StatusConflict, []byte(`{"type":"urn:problem-type:email_taken","title":"Email already in use","status":409,"detail":"This email is already used by another user","code":"email_taken"}`), noUserId, time.Hour)
+}
+
+func TestInsertNewUserIdempotencyKeyReleasedOnServerErrorFailure(t *testing.T) {
+	user := domain.User{Username: "New User", Email: "NewEmail@github.com"}
+
+	service := new(testMocks.MockDBService)
+	service.On("ReserveIdempotencyKey", mock.Anything, "key-1", requestHash(user), 30*time.Second).Return(domain.IdempotencyRecord{LeaseToken: "lease-1"}, true, nil)
+	service.On("InsertNewUser", mock.Anything, user).Return(0, errors.New("connection reset"))
+	service.On("ReleaseIdempotencyKey", mock.Anything, "key-1", "lease-1").Return(nil)
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"username":"New User","email":"NewEmail@github.com"}`), map[string]string{"Idempotency-Key": "key-1"})
+
+	expectedStatusCode := http.StatusInternalServerError
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	service.AssertCalled(t, "ReleaseIdempotencyKey", mock.Anything, "key-1", "lease-1")
+	service.AssertNotCalled(t, "CompleteIdempotencyKey", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestInsertNewUserIdempotencyKeyTooLongFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"username":"New User","email":"NewEmail@github.com"}`), map[string]string{"Idempotency-Key": strings.Repeat("k", 256)})
+
+	expectedStatusCode := http.StatusBadRequest
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:invalid_header","title":"Invalid header","status":400,"detail":"Idempotency-Key must not be longer than 255 characters","code":"invalid_header"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNotCalled(t, "ReserveIdempotencyKey", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestInsertNewUserIdempotencyKeyReserveFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything, 30*time.Second).Return(domain.IdempotencyRecord{}, false, errors.New("connection reset"))
+
+	rr := serve(&sv.Server{Db: service, IdempotencyKeyTTL: time.Hour, IdempotencyKeyLease: 30 * time.Second}, "POST", "/user", strings.NewReader(`{"username":"New User","email":"NewEmail@github.com"}`), map[string]string{"Idempotency-Key": "key-1"})
+
+	expectedStatusCode := http.StatusInternalServerError
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:internal_error","title":"Internal server error","status":500,"detail":"The request could not be completed","code":"internal_error"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNotCalled(t, "InsertNewUser", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"db_access/internal/database"
+	"db_access/internal/domain"
+	sv "db_access/internal/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUserLifecycleMemoryDatabaseSuccess drives the routes against the
+// in-memory database rather than a mock, so every response comes from the
+// real behaviour of the database.
+func TestUserLifecycleMemoryDatabaseSuccess(t *testing.T) {
+	db := database.NewMemory()
+	t.Cleanup(db.Close)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   db,
+	}
+	handler := s.RegisterRoutes()
+
+	request := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, target, bytes.NewBufferString(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	steps := []struct {
+		name               string
+		method             string
+		target             string
+		body               string
+		headers            map[string]string
+		expectedStatusCode int
+		expectedCode       string
+	}{
+		{name: "insert", method: "POST", target: "/user", body: `{"username":"New User","email":"NewEmail@github.com"}`, expectedStatusCode: http.StatusCreated},
+		{name: "insert duplicate email", method: "POST", target: "/user", body: `{"username":"Other User","email":"NewEmail@github.com"}`, expectedStatusCode: http.StatusConflict, expectedCode: "email_taken"},
+		{name: "get", method: "GET", target: "/user/1", expectedStatusCode: http.StatusOK},
+		{name: "update stale version", method: "PUT", target: "/user/1", body: `{"username":"Renamed","email":"NewEmail@github.com"}`, headers: map[string]string{"If-Match": `"2"`}, expectedStatusCode: http.StatusPreconditionFailed, expectedCode: "version_mismatch"},
+		{name: "update", method: "PUT", target: "/user/1", body: `{"username":"Renamed","email":"NewEmail@github.com"}`, headers: map[string]string{"If-Match": `"1"`}, expectedStatusCode: http.StatusOK},
+		{name: "delete", method: "DELETE", target: "/user/1", expectedStatusCode: http.StatusNoContent},
+		{name: "get deleted", method: "GET", target: "/user/1", expectedStatusCode: http.StatusGone, expectedCode: "user_deleted"},
+		{name: "delete deleted", method: "DELETE", target: "/user/1", expectedStatusCode: http.StatusGone, expectedCode: "user_deleted"},
+		{name: "delete missing", method: "DELETE", target: "/user/2", expectedStatusCode: http.StatusNotFound, expectedCode: "user_not_found"},
+		{name: "restore", method: "POST", target: "/user/1/restore", expectedStatusCode: http.StatusOK},
+		{name: "restore active", method: "POST", target: "/user/1/restore", expectedStatusCode: http.StatusConflict, expectedCode: "user_not_deleted"},
+		{name: "history", method: "GET", target: "/user/1/history", expectedStatusCode: http.StatusOK},
+		{name: "verify audit log", method: "GET", target: "/admin/audit/verify", expectedStatusCode: http.StatusOK},
+	}
+
+	for _, step := range steps {
+		rr := request(step.method, step.target, step.body, step.headers)
+		assert.Equal(t, step.expectedStatusCode, rr.Code, fmt.Sprintf("%s: Expected response status to equal %v. [actual]: %v, [body]: %v", step.name, step.expectedStatusCode, rr.Code, rr.Body.String()))
+		if step.expectedCode == "" {
+			continue
+		}
+		var problem sv.Problem
+		err := json.Unmarshal(rr.Body.Bytes(), &problem)
+		assert.Equal(t, nil, err, fmt.Sprintf("%s: Expected a problem body. [actual]: %v", step.name, rr.Body.String()))
+		assert.Equal(t, step.expectedCode, problem.Code, fmt.Sprintf("%s: Expected problem code to equal %v. [actual]: %v", step.name, step.expectedCode, problem.Code))
+	}
+
+	rr := request("GET", "/user/1/history", "", nil)
+	var history struct {
+		Entries []json.RawMessage `json:"entries"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &history)
+	assert.Equal(t, nil, err, fmt.Sprintf("Expected the history to be JSON. [actual]: %v", rr.Body.String()))
+	assert.Equal(t, 4, len(history.Entries), fmt.Sprintf("Expected an insert, update, delete and restore in the history. [actual]: %v", rr.Body.String()))
+}
+
+// TestExportUsersOutlastsQueryTimeoutSuccess checks an export is not cut short
+// by QueryTimeout, which is far shorter than it takes to export every user,
+// while the CRUD routes are still bounded by it.
+func TestExportUsersOutlastsQueryTimeoutSuccess(t *testing.T) {
+	db := database.NewMemory()
+	t.Cleanup(db.Close)
+
+	users := make([]domain.User, 1200)
+	for i := range users {
+		users[i] = domain.User{Username: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@test.com", i)}
+	}
+	_, err := db.InsertUsers(context.Background(), users, domain.BatchInsertOptions{})
+	assert.Equal(t, nil, err, "Some error occurred inserting the users. expected nil")
+
+	s := &sv.Server{
+		Port:         8080,
+		Db:           db,
+		QueryTimeout: time.Nanosecond,
+	}
+	handler := s.RegisterRoutes()
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusGatewayTimeout
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected listing users to time out. [actual]: %v", rr.Code))
+
+	req, _ = http.NewRequest("GET", "/users/export?format=ndjson", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	expectedStatusCode = http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	lines := strings.Count(rr.Body.String(), "\n")
+	assert.Equal(t, len(users), lines, fmt.Sprintf("Expected every user to be exported. [actual]: %v", lines))
+}
+
+// TestIdempotencyKeyStaleReservationReclaimedSuccess checks a key reserved by
+// a request that never stored its response, as when the server crashed, holds
+// off retries only until its lease runs out.
+func TestIdempotencyKeyStaleReservationReclaimedSuccess(t *testing.T) {
+	db := database.NewMemory()
+	t.Cleanup(db.Close)
+
+	lease := 50 * time.Millisecond
+	s := &sv.Server{
+		Port:                8080,
+		Db:                  db,
+		IdempotencyKeyTTL:   time.Hour,
+		IdempotencyKeyLease: lease,
+	}
+	handler := s.RegisterRoutes()
+
+	user := domain.User{Username: "New User", Email: "NewEmail@github.com"}
+	_, reserved, err := db.ReserveIdempotencyKey(context.Background(), "key-1", requestHash(user), lease)
+	assert.Equal(t, nil, err, "Some error occurred reserving the key. expected nil")
+	assert.True(t, reserved, "Expected the crashed request to have reserved the key")
+
+	insert := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/user", bytes.NewBufferString(`{"username":"New User","email":"NewEmail@github.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "key-1")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := insert()
+	expectedStatusCode := http.StatusConflict
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected a retry within the lease to be told the request is in progress. [actual]: %v", rr.Code))
+
+	time.Sleep(2 * lease)
+
+	rr = insert()
+	expectedStatusCode = http.StatusCreated
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected a retry after the lease to run the request. [actual]: %v, [body]: %v", rr.Code, rr.Body.String()))
+
+	time.Sleep(2 * lease)
+
+	rr = insert()
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected the stored response to outlive the lease. [actual]: %v", rr.Code))
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"), "Expected the stored response to be replayed")
+}
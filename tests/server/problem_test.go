@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"db_access/internal/domain"
+
+	sv "db_access/internal/server"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProblemForDatabaseErrorsSuccess(t *testing.T) {
+	tests := []struct {
+		name               string
+		err                error
+		expectedStatusCode int
+		expectedCode       string
+		expectedDetail     string
+	}{
+		{name: "not found", err: &domain.UserNotFoundError{Message: "User with id 12 does not exist"}, expectedStatusCode: http.StatusNotFound, expectedCode: "user_not_found", expectedDetail: "User with id 12 does not exist"},
+		{name: "deleted", err: &domain.UserDeletedError{Message: "User with id 12 has been deleted"}, expectedStatusCode: http.StatusGone, expectedCode: "user_deleted", expectedDetail: "User with id 12 has been deleted"},
+		{name: "not deleted", err: &domain.UserNotDeletedError{Message: "User with id 12 has not been deleted"}, expectedStatusCode: http.StatusConflict, expectedCode: "user_not_deleted", expectedDetail: "User with id 12 has not been deleted"},
+		{name: "unique constraint", err: &domain.UniqueConstraintDatabaseError{Message: `duplicate key value violates unique constraint "users_email_key"`}, expectedStatusCode: http.StatusConflict, expectedCode: "email_taken", expectedDetail: "This email is already used by another user"},
+		{name: "value too long", err: &domain.InvalidUserError{Message: "value too long for type character varying(50)"}, expectedStatusCode: http.StatusUnprocessableEntity, expectedCode: "validation_failed", expectedDetail: "A field is longer than the database allows"},
+		{name: "precondition failed", err: &domain.PreconditionFailedError{Message: "User with id 12 is at version 4, not 3"}, expectedStatusCode: http.StatusPreconditionFailed, expectedCode: "version_mismatch", expectedDetail: "User has been changed since it was read"},
+		{name: "transaction", err: &domain.DatabaseTransactionError{Message: "connection refused"}, expectedStatusCode: http.StatusServiceUnavailable, expectedCode: "database_unavailable", expectedDetail: "The database could not run the request. Try again later"},
+		{name: "timeout", err: &domain.UnmappedDatabaseError{Message: "timeout: context deadline exceeded", Err: context.DeadlineExceeded}, expectedStatusCode: http.StatusGatewayTimeout, expectedCode: "timeout", expectedDetail: "The database did not respond in time"},
+		{name: "wrapped not found", err: fmt.Errorf("reading user: %w", &domain.UserNotFoundError{Message: "User with id 12 does not exist"}), expectedStatusCode: http.StatusNotFound, expectedCode: "user_not_found", expectedDetail: "User with id 12 does not exist"},
+		{name: "unmapped", err: &domain.UnmappedDatabaseError{Message: "relation \"users\" does not exist"}, expectedStatusCode: http.StatusInternalServerError, expectedCode: "internal_error", expectedDetail: "The request could not be completed"},
+		{name: "unknown", err: errors.New("connection reset"), expectedStatusCode: http.StatusInternalServerError, expectedCode: "internal_error", expectedDetail: "The request could not be completed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := new(testMocks.MockDBService)
+			service.On("GetUserByID", mock.Anything, 12).Return(domain.User{}, test.err)
+
+			s := &sv.Server{
+				Port: 8080,
+				Db:   service,
+			}
+			r := gin.New()
+			r.GET("/user/:userId", s.GetUserByIDHandler)
+
+			req, _ := http.NewRequest("GET", "/user/12", nil)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			assert.Equal(t, test.expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", test.expectedStatusCode, rr.Code))
+			expectedContentType := "application/problem+json"
+			assert.Equal(t, expectedContentType, rr.Header().Get("Content-Type"), fmt.Sprintf("Expected Content-Type to equal %v. [actual]: %v", expectedContentType, rr.Header().Get("Content-Type")))
+
+			var problem sv.Problem
+			err := json.Unmarshal(rr.Body.Bytes(), &problem)
+			assert.Equal(t, nil, err, fmt.Sprintf("Expected the response body to be a problem. [actual]: %v", rr.Body.String()))
+			assert.Equal(t, test.expectedStatusCode, problem.Status, fmt.Sprintf("Expected problem status to equal %v. [actual]: %v", test.expectedStatusCode, problem.Status))
+			assert.Equal(t, test.expectedCode, problem.Code, fmt.Sprintf("Expected problem code to equal %v. [actual]: %v", test.expectedCode, problem.Code))
+			assert.Equal(t, "urn:problem-type:"+test.expectedCode, problem.Type, fmt.Sprintf("Expected problem type to name the code. [actual]: %v", problem.Type))
+			assert.NotEqual(t, "", problem.Title, "Expected the problem to have a title")
+			assert.Equal(t, test.expectedDetail, problem.Detail, fmt.Sprintf("Expected problem detail to equal %v. [actual]: %v", test.expectedDetail, problem.Detail))
+		})
+	}
+}
+
+func TestInsertNewUserHandlerFieldErrorsFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "missing fields",
+			body:     `{}`,
+			expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"The request body has invalid fields","code":"validation_failed","errors":[{"field":"username","code":"required","message":"username is required"},{"field":"email","code":"required","message":"email is required"}]}`,
+		},
+		{
+			name:     "invalid email",
+			body:     `{"username":"New User","email":"not-an-email"}`,
+			expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"The request body has invalid fields","code":"validation_failed","errors":[{"field":"email","code":"email","message":"email must be a valid email address"}]}`,
+		},
+		{
+			name:     "too long",
+			body:     `{"username":"` + strings.Repeat("u", 51) + `","email":"` + strings.Repeat("e", 92) + `@test.com"}`,
+			expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"The request body has invalid fields","code":"validation_failed","errors":[{"field":"username","code":"max","message":"username must be at most 50 characters"},{"field":"email","code":"max","message":"email must be at most 100 characters"}]}`,
+		},
+		{
+			name:     "wrong type",
+			body:     `{"username":7,"email":"NewEmail@github.com"}`,
+			expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"The request body has invalid fields","code":"validation_failed","errors":[{"field":"username","code":"type","message":"username must be a string"}]}`,
+		},
+		{
+			name:     "not json",
+			body:     `{"username":`,
+			expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"unexpected EOF","code":"validation_failed"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := new(testMocks.MockDBService)
+
+			s := &sv.Server{
+				Port: 8080,
+				Db:   service,
+			}
+			r := gin.New()
+			r.POST("/user", s.InsertNewUserHandler)
+
+			req, _ := http.NewRequest("POST", "/user", bytes.NewBufferString(test.body))
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			expectedStatusCode := http.StatusUnprocessableEntity
+			assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+			assert.Equal(t, test.expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", test.expected, rr.Body.String()))
+			service.AssertNotCalled(t, "InsertNewUser", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// TestUserHandlersErrorContractSuccess checks every handler that changes or
+// reads a single user responds to each database error with the same status.
+func TestUserHandlersErrorContractSuccess(t *testing.T) {
+	errorStatuses := []struct {
+		name               string
+		err                error
+		expectedStatusCode int
+	}{
+		{name: "not found", err: &domain.UserNotFoundError{Message: "User with id 12 does not exist"}, expectedStatusCode: http.StatusNotFound},
+		{name: "deleted", err: &domain.UserDeletedError{Message: "User with id 12 has been deleted"}, expectedStatusCode: http.StatusGone},
+		{name: "not deleted", err: &domain.UserNotDeletedError{Message: "User with id 12 has not been deleted"}, expectedStatusCode: http.StatusConflict},
+		{name: "unique constraint", err: &domain.UniqueConstraintDatabaseError{Message: "duplicate key value violates unique constraint"}, expectedStatusCode: http.StatusConflict},
+		{name: "value too long", err: &domain.InvalidUserError{Message: "value too long for type character varying(50)"}, expectedStatusCode: http.StatusUnprocessableEntity},
+		{name: "precondition failed", err: &domain.PreconditionFailedError{Message: "User with id 12 is at version 4, not 3"}, expectedStatusCode: http.StatusPreconditionFailed},
+		{name: "transaction", err: &domain.DatabaseTransactionError{Message: "connection refused"}, expectedStatusCode: http.StatusServiceUnavailable},
+		{name: "unmapped", err: &domain.UnmappedDatabaseError{Message: "syntax error"}, expectedStatusCode: http.StatusInternalServerError},
+		{name: "unknown", err: errors.New("connection reset"), expectedStatusCode: http.StatusInternalServerError},
+	}
+
+	user := `{"username":"New User","email":"NewEmail@github.com"}`
+	routes := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		mock   func(service *testMocks.MockDBService, err error)
+	}{
+		{name: "insert", method: "POST", target: "/user", body: user, mock: func(service *testMocks.MockDBService, err error) {
+			service.On("InsertNewUser", mock.Anything, mock.Anything).Return(0, err)
+		}},
+		{name: "get", method: "GET", target: "/user/12", mock: func(service *testMocks.MockDBService, err error) {
+			service.On("GetUserByID", mock.Anything, 12).Return(domain.User{}, err)
+		}},
+		{name: "update", method: "PUT", target: "/user/12", body: user, mock: func(service *testMocks.MockDBService, err error) {
+			service.On("UpdateUser", mock.Anything, 12, mock.Anything, (*int)(nil)).Return(domain.User{}, err)
+		}},
+		{name: "patch", method: "PATCH", target: "/user/12", body: user, mock: func(service *testMocks.MockDBService, err error) {
+			service.On("PatchUser", mock.Anything, 12, mock.Anything, (*int)(nil)).Return(domain.User{}, err)
+		}},
+		{name: "delete", method: "DELETE", target: "/user/12", mock: func(service *testMocks.MockDBService, err error) {
+			service.On("SoftDeleteUser", mock.Anything, 12, (*int)(nil)).Return(err)
+		}},
+		{name: "restore", method: "POST", target: "/user/12/restore", mock: func(service *testMocks.MockDBService, err error) {
+			service.On("RestoreUser", mock.Anything, 12, (*int)(nil)).Return(domain.User{}, err)
+		}},
+		{name: "history", method: "GET", target: "/user/12/history", mock: func(service *testMocks.MockDBService, err error) {
+			service.On("GetUserHistory", mock.Anything, 12).Return([]domain.AuditEntry(nil), err)
+		}},
+	}
+
+	for _, route := range routes {
+		for _, errorStatus := range errorStatuses {
+			t.Run(route.name+" "+errorStatus.name, func(t *testing.T) {
+				service := new(testMocks.MockDBService)
+				route.mock(service, errorStatus.err)
+
+				s := &sv.Server{
+					Port: 8080,
+					Db:   service,
+				}
+				handler := s.RegisterRoutes()
+
+				req, _ := http.NewRequest(route.method, route.target, bytes.NewBufferString(route.body))
+				if route.body != "" {
+					req.Header.Set("Content-Type", "application/json")
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				assert.Equal(t, errorStatus.expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v, [body]: %v", errorStatus.expectedStatusCode, rr.Code, rr.Body.String()))
+				expectedContentType := "application/problem+json"
+				assert.Equal(t, expectedContentType, rr.Header().Get("Content-Type"), fmt.Sprintf("Expected Content-Type to equal %v. [actual]: %v", expectedContentType, rr.Header().Get("Content-Type")))
+			})
+		}
+	}
+}
@@ -2,13 +2,17 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"db_access/internal/domain"
 
@@ -31,7 +35,7 @@ func TestGetAllUsersSuccess(t *testing.T) {
 
 	userList := []domain.User{user}
 
-	service.On("GetAllUsers").Return(userList, nil)
+	service.On("GetUsersPage", mock.Anything, domain.UsersQuery{Limit: 50}).Return(userList, (*domain.UsersCursor)(nil), nil)
 
 	s := &sv.Server{
 		Port: 8080,
@@ -53,14 +57,14 @@ func TestGetAllUsersSuccess(t *testing.T) {
 
 	expectedStatusCode := http.StatusOK
 	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
-	expected := `[{"id":0,"username":"New User","email":"NewEmail@github.com"}]`
+	expected := `{"users":[{"id":0,"username":"New User","email":"NewEmail@github.com"}],"next_cursor":null}`
 	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
 }
 
 func TestGetAllUsersFailure(t *testing.T) {
 	service := new(testMocks.MockDBService)
 
-	service.On("GetAllUsers").Return([]domain.User{}, errors.New("Something went wrong"))
+	service.On("GetUsersPage", mock.Anything, domain.UsersQuery{Limit: 50}).Return([]domain.User{}, (*domain.UsersCursor)(nil), errors.New("Something went wrong"))
 
 	s := &sv.Server{
 		Port: 8080,
@@ -82,14 +86,191 @@ func TestGetAllUsersFailure(t *testing.T) {
 
 	expectedStatusCode := http.StatusInternalServerError
 	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
-	expected := "{}"
+	expected := `{"type":"urn:problem-type:internal_error","title":"Internal server error","status":500,"detail":"The request could not be completed","code":"internal_error"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetAllUsersNextPageSuccess(t *testing.T) {
+	userList := []domain.User{
+		{ID: 11, Username: "New User 1", Email: "NewEmail1@github.com"},
+		{ID: 12, Username: "New User 2", Email: "NewEmail2@github.com"},
+	}
+	createdAfter := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expectedQuery := domain.UsersQuery{
+		UsernamePrefix: "New",
+		EmailDomain:    "github.com",
+		CreatedAfter:   &createdAfter,
+		Sort:           []domain.SortField{{Field: "username"}, {Field: "created_at", Descending: true}},
+		After:          &domain.UsersCursor{Keys: []string{"New User 0", "2024-02-01 00:00:00+00", "10"}},
+		Limit:          2,
+	}
+
+	service := new(testMocks.MockDBService)
+
+	service.On("GetUsersPage", mock.Anything, expectedQuery).Return(userList, &domain.UsersCursor{Keys: []string{"New User 2", "2024-03-01 00:00:00+00", "12"}}, nil)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/users", s.GetAllUsersHandler)
+
+	requestCursor := base64.RawURLEncoding.EncodeToString([]byte(`{"keys":["New User 0","2024-02-01 00:00:00+00","10"],"sort":"username,-created_at"}`))
+	params := url.Values{
+		"limit":         {"2"},
+		"username":      {"New"},
+		"email_domain":  {"github.com"},
+		"created_after": {"2024-01-01"},
+		"sort":          {"username,-created_at"},
+		"cursor":        {requestCursor},
+	}
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/users?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+
+	var page domain.UsersPage
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, userList, page.Users, "Expected the page to contain the users returned by the database")
+
+	nextCursor, err := base64.RawURLEncoding.DecodeString(*page.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"keys":["New User 2","2024-03-01 00:00:00+00","12"],"sort":"username,-created_at"}`
+	assert.Equal(t, expected, string(nextCursor), fmt.Sprintf("Expected next_cursor to point at the last user. [actual]: %v", string(nextCursor)))
+}
+
+func TestGetAllUsersIncludeDeletedSuccess(t *testing.T) {
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	deletedAt := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	userList := []domain.User{
+		{ID: 1, Username: "New User 1", Email: "NewEmail1@github.com", CreatedAt: &createdAt, UpdatedAt: &createdAt},
+		{ID: 2, Username: "New User 2", Email: "NewEmail2@github.com", CreatedAt: &createdAt, UpdatedAt: &createdAt, DeletedAt: &deletedAt},
+	}
+
+	service := new(testMocks.MockDBService)
+
+	service.On("GetUsersPage", mock.Anything, domain.UsersQuery{IncludeDeleted: true, Limit: 50}).Return(userList, (*domain.UsersCursor)(nil), nil)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/users", s.GetAllUsersHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/users?include_deleted=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"users":[` +
+		`{"id":1,"username":"New User 1","email":"NewEmail1@github.com","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z"},` +
+		`{"id":2,"username":"New User 2","email":"NewEmail2@github.com","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","deleted_at":"2024-02-01T00:00:00Z"}` +
+		`],"next_cursor":null}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetAllUsersInvalidQueryFailure(t *testing.T) {
+	otherSortCursor := base64.RawURLEncoding.EncodeToString([]byte(`{"keys":["10"],"sort":"-id"}`))
+	queries := map[string]string{
+		"limit=0":                   `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid limit. Must be an integer between 1 and 500","code":"invalid_parameter","parameter":"limit"}`,
+		"limit=abc":                 `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid limit. Must be an integer between 1 and 500","code":"invalid_parameter","parameter":"limit"}`,
+		"cursor=***":                `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid cursor","code":"invalid_parameter","parameter":"cursor"}`,
+		"cursor=bm90anNvbg":         `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid cursor","code":"invalid_parameter","parameter":"cursor"}`,
+		"cursor=" + otherSortCursor: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"cursor does not match the requested sort","code":"invalid_parameter","parameter":"cursor"}`,
+		"email_domain=a%40b.com":    `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid email_domain. Must be a domain name such as example.com","code":"invalid_parameter","parameter":"email_domain"}`,
+		"created_after=yesterday":   `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid created_after. Must be an RFC 3339 timestamp or a YYYY-MM-DD date","code":"invalid_parameter","parameter":"created_after"}`,
+		"created_before=2024-13-01": `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid created_before. Must be an RFC 3339 timestamp or a YYYY-MM-DD date","code":"invalid_parameter","parameter":"created_before"}`,
+		"created_after=2024-02-01&created_before=2024-01-01": `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid created_before. Must be later than created_after","code":"invalid_parameter","parameter":"created_before"}`,
+		"include_deleted=maybe":                              `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid include_deleted. Must be true or false","code":"invalid_parameter","parameter":"include_deleted"}`,
+		"sort=username,,id":                                  `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"invalid sort. Must be a comma separated list of fields","code":"invalid_parameter","parameter":"sort"}`,
+	}
+
+	for query, expected := range queries {
+		service := new(testMocks.MockDBService)
+		service.AssertNotCalled(t, "GetUsersPage", mock.Anything, mock.Anything)
+
+		s := &sv.Server{
+			Port: 8080,
+			Db:   service,
+		}
+		r := gin.New()
+		r.GET("/users", s.GetAllUsersHandler)
+
+		// Create a test HTTP request
+		req, err := http.NewRequest("GET", "/users?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Create a ResponseRecorder to record the response
+		rr := httptest.NewRecorder()
+		// Serve the HTTP request
+		r.ServeHTTP(rr, req)
+
+		expectedStatusCode := http.StatusBadRequest
+		assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v for %v. [actual]: %v", expectedStatusCode, query, rr.Code))
+		assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	}
+}
+
+func TestGetAllUsersUnknownSortFieldFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	expectedQuery := domain.UsersQuery{Sort: []domain.SortField{{Field: "password"}}, Limit: 50}
+	service.On("GetUsersPage", mock.Anything, expectedQuery).Return([]domain.User(nil), (*domain.UsersCursor)(nil), &domain.InvalidQueryError{Parameter: "sort", Message: `cannot sort by "password"`})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/users", s.GetAllUsersHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/users?sort=password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusBadRequest
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"cannot sort by \"password\"","code":"invalid_parameter","parameter":"sort"}`
 	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
 }
 
 func TestDeleteUserHandlerSuccess(t *testing.T) {
 
 	service := new(testMocks.MockDBService)
-	service.On("SoftDeleteUser", mock.Anything).Return(nil)
+	service.On("SoftDeleteUser", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
 	s := &sv.Server{
 		Port: 8080,
@@ -114,10 +295,10 @@ func TestDeleteUserHandlerSuccess(t *testing.T) {
 	assert.Empty(t, rr.Body.String(), fmt.Sprintf("Expected response body to be empty. [actual]: %v", rr.Body.String()))
 }
 
-func TestDeleteUserHandlerUniqueConstraintFailure(t *testing.T) {
+func TestDeleteUserHandlerAlreadyDeletedFailure(t *testing.T) {
 
 	service := new(testMocks.MockDBService)
-	service.On("SoftDeleteUser", mock.Anything).Return(&domain.UniqueConstraintDatabaseError{Message: "some issue"})
+	service.On("SoftDeleteUser", mock.Anything, mock.Anything, mock.Anything).Return(&domain.UserDeletedError{Message: "User with id 12 has already been deleted"})
 
 	s := &sv.Server{
 		Port: 8080,
@@ -137,16 +318,16 @@ func TestDeleteUserHandlerUniqueConstraintFailure(t *testing.T) {
 	// Serve the HTTP request
 	r.ServeHTTP(rr, req)
 
-	expectedStatusCode := http.StatusBadRequest
+	expectedStatusCode := http.StatusGone
 	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
-	expected := "{\"error\":\"Unable to delete this user as they have already been deleted\"}"
+	expected := `{"type":"urn:problem-type:user_deleted","title":"User has been deleted","status":410,"detail":"User with id 12 has already been deleted","code":"user_deleted"}`
 	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
 }
 
 func TestDeleteUserHandlerIdPathNotAnIntFailure(t *testing.T) {
 
 	service := new(testMocks.MockDBService)
-	service.AssertNotCalled(t, "SoftDeleteUser")
+	service.AssertNotCalled(t, "SoftDeleteUser", mock.Anything, mock.Anything, mock.Anything)
 
 	s := &sv.Server{
 		Port: 8080,
@@ -168,14 +349,14 @@ func TestDeleteUserHandlerIdPathNotAnIntFailure(t *testing.T) {
 
 	expectedStatusCode := http.StatusBadRequest
 	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
-	expected := "{\"error\":\"Invalid userId format. Must be an integer.\"}"
+	expected := `{"type":"urn:problem-type:invalid_user_id","title":"Invalid user id","status":400,"detail":"userId must be an integer","code":"invalid_user_id"}`
 	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
 }
 
 func TestDeleteUserHandlerUserNotFoundFailure(t *testing.T) {
 
 	service := new(testMocks.MockDBService)
-	service.On("SoftDeleteUser", mock.Anything).Return(&domain.UserNotFoundError{Message: "some issue"})
+	service.On("SoftDeleteUser", mock.Anything, mock.Anything, mock.Anything).Return(&domain.UserNotFoundError{Message: "User with id 12 does not exist"})
 
 	s := &sv.Server{
 		Port: 8080,
@@ -195,9 +376,9 @@ func TestDeleteUserHandlerUserNotFoundFailure(t *testing.T) {
 	// Serve the HTTP request
 	r.ServeHTTP(rr, req)
 
-	expectedStatusCode := http.StatusBadRequest
+	expectedStatusCode := http.StatusNotFound
 	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
-	expected := "{\"error\":\"Unable to delete this user as they do not exist\"}"
+	expected := `{"type":"urn:problem-type:user_not_found","title":"User not found","status":404,"detail":"User with id 12 does not exist","code":"user_not_found"}`
 	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
 }
 
@@ -210,7 +391,7 @@ func TestInsertNewUserHandlerSuccess(t *testing.T) {
 
 	service := new(testMocks.MockDBService)
 
-	service.On("InsertNewUser", user).Return(10, nil)
+	service.On("InsertNewUser", mock.Anything, user).Return(10, nil)
 
 	s := &sv.Server{
 		Port: 8080,
@@ -252,7 +433,7 @@ func TestInsertNewUserHandlerDuplicateEmailAddressFailure(t *testing.T) {
 
 	uniqueRequestError := &domain.UniqueConstraintDatabaseError{Message: "This email is not unique"}
 
-	service.On("InsertNewUser", user).Return(0, uniqueRequestError)
+	service.On("InsertNewUser", mock.Anything, user).Return(0, uniqueRequestError)
 
 	s := &sv.Server{
 		Port: 8080,
@@ -277,16 +458,16 @@ func TestInsertNewUserHandlerDuplicateEmailAddressFailure(t *testing.T) {
 	// Serve the HTTP request
 	r.ServeHTTP(rr, req)
 
-	expectedStatusCode := http.StatusBadRequest
+	expectedStatusCode := http.StatusConflict
 	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
-	expected := "{\"error\":\"cannot insert user as this email is already used\"}"
+	expected := `{"type":"urn:problem-type:email_taken","title":"Email already in use","status":409,"detail":"This email is already used by another user","code":"email_taken"}`
 	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
 }
 
 func TestInsertNewUserHandlerFailureStatusCode422(t *testing.T) {
 	service := new(testMocks.MockDBService)
 
-	service.AssertNotCalled(t, "InsertNewUser", mock.Anything)
+	service.AssertNotCalled(t, "InsertNewUser", mock.Anything, mock.Anything)
 
 	s := &sv.Server{
 		Port: 8080,
@@ -315,6 +496,662 @@ func TestInsertNewUserHandlerFailureStatusCode422(t *testing.T) {
 
 	expectedStatusCode := http.StatusUnprocessableEntity
 	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
-	expected := `{"error":"json: cannot unmarshal string into Go value of type domain.User"}`
+	expected := `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"json: cannot unmarshal string into Go value of type domain.User","code":"validation_failed"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetUserByIDHandlerSuccess(t *testing.T) {
+	user := domain.User{
+		ID:       3,
+		Username: "New User",
+		Email:    "NewEmail@github.com",
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("GetUserByID", mock.Anything, 3).Return(user, nil)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/user/:userId", s.GetUserByIDHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/user/3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"id":3,"username":"New User","email":"NewEmail@github.com"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestQueryTimeoutMiddlewareSuccess(t *testing.T) {
+	user := domain.User{
+		ID:       3,
+		Username: "New User",
+		Email:    "NewEmail@github.com",
+	}
+
+	service := new(testMocks.MockDBService)
+	hasDeadline := mock.MatchedBy(func(ctx context.Context) bool {
+		deadline, ok := ctx.Deadline()
+		return ok && time.Until(deadline) <= time.Second
+	})
+	service.On("GetUserByID", hasDeadline, 3).Return(user, nil)
+
+	s := &sv.Server{
+		Port:         8080,
+		Db:           service,
+		QueryTimeout: time.Second,
+	}
+	r := gin.New()
+	r.Use(s.QueryTimeoutMiddleware)
+	r.GET("/user/:userId", s.GetUserByIDHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/user/3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	service.AssertExpectations(t)
+}
+
+func TestGetUserByIDHandlerUserNotFoundFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("GetUserByID", mock.Anything, 12).Return(domain.User{}, &domain.UserNotFoundError{Message: "User with id 12 does not exist"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/user/:userId", s.GetUserByIDHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/user/12", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusNotFound
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:user_not_found","title":"User not found","status":404,"detail":"User with id 12 does not exist","code":"user_not_found"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetUserByIDHandlerUserDeletedFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("GetUserByID", mock.Anything, 12).Return(domain.User{}, &domain.UserDeletedError{Message: "User with id 12 has been deleted"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/user/:userId", s.GetUserByIDHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/user/12", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusGone
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:user_deleted","title":"User has been deleted","status":410,"detail":"User with id 12 has been deleted","code":"user_deleted"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetUserByIDHandlerIdPathNotAnIntFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.AssertNotCalled(t, "GetUserByID", mock.Anything, mock.Anything)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/user/:userId", s.GetUserByIDHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/user/string", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusBadRequest
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:invalid_user_id","title":"Invalid user id","status":400,"detail":"userId must be an integer","code":"invalid_user_id"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestGetUserByIDHandlerDatabaseFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("GetUserByID", mock.Anything, 12).Return(domain.User{}, &domain.UnmappedDatabaseError{Message: "some issue"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/user/:userId", s.GetUserByIDHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/user/12", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusInternalServerError
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:internal_error","title":"Internal server error","status":500,"detail":"The request could not be completed","code":"internal_error"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestUpdateUserHandlerSuccess(t *testing.T) {
+	user := domain.User{
+		Username: "Updated User",
+		Email:    "UpdatedEmail@github.com",
+	}
+	updatedUser := domain.User{
+		ID:       3,
+		Username: "Updated User",
+		Email:    "UpdatedEmail@github.com",
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("UpdateUser", mock.Anything, 3, user, (*int)(nil)).Return(updatedUser, nil)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PUT("/user/:userId", s.UpdateUserHandler)
+
+	jsonData, err := json.Marshal(user)
+	if err != nil {
+		log.Fatalf("Error marshalling payload: %v", err)
+	}
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PUT", "/user/3", bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"id":3,"username":"Updated User","email":"UpdatedEmail@github.com"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestUpdateUserHandlerDuplicateEmailAddressFailure(t *testing.T) {
+	user := domain.User{
+		Username: "Updated User",
+		Email:    "UpdatedEmail@github.com",
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("UpdateUser", mock.Anything, 3, user, (*int)(nil)).Return(domain.User{}, &domain.UniqueConstraintDatabaseError{Message: "This email is not unique"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PUT("/user/:userId", s.UpdateUserHandler)
+
+	jsonData, err := json.Marshal(user)
+	if err != nil {
+		log.Fatalf("Error marshalling payload: %v", err)
+	}
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PUT", "/user/3", bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusConflict
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:email_taken","title":"Email already in use","status":409,"detail":"This email is already used by another user","code":"email_taken"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestUpdateUserHandlerFailureStatusCode422(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.AssertNotCalled(t, "UpdateUser", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PUT("/user/:userId", s.UpdateUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PUT", "/user/3", bytes.NewBufferString(`{"username":"Updated User"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusUnprocessableEntity
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+}
+
+func TestPatchUserHandlerSuccess(t *testing.T) {
+	username := "Patched User"
+	patch := domain.UserPatch{Username: &username}
+	patchedUser := domain.User{
+		ID:       3,
+		Username: "Patched User",
+		Email:    "NewEmail@github.com",
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("PatchUser", mock.Anything, 3, patch, (*int)(nil)).Return(patchedUser, nil)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PATCH("/user/:userId", s.PatchUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PATCH", "/user/3", bytes.NewBufferString(`{"username":"Patched User","id":7}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"id":3,"username":"Patched User","email":"NewEmail@github.com"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestPatchUserHandlerNullMemberFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.AssertNotCalled(t, "PatchUser", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PATCH("/user/:userId", s.PatchUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PATCH", "/user/3", bytes.NewBufferString(`{"email":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusUnprocessableEntity
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"The request body has invalid fields","code":"validation_failed","errors":[{"field":"email","code":"required","message":"email cannot be removed"}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestPatchUserHandlerInvalidEmailFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.AssertNotCalled(t, "PatchUser", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PATCH("/user/:userId", s.PatchUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PATCH", "/user/3", bytes.NewBufferString(`{"email":"not-an-email"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusUnprocessableEntity
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"The request body has invalid fields","code":"validation_failed","errors":[{"field":"email","code":"email","message":"email must be a valid email address"}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestPatchUserHandlerUnsupportedMediaTypeFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.AssertNotCalled(t, "PatchUser", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PATCH("/user/:userId", s.PatchUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PATCH", "/user/3", bytes.NewBufferString(`username=Patched`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusUnsupportedMediaType
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+}
+
+func TestPatchUserHandlerUserNotFoundFailure(t *testing.T) {
+	email := "PatchedEmail@github.com"
+	patch := domain.UserPatch{Email: &email}
+
+	service := new(testMocks.MockDBService)
+	service.On("PatchUser", mock.Anything, 12, patch, (*int)(nil)).Return(domain.User{}, &domain.UserNotFoundError{Message: "User with id 12 does not exist"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.PATCH("/user/:userId", s.PatchUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("PATCH", "/user/12", bytes.NewBufferString(`{"email":"PatchedEmail@github.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusNotFound
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:user_not_found","title":"User not found","status":404,"detail":"User with id 12 does not exist","code":"user_not_found"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestRestoreUserHandlerSuccess(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("RestoreUser", mock.Anything, 12, (*int)(nil)).Return(domain.User{ID: 12, Username: "New User", Email: "NewEmail@github.com"}, nil)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.POST("/user/:userId/restore", s.RestoreUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("POST", "/user/12/restore", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"id":12,"username":"New User","email":"NewEmail@github.com"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestRestoreUserHandlerUserNotFoundFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("RestoreUser", mock.Anything, 12, (*int)(nil)).Return(domain.User{}, &domain.UserNotFoundError{Message: "User with id 12 does not exist"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.POST("/user/:userId/restore", s.RestoreUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("POST", "/user/12/restore", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusNotFound
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:user_not_found","title":"User not found","status":404,"detail":"User with id 12 does not exist","code":"user_not_found"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestRestoreUserHandlerUserNotDeletedFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("RestoreUser", mock.Anything, 12, (*int)(nil)).Return(domain.User{}, &domain.UserNotDeletedError{Message: "User with id 12 has not been deleted"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.POST("/user/:userId/restore", s.RestoreUserHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("POST", "/user/12/restore", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusConflict
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:user_not_deleted","title":"User has not been deleted","status":409,"detail":"User with id 12 has not been deleted","code":"user_not_deleted"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestLivenessHandlerSuccess(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.AssertNotCalled(t, "Health", mock.Anything)
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	r := gin.New()
+	r.GET("/health/live", s.LivenessHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/health/live", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"status":"up"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestReadinessHandlerSuccess(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("Health", mock.Anything).Return(domain.DatabaseHealth{Status: "up", Pool: domain.PoolStats{MaxConnections: 4, TotalConnections: 2, AcquiredConnections: 1, IdleConnections: 1, AcquireDuration: "0s"}, MigrationVersion: 3})
+
+	s := &sv.Server{
+		Port:                     8080,
+		Db:                       service,
+		ExpectedMigrationVersion: 3,
+	}
+	r := gin.New()
+	r.GET("/health/ready", s.ReadinessHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/health/ready", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"database":{"status":"up","pool":{"max_connections":4,"total_connections":2,"acquired_connections":1,"idle_connections":1,"constructing_connections":0,"acquire_count":0,"empty_acquire_count":0,"canceled_acquire_count":0,"acquire_duration":"0s"},"migration_version":3},"status":"up"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestReadinessHandlerDatabaseDownFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("Health", mock.Anything).Return(domain.DatabaseHealth{Status: "down", Error: "connection refused", Pool: domain.PoolStats{AcquireDuration: "0s"}})
+
+	s := &sv.Server{
+		Port:                     8080,
+		Db:                       service,
+		ExpectedMigrationVersion: 3,
+	}
+	r := gin.New()
+	r.GET("/health/ready", s.ReadinessHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/health/ready", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusServiceUnavailable
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"database":{"status":"down","error":"connection refused","pool":{"max_connections":0,"total_connections":0,"acquired_connections":0,"idle_connections":0,"constructing_connections":0,"acquire_count":0,"empty_acquire_count":0,"canceled_acquire_count":0,"acquire_duration":"0s"},"migration_version":0},"status":"down"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestReadinessHandlerMigrationsBehindFailure(t *testing.T) {
+
+	service := new(testMocks.MockDBService)
+	service.On("Health", mock.Anything).Return(domain.DatabaseHealth{Status: "up", Pool: domain.PoolStats{AcquireDuration: "0s"}, MigrationVersion: 2})
+
+	s := &sv.Server{
+		Port:                     8080,
+		Db:                       service,
+		ExpectedMigrationVersion: 3,
+	}
+	r := gin.New()
+	r.GET("/health/ready", s.ReadinessHandler)
+
+	// Create a test HTTP request
+	req, err := http.NewRequest("GET", "/health/ready", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+	// Serve the HTTP request
+	r.ServeHTTP(rr, req)
+
+	expectedStatusCode := http.StatusServiceUnavailable
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"database":{"status":"up","pool":{"max_connections":0,"total_connections":0,"acquired_connections":0,"idle_connections":0,"constructing_connections":0,"acquire_count":0,"empty_acquire_count":0,"canceled_acquire_count":0,"acquire_duration":"0s"},"migration_version":2},"error":"database is at migration 2, expected 3","status":"down"}`
 	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
 }
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	sv "db_access/internal/server"
+)
+
+// serve sends a request through the routes s registers and records the
+// response. The body is sent as JSON unless headers set the Content-Type, and
+// headers with an empty value are not sent.
+func serve(s *sv.Server, method string, target string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, target, body)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		if value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+	return rr
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+
+	"db_access/internal/environment"
+	sv "db_access/internal/server"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDoesNotLogPasswordSuccess(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	config := environment.Default()
+	config.Database.Password = "s3cr3t-pa55word"
+
+	server := sv.New(config, &testMocks.MockDBService{})
+	assert.NotNil(t, server, "New() returned nil")
+
+	assert.Contains(t, output.String(), "Database connection on:", "Expected New() to log the database connection")
+	assert.NotContains(t, output.String(), config.Database.Password, fmt.Sprintf("Expected the log output to never contain the password. [actual]: %v", output.String()))
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"db_access/internal/domain"
+
+	sv "db_access/internal/server"
+	testMocks "db_access/tests/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// multipartFile is a multipart form with content uploaded as file in the
+// field file, or no file when filename is empty, and its Content-Type.
+func multipartFile(filename, content string) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if filename != "" {
+		part, _ := writer.CreateFormFile("file", filename)
+		part.Write([]byte(content))
+	}
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+func TestExportUsersCSVSuccess(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	users := []domain.User{
+		{ID: 1, Username: "first", Email: "first@example.com", CreatedAt: &createdAt, UpdatedAt: &createdAt},
+		{ID: 2, Username: "with, comma", Email: "second@example.com", CreatedAt: &createdAt, UpdatedAt: &createdAt, DeletedAt: &createdAt},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("ExportUsers", mock.Anything, true, mock.Anything).Return(users, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/users/export?include_deleted=true", nil, nil)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"), "Expected a CSV content type")
+	assert.Equal(t, `attachment; filename="users.csv"`, rr.Header().Get("Content-Disposition"), "Expected the export to be downloadable")
+	expected := "id,username,email,created_at,updated_at,deleted_at\n" +
+		"1,first,first@example.com,2024-01-02T03:04:05Z,2024-01-02T03:04:05Z,\n" +
+		"2,\"with, comma\",second@example.com,2024-01-02T03:04:05Z,2024-01-02T03:04:05Z,2024-01-02T03:04:05Z\n"
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestExportUsersNDJSONSuccess(t *testing.T) {
+	users := []domain.User{
+		{ID: 1, Username: "first", Email: "first@example.com"},
+		{ID: 2, Username: "second", Email: "second@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("ExportUsers", mock.Anything, false, mock.Anything).Return(users, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/users/export?format=ndjson", nil, nil)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"), "Expected an NDJSON content type")
+	expected := `{"id":1,"username":"first","email":"first@example.com"}
+{"id":2,"username":"second","email":"second@example.com"}
+`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestExportUsersEmptySuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("ExportUsers", mock.Anything, false, mock.Anything).Return([]domain.User{}, nil)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/users/export", nil, nil)
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := "id,username,email,created_at,updated_at,deleted_at\n"
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestExportUsersDatabaseFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("ExportUsers", mock.Anything, false, mock.Anything).Return([]domain.User{}, &domain.DatabaseTransactionError{Message: "connection refused"})
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/users/export", nil, nil)
+
+	expectedStatusCode := http.StatusServiceUnavailable
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:database_unavailable","title":"Database unavailable","status":503,"detail":"The database could not run the request. Try again later","code":"database_unavailable"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+// TestExportUsersMidStreamFailure checks an export that fails after rows have
+// been sent closes the connection, so the client cannot take the rows it got
+// for the whole export.
+func TestExportUsersMidStreamFailure(t *testing.T) {
+	users := []domain.User{
+		{ID: 1, Username: "first", Email: "first@example.com"},
+		{ID: 2, Username: "second", Email: "second@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("ExportUsers", mock.Anything, false, mock.Anything).Return(users, &domain.UnmappedDatabaseError{Message: "connection reset"})
+
+	s := &sv.Server{
+		Port: 8080,
+		Db:   service,
+	}
+	server := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(server.Close)
+
+	response, err := http.Get(server.URL + "/users/export?format=ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, response.StatusCode, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, response.StatusCode))
+	body, err := io.ReadAll(response.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "Expected the connection to close before the export was complete")
+	expected := `{"id":1,"username":"first","email":"first@example.com"}
+{"id":2,"username":"second","email":"second@example.com"}
+`
+	assert.Equal(t, expected, string(body), fmt.Sprintf("Expected the rows read before the failure to be sent. [actual]: %v", string(body)))
+}
+
+func TestExportUsersInvalidFormatFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	rr := serve(&sv.Server{Db: service}, "GET", "/users/export?format=xml", nil, nil)
+
+	expectedStatusCode := http.StatusBadRequest
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"format must be csv or ndjson","code":"invalid_parameter","parameter":"format"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNotCalled(t, "ExportUsers", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestImportUsersCSVSuccess(t *testing.T) {
+	users := []domain.User{
+		{Username: "first", Email: "first@example.com"},
+		{Username: "second", Email: "second@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, users, domain.BatchInsertOptions{}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+		{Index: 1, Status: domain.BatchUserCreated, ID: 2},
+	}, nil)
+
+	body, contentType := multipartFile("users.csv", "email,username\nfirst@example.com,first\nsecond@example.com,second\n")
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/import", body, map[string]string{"Content-Type": contentType})
+
+	expectedStatusCode := http.StatusCreated
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"dry_run":false,"rows":2,"created":2,"valid":0,"failed":0,"errors":[]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestImportUsersNDJSONPartialFailure(t *testing.T) {
+	valid := []domain.User{
+		{Username: "first", Email: "first@example.com"},
+		{Username: "taken", Email: "taken@example.com"},
+	}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, valid, domain.BatchInsertOptions{}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserCreated, ID: 1},
+		{Index: 1, Status: domain.BatchUserFailed, Error: "email is already used"},
+	}, nil)
+
+	content := `{"username":"first","email":"first@example.com"}
+not json
+
+{"username":"taken","email":"taken@example.com"}
+`
+	body, contentType := multipartFile("users.ndjson", content)
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/import", body, map[string]string{"Content-Type": contentType})
+
+	expectedStatusCode := http.StatusMultiStatus
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"dry_run":false,"rows":3,"created":1,"valid":0,"failed":2,"errors":[{"line":2,"error":"line is not a JSON user object"},{"line":4,"error":"email is already used"}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestImportUsersDryRunSuccess(t *testing.T) {
+	valid := []domain.User{{Username: "first", Email: "first@example.com"}}
+
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, valid, domain.BatchInsertOptions{DryRun: true}).Return([]domain.BatchUserResult{
+		{Index: 0, Status: domain.BatchUserValid},
+	}, nil)
+
+	body, contentType := multipartFile("users.csv", "username,email\nfirst,first@example.com\n,missing@example.com\n")
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/import?dry_run=true", body, map[string]string{"Content-Type": contentType})
+
+	expectedStatusCode := http.StatusOK
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"dry_run":true,"rows":2,"created":0,"valid":1,"failed":1,"errors":[{"line":3,"error":"username is required"}]}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}
+
+func TestImportUsersCSVErrorReportSuccess(t *testing.T) {
+	service := new(testMocks.MockDBService)
+
+	body, contentType := multipartFile("users.csv", "username,email\nfirst,not-an-email\n")
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/import", body, map[string]string{"Content-Type": contentType, "Accept": "text/csv"})
+
+	expectedStatusCode := http.StatusUnprocessableEntity
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	assert.Equal(t, `attachment; filename="import-errors.csv"`, rr.Header().Get("Content-Disposition"), "Expected the error report to be downloadable")
+	expected := "line,error\n2,email must be a valid email address\n"
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+	service.AssertNotCalled(t, "InsertUsers", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestImportUsersInvalidFileFailure(t *testing.T) {
+	tests := []struct {
+		name               string
+		target             string
+		filename           string
+		content            string
+		expectedStatusCode int
+		expected           string
+	}{
+		{name: "no file", target: "/users/import", expectedStatusCode: http.StatusBadRequest, expected: `{"type":"urn:problem-type:unreadable_body","title":"Unreadable request body","status":400,"detail":"a CSV or NDJSON file must be uploaded in the multipart field file","code":"unreadable_body"}`},
+		{name: "unknown format", target: "/users/import", filename: "users.txt", content: "username,email\n", expectedStatusCode: http.StatusBadRequest, expected: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"format must be csv or ndjson","code":"invalid_parameter","parameter":"format"}`},
+		{name: "missing column", target: "/users/import", filename: "users.csv", content: "username\nfirst\n", expectedStatusCode: http.StatusUnprocessableEntity, expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"the CSV header must have a username and an email column","code":"validation_failed"}`},
+		{name: "empty", target: "/users/import?format=csv", filename: "users.txt", content: "username,email\n", expectedStatusCode: http.StatusUnprocessableEntity, expected: `{"type":"urn:problem-type:validation_failed","title":"Validation failed","status":422,"detail":"import file must contain at least one user","code":"validation_failed"}`},
+		{name: "invalid dry run", target: "/users/import?dry_run=perhaps", filename: "users.csv", content: "username,email\n", expectedStatusCode: http.StatusBadRequest, expected: `{"type":"urn:problem-type:invalid_parameter","title":"Invalid query parameter","status":400,"detail":"dry_run must be true or false","code":"invalid_parameter","parameter":"dry_run"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := new(testMocks.MockDBService)
+
+			body, contentType := multipartFile(test.filename, test.content)
+			rr := serve(&sv.Server{Db: service}, "POST", test.target, body, map[string]string{"Content-Type": contentType})
+
+			assert.Equal(t, test.expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", test.expectedStatusCode, rr.Code))
+			assert.Equal(t, test.expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", test.expected, rr.Body.String()))
+			service.AssertNotCalled(t, "InsertUsers", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestImportUsersDatabaseFailure(t *testing.T) {
+	service := new(testMocks.MockDBService)
+	service.On("InsertUsers", mock.Anything, mock.Anything, domain.BatchInsertOptions{}).Return([]domain.BatchUserResult(nil), errors.New("connection reset"))
+
+	body, contentType := multipartFile("users.csv", "username,email\nfirst,first@example.com\n")
+	rr := serve(&sv.Server{Db: service}, "POST", "/users/import", body, map[string]string{"Content-Type": contentType})
+
+	expectedStatusCode := http.StatusInternalServerError
+	assert.Equal(t, expectedStatusCode, rr.Code, fmt.Sprintf("Expected response status to equal %v. [actual]: %v", expectedStatusCode, rr.Code))
+	expected := `{"type":"urn:problem-type:internal_error","title":"Internal server error","status":500,"detail":"The request could not be completed","code":"internal_error"}`
+	assert.Equal(t, expected, rr.Body.String(), fmt.Sprintf("Expected response body to equal %v. [actual]: %v", expected, rr.Body.String()))
+}